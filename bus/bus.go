@@ -0,0 +1,73 @@
+package bus
+
+import (
+	"fmt"
+	"github.com/ircop/ohandler/cfg"
+	"time"
+)
+
+type ConnState string
+
+const (
+	StateDisconnected	ConnState = "disconnected"
+	StateConnected		ConnState = "connected"
+	StateReconnecting	ConnState = "reconnecting"
+)
+
+// Msg is a message, received from durable subscription. It should be acked after processing.
+type Msg interface {
+	Data() []byte
+	Ack() error
+}
+
+type Handler func(msg Msg)
+
+// SubOptions describe durable subscription
+type SubOptions struct {
+	Durable		string
+	MaxInflight	int
+	AckWait		time.Duration
+}
+
+type Subscription interface {
+	// Unsubscribe removes durable subscription, so server forgets it's state
+	Unsubscribe() error
+	// Close stops delivery, but keeps durable subscription: messages wait for the next subscriber
+	Close() error
+}
+
+// Status is a snapshot of bus connection state
+type Status struct {
+	Backend			string		`json:"backend"`
+	State			ConnState	`json:"state"`
+	ClusterID		string		`json:"cluster_id,omitempty"`
+	ClientID		string		`json:"client_id,omitempty"`
+	ConnectedAt		*time.Time	`json:"connected_at"`
+	LastError		string		`json:"last_error"`
+	Reconnects		int64		`json:"reconnects"`
+	Subscriptions	[]string	`json:"subscriptions"`
+}
+
+// Bus is publish/durable subscribe transport between ohandler and it's workers
+type Bus interface {
+	Publish(subject string, data []byte) error
+	Subscribe(subject string, opts SubOptions, handler Handler) (Subscription, error)
+	// OnReconnect sets callback, called after connection was lost and established again
+	OnReconnect(cb func())
+	Status() Status
+	Close() error
+}
+
+// New creates bus with backend, configured in [bus] section
+func New(config *cfg.Cfg) (Bus, error) {
+	switch config.BusBackend {
+	case "", "stan":
+		return NewStan(config)
+	case "jetstream":
+		return NewJetStream(config)
+	case "memory":
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("Unknown bus backend '%s'", config.BusBackend)
+	}
+}
@@ -0,0 +1,271 @@
+package bus
+
+import (
+	"fmt"
+	"github.com/ircop/ohandler/cfg"
+	"github.com/ircop/ohandler/logger"
+	"github.com/nats-io/nats.go"
+	"github.com/sasha-s/go-deadlock"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JetStream is NATS JetStream bus. All subjects are stored in single stream (bus.stream), subjects
+// are added to it when first used. Reconnects are handled by nats client itself.
+type JetStream struct {
+	nc				*nats.Conn
+	js				nats.JetStreamContext
+	stream			string
+	clientID		string
+
+	subjects		map[string]bool
+	subs			map[string]*jsSub
+	onReconnect		func()
+	lastError		string
+	connectedAt		time.Time
+	reconnects		int64
+	mx				deadlock.Mutex
+}
+
+type jsSub struct {
+	bus			*JetStream
+	subject		string
+	durable		string
+	sub			*nats.Subscription
+}
+
+type jsMsg struct {
+	msg		*nats.Msg
+}
+
+func (m *jsMsg) Data() []byte {
+	return m.msg.Data
+}
+
+func (m *jsMsg) Ack() error {
+	return m.msg.Ack()
+}
+
+func NewJetStream(config *cfg.Cfg) (*JetStream, error) {
+	j := &JetStream{
+		stream:config.BusStream,
+		clientID:config.NatsClientID,
+		subjects:make(map[string]bool),
+		subs:make(map[string]*jsSub),
+	}
+
+	nc, err := nats.Connect(config.NatsURL,
+		nats.Name(config.NatsClientID),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(config.NatsReconnectMin),
+		nats.PingInterval(time.Duration(config.NatsPingInterval) * time.Second),
+		nats.MaxPingsOutstanding(config.NatsPingMaxOut),
+		nats.DisconnectErrHandler(j.disconnected),
+		nats.ReconnectHandler(j.reconnected),
+	)
+	if err != nil {
+		return nil, err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	j.nc = nc
+	j.js = js
+	j.connectedAt = time.Now()
+
+	// load already stored subjects, or create stream
+	info, err := js.StreamInfo(j.stream)
+	if err == nats.ErrStreamNotFound {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:j.stream,
+			Subjects:[]string{},
+			Storage:nats.FileStorage,
+		})
+	} else if err == nil {
+		for _, s := range info.Config.Subjects {
+			j.subjects[s] = true
+		}
+	}
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("Cannot init stream '%s': %s", j.stream, err.Error())
+	}
+
+	logger.Log("Connected to NATS JetStream, stream '%s'", j.stream)
+	return j, nil
+}
+
+// ensureSubject adds subject to the stream, if it's not there yet
+func (j *JetStream) ensureSubject(subject string) error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+	if j.subjects[subject] {
+		return nil
+	}
+
+	info, err := j.js.StreamInfo(j.stream)
+	if err != nil {
+		return err
+	}
+	conf := info.Config
+	for _, s := range conf.Subjects {
+		j.subjects[s] = true
+	}
+	if j.subjects[subject] {
+		return nil
+	}
+
+	conf.Subjects = append(conf.Subjects, subject)
+	if _, err = j.js.UpdateStream(&conf); err != nil {
+		return fmt.Errorf("Cannot add subject '%s' to stream '%s': %s", subject, j.stream, err.Error())
+	}
+	j.subjects[subject] = true
+
+	return nil
+}
+
+func (j *JetStream) Publish(subject string, data []byte) error {
+	if err := j.ensureSubject(subject); err != nil {
+		return err
+	}
+	_, err := j.js.Publish(subject, data)
+	return err
+}
+
+func (j *JetStream) Subscribe(subject string, opts SubOptions, handler Handler) (Subscription, error) {
+	if err := j.ensureSubject(subject); err != nil {
+		return nil, err
+	}
+	if opts.Durable == "" {
+		opts.Durable = subject
+	}
+
+	// consumer names can't contain dots
+	durable := strings.Replace(opts.Durable, ".", "_", -1)
+
+	// consumer is created here, not by subscription: nats client deletes consumers it has created,
+	// when their subscription is closed. Bound one is kept with it's undelivered messages.
+	_, err := j.js.ConsumerInfo(j.stream, durable)
+	if err == nats.ErrConsumerNotFound {
+		_, err = j.js.AddConsumer(j.stream, &nats.ConsumerConfig{
+			Durable:durable,
+			DeliverSubject:nats.NewInbox(),
+			DeliverPolicy:nats.DeliverAllPolicy,
+			AckPolicy:nats.AckExplicitPolicy,
+			AckWait:opts.AckWait,
+			MaxAckPending:opts.MaxInflight,
+			FilterSubject:subject,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create consumer '%s': %s", durable, err.Error())
+	}
+
+	sub, err := j.js.Subscribe(subject, func(msg *nats.Msg) {
+			handler(&jsMsg{msg:msg})
+		},
+		nats.Bind(j.stream, durable),
+		nats.ManualAck(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot subscribe to '%s': %s", subject, err.Error())
+	}
+
+	s := &jsSub{
+		bus:j,
+		subject:subject,
+		durable:durable,
+		sub:sub,
+	}
+	j.mx.Lock()
+	j.subs[subject] = s
+	j.mx.Unlock()
+
+	return s, nil
+}
+
+func (s *jsSub) Unsubscribe() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return s.bus.js.DeleteConsumer(s.bus.stream, s.durable)
+}
+
+// Close drains subscription: messages in flight are handled, consumer is kept
+func (s *jsSub) Close() error {
+	j := s.bus
+	j.mx.Lock()
+	delete(j.subs, s.subject)
+	j.mx.Unlock()
+
+	return s.sub.Drain()
+}
+
+func (j *JetStream) disconnected(_ *nats.Conn, err error) {
+	if err == nil {
+		return
+	}
+	logger.Err("NATS connection lost: %s", err.Error())
+	j.mx.Lock()
+	j.lastError = err.Error()
+	j.mx.Unlock()
+}
+
+func (j *JetStream) reconnected(_ *nats.Conn) {
+	j.mx.Lock()
+	j.reconnects++
+	j.connectedAt = time.Now()
+	j.lastError = ""
+	cb := j.onReconnect
+	j.mx.Unlock()
+	logger.Log("NATS connection re-established")
+
+	if cb != nil {
+		go cb()
+	}
+}
+
+func (j *JetStream) OnReconnect(cb func()) {
+	j.mx.Lock()
+	j.onReconnect = cb
+	j.mx.Unlock()
+}
+
+func (j *JetStream) Status() Status {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	st := Status{
+		Backend:"jetstream",
+		ClientID:j.clientID,
+		LastError:j.lastError,
+		Reconnects:j.reconnects,
+		Subscriptions:make([]string, 0, len(j.subs)),
+	}
+	switch j.nc.Status() {
+	case nats.CONNECTED:
+		st.State = StateConnected
+		t := j.connectedAt
+		st.ConnectedAt = &t
+	case nats.RECONNECTING, nats.CONNECTING:
+		st.State = StateReconnecting
+	default:
+		st.State = StateDisconnected
+	}
+	for subject := range j.subs {
+		st.Subscriptions = append(st.Subscriptions, subject)
+	}
+	sort.Strings(st.Subscriptions)
+
+	return st
+}
+
+// Close closes connection without unsubscribing, so durable consumers are kept on server
+func (j *JetStream) Close() error {
+	j.nc.Close()
+	return nil
+}
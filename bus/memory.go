@@ -0,0 +1,158 @@
+package bus
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is in-process bus. Messages published to subject without subscribers are queued
+// and delivered to the first subscriber, like durable subscription would get them.
+// Handlers are called synchronously from Publish.
+type Memory struct {
+	subs		map[string][]*memorySub
+	pending		map[string][][]byte
+	closed		bool
+	createdAt	time.Time
+	mx			sync.Mutex
+}
+
+type memorySub struct {
+	bus			*Memory
+	subject		string
+	handler		Handler
+}
+
+type memoryMsg struct {
+	data		[]byte
+	acked		bool
+	mx			sync.Mutex
+}
+
+func (m *memoryMsg) Data() []byte {
+	return m.data
+}
+
+func (m *memoryMsg) Ack() error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.acked {
+		return fmt.Errorf("Message is already acked")
+	}
+	m.acked = true
+	return nil
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		subs:make(map[string][]*memorySub),
+		pending:make(map[string][][]byte),
+		createdAt:time.Now(),
+	}
+}
+
+func (m *Memory) Publish(subject string, data []byte) error {
+	m.mx.Lock()
+	if m.closed {
+		m.mx.Unlock()
+		return fmt.Errorf("Bus is closed")
+	}
+	subs := m.subs[subject]
+	if len(subs) == 0 {
+		m.pending[subject] = append(m.pending[subject], data)
+		m.mx.Unlock()
+		return nil
+	}
+	subs = append([]*memorySub{}, subs...)
+	m.mx.Unlock()
+
+	// handlers are called without lock, so they can publish too
+	for _, s := range subs {
+		s.handler(&memoryMsg{data:data})
+	}
+
+	return nil
+}
+
+func (m *Memory) Subscribe(subject string, opts SubOptions, handler Handler) (Subscription, error) {
+	m.mx.Lock()
+	if m.closed {
+		m.mx.Unlock()
+		return nil, fmt.Errorf("Bus is closed")
+	}
+	s := &memorySub{
+		bus:m,
+		subject:subject,
+		handler:handler,
+	}
+	m.subs[subject] = append(m.subs[subject], s)
+	queued := m.pending[subject]
+	delete(m.pending, subject)
+	m.mx.Unlock()
+
+	for _, data := range queued {
+		handler(&memoryMsg{data:data})
+	}
+
+	return s, nil
+}
+
+func (s *memorySub) Unsubscribe() error {
+	m := s.bus
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	subs := m.subs[s.subject]
+	for i := range subs {
+		if subs[i] == s {
+			m.subs[s.subject] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(m.subs[s.subject]) == 0 {
+		delete(m.subs, s.subject)
+	}
+
+	return nil
+}
+
+// Close is the same as Unsubscribe: messages without subscribers are queued for the next one anyway
+func (s *memorySub) Close() error {
+	return s.Unsubscribe()
+}
+
+// OnReconnect does nothing: memory bus is never disconnected
+func (m *Memory) OnReconnect(cb func()) {
+}
+
+func (m *Memory) Status() Status {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	st := Status{
+		Backend:"memory",
+		State:StateConnected,
+		Subscriptions:make([]string, 0, len(m.subs)),
+	}
+	if m.closed {
+		st.State = StateDisconnected
+	} else {
+		t := m.createdAt
+		st.ConnectedAt = &t
+	}
+	for subject := range m.subs {
+		st.Subscriptions = append(st.Subscriptions, subject)
+	}
+	sort.Strings(st.Subscriptions)
+
+	return st
+}
+
+func (m *Memory) Close() error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.closed = true
+	m.subs = make(map[string][]*memorySub)
+	return nil
+}
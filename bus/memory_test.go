@@ -0,0 +1,63 @@
+package bus
+
+import (
+	"testing"
+)
+
+func collect(b *Memory, subject string) (*[]string, Subscription, error) {
+	got := make([]string, 0)
+	sub, err := b.Subscribe(subject, SubOptions{}, func(msg Msg) {
+		got = append(got, string(msg.Data()))
+		msg.Ack()
+	})
+	return &got, sub, err
+}
+
+func TestMemoryQueuesUntilSubscribed(t *testing.T) {
+	b := NewMemory()
+	b.Publish("tasks", []byte("one"))
+	b.Publish("tasks", []byte("two"))
+
+	got, _, err := collect(b, "tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("tasks", []byte("three"))
+
+	if len(*got) != 3 || (*got)[0] != "one" || (*got)[1] != "two" || (*got)[2] != "three" {
+		t.Errorf("unexpected messages: %v", *got)
+	}
+}
+
+func TestMemoryUnsubscribe(t *testing.T) {
+	b := NewMemory()
+	got, sub, _ := collect(b, "db")
+	b.Publish("db", []byte("one"))
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("db", []byte("two"))
+
+	if len(*got) != 1 {
+		t.Errorf("expected 1 message, got %v", *got)
+	}
+	if len(b.Status().Subscriptions) != 0 {
+		t.Errorf("subscription is still listed: %v", b.Status().Subscriptions)
+	}
+
+	// message published after unsubscribe waits for next subscriber
+	got, _, _ = collect(b, "db")
+	if len(*got) != 1 || (*got)[0] != "two" {
+		t.Errorf("queued message was not delivered: %v", *got)
+	}
+}
+
+func TestMemoryAck(t *testing.T) {
+	msg := &memoryMsg{data:[]byte("x")}
+	if err := msg.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Ack(); err == nil {
+		t.Errorf("double ack should fail")
+	}
+}
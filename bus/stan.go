@@ -0,0 +1,290 @@
+package bus
+
+import (
+	"fmt"
+	"github.com/ircop/ohandler/cfg"
+	"github.com/ircop/ohandler/logger"
+	nats "github.com/nats-io/go-nats-streaming"
+	"github.com/sasha-s/go-deadlock"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stan is NATS Streaming bus. It reconnects with backoff and re-establishes durable subscriptions.
+type Stan struct {
+	conn			nats.Conn
+	url				string
+	clusterID		string
+	clientID		string
+	config			*cfg.Cfg
+
+	subs			map[string]*stanSub
+	onReconnect		func()
+	state			ConnState
+	lastError		string
+	connectedAt		time.Time
+	reconnects		int64
+	closed			bool
+	mx				deadlock.Mutex
+}
+
+// stanSub keeps everything needed to re-establish subscription after reconnect
+type stanSub struct {
+	bus			*Stan
+	subject		string
+	opts		SubOptions
+	handler		Handler
+	sub			nats.Subscription
+}
+
+type stanMsg struct {
+	msg		*nats.Msg
+}
+
+func (m *stanMsg) Data() []byte {
+	return m.msg.Data
+}
+
+func (m *stanMsg) Ack() error {
+	return m.msg.Ack()
+}
+
+func NewStan(config *cfg.Cfg) (*Stan, error) {
+	clientID := config.NatsClientID
+	if clientID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot discover hostname: %s", err.Error())
+		}
+		clientID = strings.Replace(hostname, ".", "-", -1) + "-client"
+	}
+
+	s := &Stan{
+		url:config.NatsURL,
+		clusterID:config.NatsClusterID,
+		clientID:clientID,
+		config:config,
+		subs:make(map[string]*stanSub),
+		state:StateDisconnected,
+	}
+
+	return s, s.connect()
+}
+
+func (s *Stan) Subscribe(subject string, opts SubOptions, handler Handler) (Subscription, error) {
+	if opts.Durable == "" {
+		opts.Durable = subject
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	sub := &stanSub{
+		bus:s,
+		subject:subject,
+		opts:opts,
+		handler:handler,
+	}
+	s.subs[subject] = sub
+
+	if s.conn == nil {
+		// will be subscribed on reconnect
+		return sub, nil
+	}
+	return sub, s.subscribe(s.conn, sub)
+}
+
+func (sub *stanSub) Unsubscribe() error {
+	s := sub.bus
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.subs, sub.subject)
+
+	if sub.sub == nil || s.conn == nil {
+		return nil
+	}
+	return sub.sub.Unsubscribe()
+}
+
+func (sub *stanSub) Close() error {
+	s := sub.bus
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.subs, sub.subject)
+
+	if sub.sub == nil || s.conn == nil {
+		return nil
+	}
+	return sub.sub.Close()
+}
+
+func (s *Stan) subscribe(conn nats.Conn, sub *stanSub) error {
+	var err error
+	sub.sub, err = conn.Subscribe(sub.subject, func(msg *nats.Msg) {
+			sub.handler(&stanMsg{msg:msg})
+		},
+		nats.DurableName(sub.opts.Durable),
+		nats.MaxInflight(sub.opts.MaxInflight),
+		nats.SetManualAckMode(),
+		nats.AckWait(sub.opts.AckWait),
+	)
+	if err != nil {
+		return fmt.Errorf("Cannot subscribe to '%s': %s", sub.subject, err.Error())
+	}
+
+	return nil
+}
+
+// connect opens new streaming connection and (re)subscribes all durable subscriptions
+func (s *Stan) connect() error {
+	conn, err := nats.Connect(s.clusterID, s.clientID,
+		nats.NatsURL(s.url),
+		nats.Pings(s.config.NatsPingInterval, s.config.NatsPingMaxOut),
+		nats.SetConnectionLostHandler(s.connectionLost),
+	)
+	if err != nil {
+		s.setError(err)
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	// closed while connecting
+	if s.closed {
+		conn.Close()
+		return fmt.Errorf("Bus is closed")
+	}
+	for _, sub := range s.subs {
+		if err = s.subscribe(conn, sub); err != nil {
+			conn.Close()
+			s.lastError = err.Error()
+			return err
+		}
+	}
+
+	s.conn = conn
+	s.state = StateConnected
+	s.connectedAt = time.Now()
+	s.lastError = ""
+
+	logger.Log("Connected to NATS cluster '%s' as '%s'", s.clusterID, s.clientID)
+	return nil
+}
+
+// connectionLost is called by the streaming library when server pings are not answered
+func (s *Stan) connectionLost(_ nats.Conn, reason error) {
+	logger.Err("NATS connection lost: %s", reason.Error())
+
+	s.mx.Lock()
+	if s.state == StateReconnecting || s.closed {
+		s.mx.Unlock()
+		return
+	}
+	s.conn = nil
+	s.state = StateReconnecting
+	s.lastError = reason.Error()
+	s.mx.Unlock()
+
+	go s.reconnect()
+}
+
+// reconnect tries to connect again with exponential backoff, until success or Close
+func (s *Stan) reconnect() {
+	delay := s.config.NatsReconnectMin
+	for {
+		time.Sleep(delay)
+
+		s.mx.Lock()
+		closed := s.closed
+		s.mx.Unlock()
+		if closed {
+			return
+		}
+
+		if err := s.connect(); err != nil {
+			logger.Err("NATS reconnect failed (next try in %s): %s", delay.String(), err.Error())
+			delay *= 2
+			if delay > s.config.NatsReconnectMax {
+				delay = s.config.NatsReconnectMax
+			}
+			continue
+		}
+
+		s.mx.Lock()
+		s.reconnects++
+		cb := s.onReconnect
+		s.mx.Unlock()
+		logger.Log("NATS connection re-established")
+
+		if cb != nil {
+			go cb()
+		}
+		return
+	}
+}
+
+func (s *Stan) setError(err error) {
+	s.mx.Lock()
+	s.lastError = err.Error()
+	s.mx.Unlock()
+}
+
+func (s *Stan) OnReconnect(cb func()) {
+	s.mx.Lock()
+	s.onReconnect = cb
+	s.mx.Unlock()
+}
+
+// Publish sends message to given subject and waits for server ACK.
+// Returns error if there is no active connection or message was not acked.
+func (s *Stan) Publish(subject string, data []byte) error {
+	s.mx.Lock()
+	conn := s.conn
+	s.mx.Unlock()
+	if conn == nil {
+		return fmt.Errorf("NATS is not connected")
+	}
+
+	return conn.Publish(subject, data)
+}
+
+// Status returns current connection state
+func (s *Stan) Status() Status {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	st := Status{
+		Backend:"stan",
+		State:s.state,
+		ClusterID:s.clusterID,
+		ClientID:s.clientID,
+		LastError:s.lastError,
+		Reconnects:s.reconnects,
+		Subscriptions:make([]string, 0, len(s.subs)),
+	}
+	if s.state == StateConnected {
+		t := s.connectedAt
+		st.ConnectedAt = &t
+	}
+	for subject := range s.subs {
+		st.Subscriptions = append(st.Subscriptions, subject)
+	}
+	sort.Strings(st.Subscriptions)
+
+	return st
+}
+
+// Close closes connection without removing durable subscriptions
+func (s *Stan) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.closed = true
+	s.state = StateDisconnected
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
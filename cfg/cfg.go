@@ -2,6 +2,8 @@ package cfg
 
 import (
 	"github.com/spf13/viper"
+	"os"
+	"time"
 )
 
 // Cfg is struct for handling config parameters
@@ -10,6 +12,48 @@ type Cfg struct {
 	NatsTasks		string
 	NatsReplies		string
 	NatsDB			string
+	NatsClusterID	string
+	NatsClientID	string
+
+	NatsRepliesInflight	int
+	NatsRepliesAckWait	time.Duration
+	NatsDBInflight		int
+	NatsDBAckWait		time.Duration
+	NatsPingInflight	int
+	NatsPingAckWait		time.Duration
+
+	NatsReconnectMin	time.Duration
+	NatsReconnectMax	time.Duration
+	NatsPingInterval	int
+	NatsPingMaxOut		int
+
+	BusBackend		string
+	BusStream		string
+
+	BoxTimeout		time.Duration
+	BoxRunsRetention	time.Duration
+	BoxHoldDeletions	int
+	BoxLinkMaxAge		time.Duration
+	BoxFdbRetention		time.Duration
+	BoxArpRetention		time.Duration
+
+	SchedMaxInflight	int
+	SchedMaxPerDomain	int
+	SchedJitter			time.Duration
+	SchedMaxBackoff		time.Duration
+
+	ClusterEnabled		bool
+	ClusterInstance		string
+	ClusterLockID		int64
+	ClusterCheckInterval	time.Duration
+	ClusterDBHost		string
+	ClusterDBPort		int
+
+	ShutdownTimeout		time.Duration
+
+	DbSyncInterval		time.Duration
+	DbSyncMaxChanges	int
+	DbSyncRetention		time.Duration
 
 	LogDir			string
 
@@ -40,10 +84,87 @@ func NewCfg(path string) (*Cfg, error) {
 
 	c := new(Cfg)
 
+	// defaults are the values that were hardcoded in streamer before
+	viper.SetDefault("nats.cluster-id", "test-cluster")
+	viper.SetDefault("nats.replies-inflight", 300)
+	viper.SetDefault("nats.replies-ack-wait", time.Minute * 15)
+	viper.SetDefault("nats.db-inflight", 10)
+	viper.SetDefault("nats.db-ack-wait", time.Minute * 3)
+	viper.SetDefault("nats.ping-inflight", 5000)
+	viper.SetDefault("nats.ping-ack-wait", time.Minute)
+	viper.SetDefault("nats.reconnect-min", time.Second)
+	viper.SetDefault("nats.reconnect-max", time.Minute)
+	viper.SetDefault("nats.ping-interval", 5)
+	viper.SetDefault("nats.ping-max-out", 3)
+	viper.SetDefault("bus.backend", "stan")
+	viper.SetDefault("bus.stream", "OHANDLER")
+	viper.SetDefault("box.timeout", time.Minute * 15)
+	viper.SetDefault("box.runs-retention", time.Hour * 24 * 30)
+	viper.SetDefault("box.hold-deletions", 100)
+	viper.SetDefault("box.link-max-age", time.Hour * 24 * 7)
+	viper.SetDefault("box.fdb-retention", time.Hour * 24 * 30)
+	viper.SetDefault("box.arp-retention", time.Hour * 24 * 90)
+	viper.SetDefault("scheduler.max-inflight", 500)
+	viper.SetDefault("scheduler.max-inflight-domain", 0)
+	viper.SetDefault("scheduler.jitter", time.Minute * 3)
+	viper.SetDefault("scheduler.max-backoff", time.Hour * 24)
+	viper.SetDefault("cluster.enabled", false)
+	viper.SetDefault("cluster.lock-id", 731001)
+	viper.SetDefault("cluster.check-interval", time.Second * 2)
+	viper.SetDefault("shutdown.timeout", time.Minute)
+	viper.SetDefault("db-sync.interval", time.Minute * 15)
+	viper.SetDefault("db-sync.max-changes", 5000)
+	viper.SetDefault("db-sync.retention", time.Hour * 24)
+
 	c.NatsURL = viper.GetString("nats.url")
 	c.NatsTasks = viper.GetString("nats.tasks-chan")
 	c.NatsReplies = viper.GetString("nats.replies-chan")
 	c.NatsDB = viper.GetString("nats.db-chan")
+	c.NatsClusterID = viper.GetString("nats.cluster-id")
+	c.NatsClientID = viper.GetString("nats.client-id")
+
+	c.NatsRepliesInflight = viper.GetInt("nats.replies-inflight")
+	c.NatsRepliesAckWait = viper.GetDuration("nats.replies-ack-wait")
+	c.NatsDBInflight = viper.GetInt("nats.db-inflight")
+	c.NatsDBAckWait = viper.GetDuration("nats.db-ack-wait")
+	c.NatsPingInflight = viper.GetInt("nats.ping-inflight")
+	c.NatsPingAckWait = viper.GetDuration("nats.ping-ack-wait")
+
+	c.NatsReconnectMin = viper.GetDuration("nats.reconnect-min")
+	c.NatsReconnectMax = viper.GetDuration("nats.reconnect-max")
+	c.NatsPingInterval = viper.GetInt("nats.ping-interval")
+	c.NatsPingMaxOut = viper.GetInt("nats.ping-max-out")
+
+	c.BusBackend = viper.GetString("bus.backend")
+	c.BusStream = viper.GetString("bus.stream")
+
+	c.BoxTimeout = viper.GetDuration("box.timeout")
+	c.BoxRunsRetention = viper.GetDuration("box.runs-retention")
+	c.BoxHoldDeletions = viper.GetInt("box.hold-deletions")
+	c.BoxLinkMaxAge = viper.GetDuration("box.link-max-age")
+	c.BoxFdbRetention = viper.GetDuration("box.fdb-retention")
+	c.BoxArpRetention = viper.GetDuration("box.arp-retention")
+
+	c.SchedMaxInflight = viper.GetInt("scheduler.max-inflight")
+	c.SchedMaxPerDomain = viper.GetInt("scheduler.max-inflight-domain")
+	c.SchedJitter = viper.GetDuration("scheduler.jitter")
+	c.SchedMaxBackoff = viper.GetDuration("scheduler.max-backoff")
+
+	c.ClusterEnabled = viper.GetBool("cluster.enabled")
+	c.ClusterInstance = viper.GetString("cluster.instance")
+	if c.ClusterInstance == "" {
+		c.ClusterInstance, _ = os.Hostname()
+	}
+	c.ClusterLockID = viper.GetInt64("cluster.lock-id")
+	c.ClusterCheckInterval = viper.GetDuration("cluster.check-interval")
+	c.ClusterDBHost = viper.GetString("cluster.db-host")
+	c.ClusterDBPort = viper.GetInt("cluster.db-port")
+
+	c.ShutdownTimeout = viper.GetDuration("shutdown.timeout")
+
+	c.DbSyncInterval = viper.GetDuration("db-sync.interval")
+	c.DbSyncMaxChanges = viper.GetInt("db-sync.max-changes")
+	c.DbSyncRetention = viper.GetDuration("db-sync.retention")
 
 	c.DBHost = viper.GetString("db.host")
 	c.DBPort = viper.GetInt("db.port")
@@ -0,0 +1,193 @@
+package cluster
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/cfg"
+	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/logger"
+	"github.com/sasha-s/go-deadlock"
+	"time"
+)
+
+// Node is elector of this instance, started by Init
+var Node *Elector
+
+// locker is leadership lock; it's released by itself when holder dies
+type locker interface {
+	// TryLock takes lock, if it's free
+	TryLock() (bool, error)
+	// Holds checks that lock is still held by us
+	Holds() (bool, error)
+}
+
+// Elector takes part in leader election. Leader owns scheduling, db sync and ping updates handling;
+// followers serve REST only and try to take leadership every check interval.
+type Elector struct {
+	instance	string
+	enabled		bool
+	interval	time.Duration
+	lock		locker
+	onElected	func()
+	onDemoted	func()
+
+	leader		bool
+	since		time.Time
+	elections	int64
+	lastError	string
+	MX			deadlock.Mutex
+}
+
+type Status struct {
+	Enabled		bool		`json:"enabled"`
+	Instance	string		`json:"instance"`
+	Leader		bool		`json:"leader"`
+	Since		time.Time	`json:"since"`
+	Elections	int64		`json:"elections"`
+	LastError	string		`json:"last_error"`
+}
+
+// Init starts leader election. When cluster mode is disabled, this instance becomes leader immediately.
+// onElected and onDemoted are called from election loop, one at a time.
+func Init(config *cfg.Cfg, onElected func(), onDemoted func()) {
+	Node = &Elector{
+		instance:config.ClusterInstance,
+		enabled:config.ClusterEnabled,
+		interval:config.ClusterCheckInterval,
+		onElected:onElected,
+		onDemoted:onDemoted,
+	}
+
+	if !config.ClusterEnabled {
+		Node.elect()
+		return
+	}
+
+	Node.lock = newPgLock(db.Session(config.ClusterDBHost, config.ClusterDBPort), config.ClusterLockID)
+	logger.Log("Cluster mode: instance '%s', waiting for leadership...", Node.instance)
+	go Node.run()
+}
+
+// IsLeader returns true if this instance is the leader
+func IsLeader() bool {
+	if Node == nil {
+		return false
+	}
+	return Node.IsLeader()
+}
+
+func (e *Elector) IsLeader() bool {
+	e.MX.Lock()
+	defer e.MX.Unlock()
+	return e.leader
+}
+
+func (e *Elector) Status() Status {
+	e.MX.Lock()
+	defer e.MX.Unlock()
+	return Status{
+		Enabled:e.enabled,
+		Instance:e.instance,
+		Leader:e.leader,
+		Since:e.since,
+		Elections:e.elections,
+		LastError:e.lastError,
+	}
+}
+
+func (e *Elector) run() {
+	for {
+		e.check()
+		time.Sleep(e.interval)
+	}
+}
+
+// check verifies that leader still holds the lock, or tries to take it if we are follower
+func (e *Elector) check() {
+	if e.IsLeader() {
+		holds, err := e.lock.Holds()
+		if err != nil {
+			// lock session may be gone, so somebody else may be the leader already
+			logger.Err("Cluster: cannot check leadership lock: %s", err.Error())
+			e.setError(err)
+			e.demote()
+			return
+		}
+		if !holds {
+			logger.Err("Cluster: leadership lock is lost")
+			e.demote()
+		}
+		return
+	}
+
+	ok, err := e.lock.TryLock()
+	if err != nil {
+		logger.Err("Cluster: cannot take leadership lock: %s", err.Error())
+		e.setError(err)
+		return
+	}
+	if ok {
+		e.elect()
+	}
+}
+
+func (e *Elector) setError(err error) {
+	e.MX.Lock()
+	e.lastError = err.Error()
+	e.MX.Unlock()
+}
+
+func (e *Elector) elect() {
+	e.MX.Lock()
+	e.leader = true
+	e.since = time.Now()
+	e.elections++
+	e.MX.Unlock()
+
+	logger.Log("Cluster: instance '%s' is the leader now", e.instance)
+	if e.onElected != nil {
+		e.onElected()
+	}
+}
+
+func (e *Elector) demote() {
+	e.MX.Lock()
+	e.leader = false
+	e.since = time.Now()
+	e.MX.Unlock()
+
+	logger.Log("Cluster: instance '%s' is follower now", e.instance)
+	if e.onDemoted != nil {
+		e.onDemoted()
+	}
+}
+
+// pgLock is postgres session-level advisory lock. Postgres releases it when session is closed,
+// so leader process death frees leadership immediately.
+type pgLock struct {
+	db		*pg.DB
+	id		int64
+}
+
+func newPgLock(session *pg.DB, id int64) *pgLock {
+	return &pgLock{db:session, id:id}
+}
+
+func (l *pgLock) TryLock() (bool, error) {
+	// detect dead peers fast: leader host may disappear without closing it's connection
+	if _, err := l.db.Exec(`SET tcp_keepalives_idle = 5; SET tcp_keepalives_interval = 2; SET tcp_keepalives_count = 3`); err != nil {
+		return false, err
+	}
+
+	var ok bool
+	_, err := l.db.QueryOne(pg.Scan(&ok), `SELECT pg_try_advisory_lock(?)`, l.id)
+	return ok, err
+}
+
+func (l *pgLock) Holds() (bool, error) {
+	// single-key advisory lock is stored as classid (high half of key), objid (low half), objsubid = 1
+	var cnt int
+	_, err := l.db.QueryOne(pg.Scan(&cnt), `SELECT count(*) FROM pg_locks WHERE locktype = 'advisory'
+		AND classid = ? AND objid = ? AND objsubid = 1 AND granted AND pid = pg_backend_pid()`,
+		uint32(l.id >> 32), uint32(l.id))
+	return cnt > 0, err
+}
@@ -0,0 +1,63 @@
+package cluster
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeLock struct {
+	free	bool
+	held	bool
+	err		error
+}
+
+func (l *fakeLock) TryLock() (bool, error) {
+	if l.err != nil {
+		return false, l.err
+	}
+	if l.free {
+		l.free = false
+		l.held = true
+		return true, nil
+	}
+	return false, nil
+}
+
+func (l *fakeLock) Holds() (bool, error) {
+	return l.held, l.err
+}
+
+func TestElection(t *testing.T) {
+	lock := &fakeLock{}
+	elected, demoted := 0, 0
+	e := &Elector{
+		enabled:true,
+		lock:lock,
+		onElected:func() { elected++ },
+		onDemoted:func() { demoted++ },
+	}
+
+	// lock is held by other instance
+	e.check()
+	if e.IsLeader() || elected != 0 {
+		t.Fatalf("should stay follower while lock is busy")
+	}
+
+	// leader died
+	lock.free = true
+	e.check()
+	e.check()
+	if !e.IsLeader() || elected != 1 {
+		t.Fatalf("should be elected once, got leader=%v elected=%d", e.IsLeader(), elected)
+	}
+
+	// lock session is broken
+	lock.err = errors.New("connection reset")
+	e.check()
+	if e.IsLeader() || demoted != 1 {
+		t.Fatalf("should be demoted on lock error, got leader=%v demoted=%d", e.IsLeader(), demoted)
+	}
+	if e.Status().LastError == "" {
+		t.Fatalf("last error is not set")
+	}
+}
@@ -3,17 +3,22 @@ package db
 import (
 	"github.com/go-pg/pg"
 	"fmt"
+	"net"
 )
 
 var DB *pg.DB
 
+// options of main connection, used for dedicated sessions
+var options *pg.Options
+
 func InitDB(host string, port int, dbname string, user string, password string) error {
-	DB = pg.Connect(&pg.Options{
+	options = &pg.Options{
 		Addr:		fmt.Sprintf("%s:%d", host, port),
 		User:		user,
 		Password:   password,
 		Database:	dbname,
-	})
+	}
+	DB = pg.Connect(options)
 
 	var n int
 	_, err := DB.QueryOne(pg.Scan(&n), "SELECT 1")
@@ -23,3 +28,24 @@ func InitDB(host string, port int, dbname string, user string, password string)
 
 	return nil
 }
+
+// Session returns separate single-connection DB handle, for session-level stuff like advisory locks.
+// Non-empty host and non-zero port override main connection ones (e.g. to bypass connection pooler).
+func Session(host string, port int) *pg.DB {
+	opts := *options
+	if host != "" || port != 0 {
+		h, p, err := net.SplitHostPort(opts.Addr)
+		if err == nil {
+			if host != "" {
+				h = host
+			}
+			if port != 0 {
+				p = fmt.Sprintf("%d", port)
+			}
+			opts.Addr = h + ":" + p
+		}
+	}
+	opts.PoolSize = 1
+
+	return pg.Connect(&opts)
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"fmt"
+	"github.com/go-pg/pg"
+)
+
+// schema holds DDL for tables and columns added after the initial database layout.
+// Every statement must be idempotent: all of them are executed on each start.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS domains (
+		id			bigserial PRIMARY KEY,
+		name		text NOT NULL UNIQUE,
+		created_at	timestamptz NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE objects ADD COLUMN IF NOT EXISTS domain_id bigint REFERENCES domains(id)`,
+	`CREATE TABLE IF NOT EXISTS object_states (
+		id			bigserial PRIMARY KEY,
+		object_id	bigint NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+		alive		boolean NOT NULL,
+		changed_at	timestamptz NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS object_states_object_id_changed_at ON object_states (object_id, changed_at)`,
+	`CREATE TABLE IF NOT EXISTS db_changes (
+		seq			bigserial PRIMARY KEY,
+		object_id	bigint NOT NULL,
+		domain_id	bigint NOT NULL DEFAULT 0,
+		removed		boolean NOT NULL DEFAULT false,
+		created_at	timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS db_changes_domain_id_seq ON db_changes (domain_id, seq)`,
+	`ALTER TABLE profiles_discovery ADD COLUMN IF NOT EXISTS task_intervals jsonb`,
+	`ALTER TABLE objects ADD COLUMN IF NOT EXISTS task_runs jsonb`,
+	`CREATE TABLE IF NOT EXISTS discovery_runs (
+		id			bigserial PRIMARY KEY,
+		object_id	bigint NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+		request_id	text,
+		started_at	timestamptz NOT NULL,
+		finished_at	timestamptz NOT NULL,
+		outcome		text NOT NULL,
+		error		text,
+		tasks		text[],
+		errors		jsonb,
+		changes		jsonb
+	)`,
+	`CREATE INDEX IF NOT EXISTS discovery_runs_object_id_started_at ON discovery_runs (object_id, started_at)`,
+	`CREATE TABLE IF NOT EXISTS maintenances (
+		id			bigserial PRIMARY KEY,
+		title		text NOT NULL DEFAULT '',
+		start_at	timestamptz NOT NULL,
+		end_at		timestamptz NOT NULL,
+		recurrence	text NOT NULL DEFAULT '',
+		until		timestamptz,
+		object_ids	bigint[],
+		segment_ids	bigint[],
+		created_at	timestamptz NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE object_states ADD COLUMN IF NOT EXISTS maintenance boolean NOT NULL DEFAULT false`,
+	`CREATE TABLE IF NOT EXISTS box_requests (
+		request_id	text PRIMARY KEY,
+		object_id	bigint NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+		tasks		text[],
+		sent_at		timestamptz NOT NULL,
+		expires_at	timestamptz NOT NULL
+	)`,
+	// instance, that sent request and applies it's reply
+	`ALTER TABLE box_requests ADD COLUMN IF NOT EXISTS instance text NOT NULL DEFAULT ''`,
+	// changes of cached tables are announced as {"table": ..., "op": ..., "id": ...} to 'ohandler_changes'
+	`CREATE OR REPLACE FUNCTION ohandler_notify() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_notify('ohandler_changes', json_build_object(
+			'table', TG_TABLE_NAME,
+			'op', TG_OP,
+			'id', CASE WHEN TG_OP = 'DELETE' THEN OLD.id ELSE NEW.id END
+		)::text);
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql`,
+	// objects are updated by discovery all the time: only columns that matter for scheduling and polling are watched
+	`DROP TRIGGER IF EXISTS objects_notify ON objects`,
+	`CREATE TRIGGER objects_notify AFTER INSERT OR DELETE ON objects
+		FOR EACH ROW EXECUTE PROCEDURE ohandler_notify()`,
+	`DROP TRIGGER IF EXISTS objects_notify_update ON objects`,
+	`CREATE TRIGGER objects_notify_update AFTER UPDATE ON objects FOR EACH ROW
+		WHEN ((OLD.name, OLD.mgmt, OLD.auth_id, OLD.discovery_id, OLD.profile_id, OLD.domain_id)
+			IS DISTINCT FROM (NEW.name, NEW.mgmt, NEW.auth_id, NEW.discovery_id, NEW.profile_id, NEW.domain_id))
+		EXECUTE PROCEDURE ohandler_notify()`,
+	`DROP TRIGGER IF EXISTS profiles_auth_notify ON profiles_auth`,
+	`CREATE TRIGGER profiles_auth_notify AFTER INSERT OR UPDATE OR DELETE ON profiles_auth
+		FOR EACH ROW EXECUTE PROCEDURE ohandler_notify()`,
+	`DROP TRIGGER IF EXISTS profiles_discovery_notify ON profiles_discovery`,
+	`CREATE TRIGGER profiles_discovery_notify AFTER INSERT OR UPDATE OR DELETE ON profiles_discovery
+		FOR EACH ROW EXECUTE PROCEDURE ohandler_notify()`,
+	`DROP TRIGGER IF EXISTS domains_notify ON domains`,
+	`CREATE TRIGGER domains_notify AFTER INSERT OR UPDATE OR DELETE ON domains
+		FOR EACH ROW EXECUTE PROCEDURE ohandler_notify()`,
+	`DROP TRIGGER IF EXISTS maintenances_notify ON maintenances`,
+	`CREATE TRIGGER maintenances_notify AFTER INSERT OR UPDATE OR DELETE ON maintenances
+		FOR EACH ROW EXECUTE PROCEDURE ohandler_notify()`,
+	`CREATE TABLE IF NOT EXISTS pending_changesets (
+		id			bigserial PRIMARY KEY,
+		object_id	bigint NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+		request_id	text NOT NULL DEFAULT '',
+		created_at	timestamptz NOT NULL DEFAULT now(),
+		deletions	integer NOT NULL DEFAULT 0,
+		changeset	jsonb NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS pending_changesets_object_id ON pending_changesets (object_id)`,
+	// no reference to objects: history outlives removed objects
+	`CREATE TABLE IF NOT EXISTS change_events (
+		id			bigserial PRIMARY KEY,
+		object_id	bigint NOT NULL,
+		entity		text NOT NULL,
+		entity_id	bigint NOT NULL DEFAULT 0,
+		key			text NOT NULL DEFAULT '',
+		action		text NOT NULL,
+		old_value	jsonb,
+		new_value	jsonb,
+		source		text NOT NULL,
+		created_at	timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS change_events_object_id ON change_events (object_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS change_events_created_at ON change_events (created_at)`,
+	`ALTER TABLE interfaces ADD COLUMN IF NOT EXISTS admin_status text`,
+	`ALTER TABLE interfaces ADD COLUMN IF NOT EXISTS oper_status text`,
+	`ALTER TABLE interfaces ADD COLUMN IF NOT EXISTS speed bigint`,
+	`ALTER TABLE interfaces ADD COLUMN IF NOT EXISTS duplex text`,
+	`ALTER TABLE interfaces ADD COLUMN IF NOT EXISTS mtu bigint`,
+	`ALTER TABLE interfaces ADD COLUMN IF NOT EXISTS mac text`,
+	`ALTER TABLE interfaces ADD COLUMN IF NOT EXISTS if_index bigint`,
+	`ALTER TABLE interfaces ADD COLUMN IF NOT EXISTS oper_changed_at timestamptz`,
+	`CREATE INDEX IF NOT EXISTS interfaces_oper_status ON interfaces (oper_status, oper_changed_at)`,
+	`ALTER TABLE profiles_discovery ADD COLUMN IF NOT EXISTS lldp_chassis_rules text[]`,
+	`ALTER TABLE profiles_discovery ADD COLUMN IF NOT EXISTS lldp_port_rules text[]`,
+	`CREATE TABLE IF NOT EXISTS unresolved_neighbors (
+		id					bigserial PRIMARY KEY,
+		object_id			bigint NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+		local_interface_id	bigint REFERENCES interfaces(id) ON DELETE CASCADE,
+		local_port			text NOT NULL,
+		chassis_id			text NOT NULL,
+		port_id				text NOT NULL,
+		neighbor_id			bigint REFERENCES objects(id) ON DELETE CASCADE,
+		first_seen			timestamptz NOT NULL DEFAULT now(),
+		last_seen			timestamptz NOT NULL DEFAULT now(),
+		UNIQUE (object_id, local_port, chassis_id, port_id)
+	)`,
+	// existing links are considered confirmed at migration
+	`ALTER TABLE links ADD COLUMN IF NOT EXISTS last_confirmed_at timestamptz DEFAULT now()`,
+	`CREATE TABLE IF NOT EXISTS link_conflicts (
+		id						bigserial PRIMARY KEY,
+		object_id				bigint NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+		local_interface_id		bigint NOT NULL REFERENCES interfaces(id) ON DELETE CASCADE,
+		neighbor_id				bigint NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+		neighbor_interface_id	bigint NOT NULL REFERENCES interfaces(id) ON DELETE CASCADE,
+		link_id					bigint NOT NULL REFERENCES links(id) ON DELETE CASCADE,
+		last_seen				timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS link_conflicts_object_id ON link_conflicts (object_id)`,
+	// entries, that are not in the last FDB of object, are kept inactive as MAC history
+	`CREATE TABLE IF NOT EXISTS fdb_entries (
+		id				bigserial PRIMARY KEY,
+		object_id		bigint NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+		interface_id	bigint REFERENCES interfaces(id) ON DELETE SET NULL,
+		port			text NOT NULL,
+		mac				macaddr NOT NULL,
+		vlan			bigint NOT NULL DEFAULT 0,
+		active			boolean NOT NULL DEFAULT true,
+		first_seen		timestamptz NOT NULL DEFAULT now(),
+		last_seen		timestamptz NOT NULL DEFAULT now(),
+		UNIQUE (object_id, port, mac, vlan)
+	)`,
+	`CREATE INDEX IF NOT EXISTS fdb_entries_mac ON fdb_entries (mac, last_seen)`,
+	// each period of IP-to-MAC binding is separate row: binding, that is gone and seen again, starts a new one
+	`CREATE TABLE IF NOT EXISTS arp_entries (
+		id				bigserial PRIMARY KEY,
+		object_id		bigint NOT NULL REFERENCES objects(id) ON DELETE CASCADE,
+		interface_id	bigint REFERENCES interfaces(id) ON DELETE SET NULL,
+		port			text NOT NULL,
+		ip				inet NOT NULL,
+		mac				macaddr NOT NULL,
+		active			boolean NOT NULL DEFAULT true,
+		first_seen		timestamptz NOT NULL DEFAULT now(),
+		last_seen		timestamptz NOT NULL DEFAULT now()
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS arp_entries_active ON arp_entries (object_id, port, ip, mac) WHERE active`,
+	`CREATE INDEX IF NOT EXISTS arp_entries_ip ON arp_entries (ip, first_seen)`,
+	`CREATE INDEX IF NOT EXISTS arp_entries_mac ON arp_entries (mac, last_seen)`,
+}
+
+// schemaLockID is advisory lock, that serializes migrations of instances started at the same time
+const schemaLockID = 731000
+
+// Migrate applies schema statements one by one, in single transaction
+func Migrate() error {
+	return DB.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, schemaLockID); err != nil {
+			return fmt.Errorf("Cannot lock schema: %s", err.Error())
+		}
+		for i := range schema {
+			if _, err := tx.Exec(schema[i]); err != nil {
+				return fmt.Errorf("Schema migration #%d failed: %s", i, err.Error())
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,289 @@
+package dbwatch
+
+import (
+	"encoding/json"
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/cluster"
+	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"github.com/ircop/ohandler/streamer"
+	"github.com/ircop/ohandler/tasks"
+	"net"
+	"time"
+)
+
+// Channel where db triggers announce changes of cached tables
+const Channel = "ohandler_changes"
+
+// Change is payload of trigger notification
+type Change struct {
+	Table	string	`json:"table"`
+	Op		string	`json:"op"`
+	ID		int64	`json:"id"`
+}
+
+/*
+Start listens for changes, made by other instances, scripts, etc., and applies them to in-memory state.
+Changes made by this process are already applied, so they are found equal and skipped.
+Only leader re-schedules objects and sends updates to pollers.
+If connection was lost, notifications could be missed: then onResync is called, until it succeeds.
+ */
+func Start(onResync func() error) {
+	ln := db.DB.Listen(Channel)
+	go func() {
+		broken := false
+		for {
+			_, payload, err := ln.ReceiveTimeout(time.Minute)
+			timeout := false
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				timeout = true
+			} else if err != nil {
+				if !broken {
+					logger.Err("DB watch: %s", err.Error())
+				}
+				broken = true
+				time.Sleep(time.Second)
+				continue
+			}
+
+			// listener is reconnected, even if nothing is received until timeout
+			if broken {
+				logger.Log("DB watch: listener is reconnected, resyncing")
+				if err = onResync(); err != nil {
+					logger.Err("DB watch: resync failed: %s", err.Error())
+					continue
+				}
+				broken = false
+			}
+			if timeout {
+				continue
+			}
+
+			var change Change
+			if err = json.Unmarshal([]byte(payload), &change); err != nil {
+				logger.Err("DB watch: cannot parse notification '%s': %s", payload, err.Error())
+				continue
+			}
+			Apply(change)
+		}
+	}()
+}
+
+// Apply reloads changed row into memory
+func Apply(change Change) {
+	var err error
+	switch change.Table {
+	case "objects":
+		err = reloadObject(change.ID)
+	case "profiles_auth":
+		err = reloadAuthProfile(change.ID)
+	case "profiles_discovery":
+		err = reloadDiscoveryProfile(change.ID)
+	case "domains":
+		err = reloadDomain(change.ID)
+	case "maintenances":
+		err = reloadMaintenance(change.ID)
+	default:
+		return
+	}
+	if err != nil {
+		logger.Err("DB watch: failed to reload %s #%d: %s", change.Table, change.ID, err.Error())
+	}
+}
+
+func reloadObject(id int64) error {
+	var dbo models.Object
+	err := db.DB.Model(&dbo).Where(`id = ?`, id).Select()
+	if err != nil && err != pg.ErrNoRows {
+		return err
+	}
+
+	moInt, known := handler.Objects.Load(id)
+	leader := cluster.IsLeader()
+
+	// removed
+	if err == pg.ErrNoRows {
+		if !known {
+			return nil
+		}
+		mo := moInt.(*handler.ManagedObject)
+		mo.MX.Lock()
+		old := mo.DbObject
+		mo.MX.Unlock()
+
+		logger.Log("DB watch: object %s (#%d) is removed", old.Name, id)
+		tasks.Sched.Remove(id)
+		handler.Objects.Delete(id)
+		if leader {
+			streamer.UpdateObject(old, true)
+		}
+		return nil
+	}
+
+	// new; REST controller may store it before notification, so it's stored only once
+	if !known {
+		mo := &handler.ManagedObject{DbObject:dbo}
+		if moInt, known = handler.Objects.LoadOrStore(id, mo); !known {
+			logger.Log("DB watch: new object %s (#%d)", dbo.Name, id)
+			if leader {
+				tasks.SheduleBox(mo, true)
+				streamer.UpdateObject(dbo, false)
+			}
+			return nil
+		}
+	}
+
+	mo := moInt.(*handler.ManagedObject)
+	mo.MX.Lock()
+	old := mo.DbObject
+	if !objectChanged(old, dbo) {
+		mo.MX.Unlock()
+		return nil
+	}
+	mo.DbObject = dbo
+	mo.MX.Unlock()
+
+	logger.Log("DB watch: object %s (#%d) is changed", dbo.Name, id)
+	if !leader {
+		return nil
+	}
+	tasks.SheduleBox(mo, false)
+	if old.DomainID != dbo.DomainID {
+		// old domain pollers should forget it
+		streamer.UpdateObject(old, true)
+		streamer.UpdateObject(dbo, false)
+	} else if old.Mgmt != dbo.Mgmt || old.DiscoveryID != dbo.DiscoveryID || old.AuthID != dbo.AuthID {
+		streamer.UpdateObject(dbo, false)
+	}
+
+	return nil
+}
+
+// objectChanged compares columns, watched by objects_notify_update trigger
+func objectChanged(old models.Object, dbo models.Object) bool {
+	return old.Name != dbo.Name || old.Mgmt != dbo.Mgmt || old.AuthID != dbo.AuthID ||
+		old.DiscoveryID != dbo.DiscoveryID || old.ProfileID != dbo.ProfileID || old.DomainID != dbo.DomainID
+}
+
+func reloadAuthProfile(id int64) error {
+	ap, err := models.AuthProfilesByID(id)
+	if err != nil {
+		return err
+	}
+	if ap == nil {
+		handler.AuthProfiles.Delete(id)
+		return nil
+	}
+
+	var oldRO string
+	apInt, known := handler.AuthProfiles.Load(id)
+	if known {
+		old := apInt.(models.AuthProfile)
+		if old == *ap {
+			return nil
+		}
+		oldRO = old.RoCommunity
+	}
+	handler.AuthProfiles.Store(id, *ap)
+	logger.Log("DB watch: auth profile '%s' (#%d) is reloaded", ap.Title, id)
+
+	// pollers use community of profile
+	if known && oldRO != ap.RoCommunity && cluster.IsLeader() {
+		objects := make([]models.Object, 0)
+		if err := db.DB.Model(&objects).Where(`auth_id = ?`, id).Select(); err != nil && err != pg.ErrNoRows {
+			return err
+		}
+		streamer.UpdateObjects(objects, false)
+	}
+
+	return nil
+}
+
+func reloadDiscoveryProfile(id int64) error {
+	dp := models.DiscoveryProfile{ID:id}
+	err := db.DB.Model(&dp).WherePK().Select()
+	if err == pg.ErrNoRows {
+		handler.DiscoveryProfiles.Delete(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dpInt, known := handler.DiscoveryProfiles.Load(id)
+	handler.DiscoveryProfiles.Store(id, dp)
+	if !known {
+		logger.Log("DB watch: new discovery profile '%s' (#%d)", dp.Title, id)
+		return nil
+	}
+	old := dpInt.(models.DiscoveryProfile)
+	pollChanged := old.PeriodicInterval != dp.PeriodicInterval || old.PingInterval != dp.PingInterval
+	if old.BoxInterval <= dp.BoxInterval && !pollChanged {
+		return nil
+	}
+
+	logger.Log("DB watch: discovery profile '%s' (#%d) intervals are changed", dp.Title, id)
+	if !cluster.IsLeader() {
+		return nil
+	}
+	objects := make([]models.Object, 0)
+	if err := db.DB.Model(&objects).Where(`discovery_id = ?`, id).Select(); err != nil && err != pg.ErrNoRows {
+		return err
+	}
+	if pollChanged {
+		streamer.UpdateObjects(objects, false)
+	}
+	// smaller box interval: objects should not wait for the old one
+	if old.BoxInterval > dp.BoxInterval {
+		for i := range objects {
+			if moInt, ok := handler.Objects.Load(objects[i].ID); ok {
+				tasks.SheduleBox(moInt.(*handler.ManagedObject), false)
+			}
+		}
+	}
+
+	return nil
+}
+
+func reloadDomain(id int64) error {
+	d := models.Domain{ID:id}
+	err := db.DB.Model(&d).WherePK().Select()
+	if err != nil && err != pg.ErrNoRows {
+		return err
+	}
+
+	dInt, known := handler.Domains.Load(id)
+	if err == pg.ErrNoRows {
+		if known {
+			logger.Log("DB watch: domain '%s' is removed", dInt.(models.Domain).Name)
+			if err = streamer.Nats.RemoveDomain(dInt.(models.Domain)); err != nil {
+				logger.Err("Failed to unsubscribe domain '%s': %s", dInt.(models.Domain).Name, err.Error())
+			}
+			handler.Domains.Delete(id)
+		}
+		return nil
+	}
+
+	handler.Domains.Store(id, d)
+	if !known {
+		logger.Log("DB watch: new domain '%s'", d.Name)
+		return streamer.Nats.AddDomain(d)
+	}
+	return nil
+}
+
+func reloadMaintenance(id int64) error {
+	m := models.Maintenance{ID:id}
+	err := db.DB.Model(&m).WherePK().Select()
+	if err == pg.ErrNoRows {
+		handler.RemoveMaintenance(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return handler.StoreMaintenance(m)
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"sync"
+)
+
+var Domains sync.Map
+
+func StoreDomains() error {
+	domains, err := models.DomainsAll()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range domains {
+		Domains.Store(d.ID, d)
+	}
+
+	logger.Log("Stored %d domains", len(domains))
+	return nil
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"sync"
+	"time"
+)
+
+var Maintenances sync.Map
+
+// maintenanceObjects are objects of window segments by window id, resolved when window is stored:
+// maintenance checks of every ping update and discovery result don't go to DB.
+var maintenanceObjects sync.Map
+
+func StoreMaintenances() error {
+	windows, err := models.MaintenancesAll()
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[int64]bool, len(windows))
+	for _, m := range windows {
+		if err = StoreMaintenance(m); err != nil {
+			return err
+		}
+		ids[m.ID] = true
+	}
+
+	// windows, that were removed from DB
+	Maintenances.Range(func(key, _ interface{}) bool {
+		if !ids[key.(int64)] {
+			RemoveMaintenance(key.(int64))
+		}
+		return true
+	})
+
+	logger.Log("Stored %d maintenance windows", len(windows))
+	return nil
+}
+
+// StoreMaintenance stores window in memory with objects of it's segments
+func StoreMaintenance(m models.Maintenance) error {
+	objects := make(map[int64]bool)
+	if len(m.SegmentIDs) > 0 {
+		ids, err := models.SegmentsObjectIDs(m.SegmentIDs)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			objects[id] = true
+		}
+	}
+
+	maintenanceObjects.Store(m.ID, objects)
+	Maintenances.Store(m.ID, m)
+	return nil
+}
+
+// RemoveMaintenance removes window from memory
+func RemoveMaintenance(id int64) {
+	Maintenances.Delete(id)
+	maintenanceObjects.Delete(id)
+}
+
+// ReloadMaintenanceSegments resolves objects of segment-scoped windows again, when segments of object are changed
+func ReloadMaintenanceSegments() {
+	Maintenances.Range(func(_, mInt interface{}) bool {
+		m := mInt.(models.Maintenance)
+		if len(m.SegmentIDs) == 0 {
+			return true
+		}
+		if err := StoreMaintenance(m); err != nil {
+			logger.Err("Failed to select objects of maintenance #%d segments: %s", m.ID, err.Error())
+		}
+		return true
+	})
+}
+
+// InMaintenance returns true if object is covered by one of active maintenance windows
+func InMaintenance(objectID int64) bool {
+	now := time.Now()
+	covered := false
+	Maintenances.Range(func(id, mInt interface{}) bool {
+		m := mInt.(models.Maintenance)
+		if !m.ActiveAt(now) {
+			return true
+		}
+		var objects map[int64]bool
+		if oInt, ok := maintenanceObjects.Load(id); ok {
+			objects = oInt.(map[int64]bool)
+		}
+		covered = m.Covers(objectID, objects)
+		return !covered
+	})
+
+	return covered
+}
+
+// MaintenancePeriods returns occurences of windows, covering object, within [from, to)
+func MaintenancePeriods(objectID int64, from time.Time, to time.Time) []models.Period {
+	periods := make([]models.Period, 0)
+	Maintenances.Range(func(id, mInt interface{}) bool {
+		m := mInt.(models.Maintenance)
+		var objects map[int64]bool
+		if oInt, ok := maintenanceObjects.Load(id); ok {
+			objects = oInt.(map[int64]bool)
+		}
+		if m.Covers(objectID, objects) {
+			periods = append(periods, m.Occurences(from, to)...)
+		}
+		return true
+	})
+
+	return periods
+}
@@ -5,29 +5,43 @@ import (
 	"github.com/ircop/ohandler/models"
 	"github.com/sasha-s/go-deadlock"
 	"sync"
-	"time"
 )
 
 type ManagedObject struct {
 	DbObject		models.Object
-	BoxTimer		*time.Timer
 	MX				deadlock.Mutex
 }
 
 var Objects sync.Map
 
+// StoreObjects loads objects into memory. On reload, known objects are updated in place: running
+// discoveries and requests keep pointers to them.
 func StoreObjects() error {
 	objects, err := models.ObjectsAll()
 	if err != nil {
 		return err
 	}
 
+	ids := make(map[int64]bool, len(objects))
 	for i, _ := range objects {
-		mo := ManagedObject{DbObject:objects[i]}
-		Objects.Store(objects[i].ID, &mo)
-		continue
+		ids[objects[i].ID] = true
+		moInt, loaded := Objects.LoadOrStore(objects[i].ID, &ManagedObject{DbObject:objects[i]})
+		if loaded {
+			mo := moInt.(*ManagedObject)
+			mo.MX.Lock()
+			mo.DbObject = objects[i]
+			mo.MX.Unlock()
+		}
 	}
 
+	// on reload, forget objects that were removed meanwhile
+	Objects.Range(func(id, _ interface{}) bool {
+		if !ids[id.(int64)] {
+			Objects.Delete(id)
+		}
+		return true
+	})
+
 	logger.Log("Stored %d objects", len(objects))
 
 	return nil
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+// ArpEntry is IP-to-MAC binding (ARP or IPv6 ND), learned on object port. Each row is one period of binding:
+// entries, that are not in the last discovered ARP table of object, are inactive and kept as history.
+type ArpEntry struct {
+	TableName struct{} `sql:"arp_entries" json:"-"`
+
+	ID			int64		`json:"id"`
+	ObjectID	int64		`json:"object_id"`
+	// interface is not known, if it's removed after entry was seen
+	InterfaceID	int64		`json:"interface_id"`
+	Port		string		`json:"port"`
+	IP			string		`json:"ip" sql:"ip,type:inet"`
+	Mac			string		`json:"mac" sql:"type:macaddr"`
+	Active		bool		`json:"active" sql:",notnull"`
+	FirstSeen	time.Time	`json:"first_seen" sql:"default:now()"`
+	LastSeen	time.Time	`json:"last_seen" sql:"default:now()"`
+}
+
+// ArpStore replaces active ARP table of object with given entries in transaction. Entries, that are gone, become
+// inactive; inactive ones, not seen since given time, are removed (zero time keeps them forever).
+func ArpStore(tx orm.DB, objectID int64, list []ArpEntry, removeBefore time.Time) error {
+	if len(list) > 0 {
+		_, err := tx.Model(&list).
+			OnConflict(`(object_id, port, ip, mac) WHERE active DO UPDATE`).
+			Set(`last_seen = now()`).
+			Set(`interface_id = EXCLUDED.interface_id`).
+			Insert()
+		if err != nil {
+			return err
+		}
+	}
+
+	// now() is the same during transaction, so stored ones are seen at it
+	_, err := tx.Model(&ArpEntry{}).Set(`active = false`).Where(`object_id = ?`, objectID).
+		Where(`active`).Where(`last_seen < now()`).Update()
+	if err != nil || removeBefore.IsZero() {
+		return err
+	}
+
+	_, err = tx.Model(&ArpEntry{}).Where(`object_id = ?`, objectID).Where(`NOT active`).
+		Where(`last_seen < ?`, removeBefore).Delete()
+	return err
+}
+
+// ArpFind returns page of active ARP entries of object, ordered by ip, and total amount of them
+func ArpFind(objectID int64, limit int, offset int) ([]ArpEntry, int, error) {
+	list := make([]ArpEntry, 0)
+	cnt, err := db.DB.Model(&list).Where(`object_id = ?`, objectID).Where(`active`).
+		Order(`ip`, `mac`).Limit(limit).Offset(offset).SelectAndCount()
+	if err != nil && err != pg.ErrNoRows {
+		return list, 0, err
+	}
+
+	return list, cnt, nil
+}
+
+// ArpByIP returns bindings of IP, recently seen first. With non-zero time, only bindings, that existed at it,
+// are returned: binding is considered existing until it's last seen, or until now, if it's still active.
+func ArpByIP(ip string, at time.Time) ([]ArpEntry, error) {
+	list := make([]ArpEntry, 0)
+	q := db.DB.Model(&list).Where(`ip = ?`, ip)
+	if !at.IsZero() {
+		q.Where(`first_seen <= ?`, at).WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+			return q.Where(`active`).WhereOr(`last_seen >= ?`, at), nil
+		})
+	}
+
+	err := q.Order(`last_seen DESC`, `id DESC`).Select()
+	if err != nil && err != pg.ErrNoRows {
+		return list, err
+	}
+
+	return list, nil
+}
+
+// ArpByMac returns bindings of MAC (IPs, used by it), recently seen first
+func ArpByMac(mac string) ([]ArpEntry, error) {
+	list := make([]ArpEntry, 0)
+	err := db.DB.Model(&list).Where(`mac = ?`, mac).Order(`last_seen DESC`, `id DESC`).Select()
+	if err != nil && err != pg.ErrNoRows {
+		return list, err
+	}
+
+	return list, nil
+}
+
+// ArpNetworkHosts returns active bindings of hosts in network: their IPs are in subnet of ip interface of the
+// same object, that is placed to this network
+func ArpNetworkHosts(networkID int64) ([]ArpEntry, error) {
+	list := make([]ArpEntry, 0)
+	_, err := db.DB.Query(&list, `SELECT DISTINCT ON (a.ip, a.mac) a.* FROM arp_entries a
+		JOIN ips i ON i.object_id = a.object_id AND a.ip << i.addr::inet
+		WHERE i.network_id = ? AND a.active
+		ORDER BY a.ip, a.mac, a.last_seen DESC`, networkID)
+	if err != nil && err != pg.ErrNoRows {
+		return list, err
+	}
+
+	return list, nil
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+// BoxRequest is box request, sent to worker and not answered yet.
+// It's kept in DB, so reply that comes after restart can still be applied.
+type BoxRequest struct {
+	TableName struct{} `sql:"box_requests" json:"-"`
+
+	RequestID	string		`json:"request_id" sql:",pk"`
+	ObjectID	int64		`json:"object_id"`
+	Tasks		[]string	`json:"tasks" sql:",array"`
+	SentAt		time.Time	`json:"sent_at"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+	// every instance receives every reply: only the sender applies it
+	Instance	string		`json:"instance" sql:",notnull"`
+}
+
+// BoxRequestTake removes request of instance and returns it. Only one caller gets it, so reply is never
+// applied twice. Returns nil if there is no such request, or it's sent by another instance.
+func BoxRequestTake(requestID string, instance string) (*BoxRequest, error) {
+	var r BoxRequest
+	_, err := db.DB.QueryOne(&r, `DELETE FROM box_requests WHERE request_id = ? AND instance = ? RETURNING *`, requestID, instance)
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func BoxRequestDelete(requestID string) error {
+	_, err := db.DB.Model(&BoxRequest{}).Where(`request_id = ?`, requestID).Delete()
+	return err
+}
+
+// BoxRequestsPrune removes requests, that will never be answered
+func BoxRequestsPrune() error {
+	_, err := db.DB.Model(&BoxRequest{}).Where(`expires_at < ?`, time.Now()).Delete()
+	return err
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+// Change event actions
+const (
+	ActionAdd		= "add"
+	ActionUpdate	= "update"
+	ActionDelete	= "delete"
+)
+
+// SourceDiscovery is source of changes, made by box discovery results
+const SourceDiscovery = "discovery"
+
+// SourceUser returns source of changes, made by user in web interface
+func SourceUser(login string) string {
+	return "user:" + login
+}
+
+// SourceApiKey returns source of changes, made over REST with api key
+func SourceApiKey(tokenID int64) string {
+	return fmt.Sprintf("api:%d", tokenID)
+}
+
+// ChangeEvent is a single change of object inventory: interface, vlan, link, platform field, etc.
+// Values are json of changed entity (or plain json string for single fields).
+type ChangeEvent struct {
+	TableName struct{} `sql:"change_events" json:"-"`
+
+	ID			int64				`json:"id"`
+	ObjectID	int64				`json:"object_id"`
+	Entity		string				`json:"entity"`
+	EntityID	int64				`json:"entity_id" sql:",notnull"`
+	// human-readable subject of change, like interface name or platform field
+	Key			string				`json:"key"`
+	Action		string				`json:"action"`
+	OldValue	json.RawMessage		`json:"old_value"`
+	NewValue	json.RawMessage		`json:"new_value"`
+	Source		string				`json:"source"`
+	CreatedAt	time.Time			`json:"created_at" sql:"default:now()"`
+}
+
+// ChangeEventFilter selects change events; zero fields are not filtered
+type ChangeEventFilter struct {
+	ObjectID	int64
+	Entity		string
+	EntityID	int64
+	Action		string
+	Source		string
+	From		time.Time
+	To			time.Time
+}
+
+// NewChangeEvent returns event with old and new values marshalled to json. Nil value is stored as null.
+func NewChangeEvent(objectID int64, entity string, entityID int64, key string, action string, old interface{}, new interface{}, source string) ChangeEvent {
+	e := ChangeEvent{
+		ObjectID:objectID,
+		Entity:entity,
+		EntityID:entityID,
+		Key:key,
+		Action:action,
+		Source:source,
+	}
+	if old != nil {
+		e.OldValue, _ = json.Marshal(old)
+	}
+	if new != nil {
+		e.NewValue, _ = json.Marshal(new)
+	}
+
+	return e
+}
+
+// LinkChangeEvents returns event of link change for both linked objects, so it's in history of each
+func LinkChangeEvents(l Link, key string, action string, old interface{}, new interface{}, source string) []ChangeEvent {
+	events := []ChangeEvent{NewChangeEvent(l.Object1ID, "link", l.ID, key, action, old, new, source)}
+	if l.Object2ID != l.Object1ID {
+		events = append(events, NewChangeEvent(l.Object2ID, "link", l.ID, key, action, old, new, source))
+	}
+	return events
+}
+
+// ChangeEventsInsert stores events, usually in transaction of changes themselves
+func ChangeEventsInsert(tx orm.DB, events []ChangeEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return tx.Insert(&events)
+}
+
+// ChangeEventsFind returns page of filtered events, newest first, and total amount of them
+func ChangeEventsFind(f ChangeEventFilter, limit int, offset int) ([]ChangeEvent, int, error) {
+	events := make([]ChangeEvent, 0)
+	q := db.DB.Model(&events)
+	if f.ObjectID != 0 {
+		q.Where(`object_id = ?`, f.ObjectID)
+	}
+	if f.Entity != "" {
+		q.Where(`entity = ?`, f.Entity)
+	}
+	if f.EntityID != 0 {
+		q.Where(`entity_id = ?`, f.EntityID)
+	}
+	if f.Action != "" {
+		q.Where(`action = ?`, f.Action)
+	}
+	if f.Source != "" {
+		q.Where(`source = ?`, f.Source)
+	}
+	if !f.From.IsZero() {
+		q.Where(`created_at >= ?`, f.From)
+	}
+	if !f.To.IsZero() {
+		q.Where(`created_at < ?`, f.To)
+	}
+
+	cnt, err := q.Order(`created_at DESC`, `id DESC`).Limit(limit).Offset(offset).SelectAndCount()
+	if err != nil && err != pg.ErrNoRows {
+		return events, 0, err
+	}
+
+	return events, cnt, nil
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+// DbChange is a sequence-numbered record of object change, broadcasted to pollers
+type DbChange struct {
+	TableName struct{} `sql:"db_changes" json:"-"`
+
+	Seq			int64		`json:"seq" sql:",pk"`
+	ObjectID	int64		`json:"object_id"`
+	DomainID	int64		`json:"domain_id" sql:",notnull"`
+	Removed		bool		`json:"removed" sql:",notnull"`
+	CreatedAt	time.Time	`json:"created_at" sql:"default:now()"`
+}
+
+// dbChangesLockID is advisory lock, that serializes storing of changes
+const dbChangesLockID = 731001
+
+// DbChangesAdd stores changes of given objects and returns last sequence number. Changes are stored one
+// transaction at a time, so they are committed in sequence order: pollers, that got change N, can't miss
+// change with smaller number, committed later.
+func DbChangesAdd(objects []Object, removed bool) (int64, error) {
+	if len(objects) == 0 {
+		return 0, nil
+	}
+
+	changes := make([]DbChange, 0, len(objects))
+	for i := range objects {
+		changes = append(changes, DbChange{
+			ObjectID:objects[i].ID,
+			DomainID:objects[i].DomainID,
+			Removed:removed,
+		})
+	}
+	err := db.DB.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, dbChangesLockID); err != nil {
+			return err
+		}
+		return tx.Insert(&changes)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return changes[len(changes)-1].Seq, nil
+}
+
+// DbChangesRange returns first and last stored sequence numbers
+func DbChangesRange() (int64, int64, error) {
+	var first, last int64
+	_, err := db.DB.QueryOne(pg.Scan(&first, &last), `SELECT coalesce(min(seq), 0), coalesce(max(seq), 0) FROM db_changes`)
+
+	return first, last, err
+}
+
+// DbChangesSince returns last change of every object in domain after given sequence number
+func DbChangesSince(domainID int64, since int64) ([]DbChange, error) {
+	var changes []DbChange
+	_, err := db.DB.Query(&changes, `SELECT DISTINCT ON (object_id) * FROM db_changes
+		WHERE domain_id = ? AND seq > ? ORDER BY object_id, seq DESC`, domainID, since)
+
+	return changes, err
+}
+
+// DbChangesPrune removes changes older than retention period.
+// Last change is always kept, so sequence never goes back.
+func DbChangesPrune(retention time.Duration) error {
+	_, err := db.DB.Exec(`DELETE FROM db_changes WHERE created_at < ? AND seq < (SELECT max(seq) FROM db_changes)`,
+		time.Now().Add(-retention))
+
+	return err
+}
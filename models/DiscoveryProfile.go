@@ -1,10 +1,39 @@
 package models
 
 import (
+	"fmt"
 	"github.com/go-pg/pg"
+	"github.com/ircop/dproto"
 	"github.com/ircop/ohandler/db"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// task is considered due a bit earlier than it's interval, so box discovery jitter doesn't postpone it for whole box interval
+const taskDueSlack = time.Minute
+
+// LLDP chassis ID matching rules: neighbor object is found by object mac, name (hostname), mgmt or ip address
+const (
+	ChassisMac		= "mac"
+	ChassisName		= "name"
+	ChassisMgmt		= "mgmt"
+	ChassisIpif		= "ipif"
+)
+
+// LLDP port ID matching rules: neighbor port is found by it's LLDP ID, name or shortname, ifIndex or description
+const (
+	PortLldpID		= "lldp_id"
+	PortName		= "name"
+	PortIfIndex		= "ifindex"
+	PortDescription	= "description"
+)
+
+// Rules, that are used when profile has no own ones
+var DefaultChassisRules = []string{ChassisMac, ChassisName, ChassisMgmt, ChassisIpif}
+var DefaultPortRules = []string{PortLldpID, PortName, PortIfIndex, PortDescription}
+
 // DiscoveryProfile is struct for handling discovery profiles in db
 type DiscoveryProfile struct {
 	TableName struct{} `sql:"profiles_discovery"`
@@ -15,6 +44,57 @@ type DiscoveryProfile struct {
 	BoxInterval			int64		`json:"box_interval"`
 	PeriodicInterval	int64		`json:"periodic_interval"`
 	PingInterval		int64		`json:"ping_interval"`
+	// own intervals (seconds) of box task types, by dproto task name. Other tasks run on every box discovery.
+	TaskIntervals		map[string]int64	`json:"task_intervals" sql:"task_intervals"`
+	// LLDP neighbor matching rules, tried in order
+	ChassisRules		[]string	`json:"chassis_rules" sql:"lldp_chassis_rules,array"`
+	PortRules			[]string	`json:"port_rules" sql:"lldp_port_rules,array"`
+}
+
+// LldpChassisRules returns chassis ID matching rules of profile, or default ones
+func (dp DiscoveryProfile) LldpChassisRules() []string {
+	if len(dp.ChassisRules) == 0 {
+		return DefaultChassisRules
+	}
+	return dp.ChassisRules
+}
+
+// LldpPortRules returns port ID matching rules of profile, or default ones
+func (dp DiscoveryProfile) LldpPortRules() []string {
+	if len(dp.PortRules) == 0 {
+		return DefaultPortRules
+	}
+	return dp.PortRules
+}
+
+// ParseLldpRules parses matching rules, like "mac,name" (or json array, passed as "[mac name]"), checking them
+// against known ones. Empty string gives empty set, which means default rules.
+func ParseLldpRules(s string, known []string) ([]string, error) {
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '[' || r == ']'
+	})
+	for _, rule := range fields {
+		rule = strings.ToLower(rule)
+		if seen[rule] {
+			continue
+		}
+		found := false
+		for _, k := range known {
+			if k == rule {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown matching rule '%s'", rule)
+		}
+		seen[rule] = true
+		result = append(result, rule)
+	}
+
+	return result, nil
 }
 
 func DiscoveryProfilesAll() ([]DiscoveryProfile, error) {
@@ -26,4 +106,80 @@ func DiscoveryProfilesAll() ([]DiscoveryProfile, error) {
 	}
 
 	return models, nil
-}
\ No newline at end of file
+}
+
+// ParseTaskIntervals parses intervals like "config:86400,lldp:3600". Task names are case-insensitive.
+func ParseTaskIntervals(s string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Wrong task interval '%s'", part)
+		}
+		name := strings.ToUpper(strings.TrimSpace(kv[0]))
+		if _, ok := dproto.TaskType_value[name]; !ok {
+			return nil, fmt.Errorf("Unknown task type '%s'", kv[0])
+		}
+		interval, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("Wrong interval for task '%s'", kv[0])
+		}
+		result[name] = interval
+	}
+
+	return result, nil
+}
+
+// ParseTaskTypes parses comma-separated task names, like "config,lldp". Empty string gives empty set.
+func ParseTaskTypes(s string) ([]dproto.TaskType, error) {
+	result := make([]dproto.TaskType, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		v, ok := dproto.TaskType_value[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown task type '%s'", name)
+		}
+		result = append(result, dproto.TaskType(v))
+	}
+
+	return result, nil
+}
+
+// AllTaskTypes returns all dproto task types, ordered by value
+func AllTaskTypes() []dproto.TaskType {
+	result := make([]dproto.TaskType, 0, len(dproto.TaskType_name))
+	for v := range dproto.TaskType_name {
+		result = append(result, dproto.TaskType(v))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+
+	return result
+}
+
+// DueTasks returns task types, that should be requested at given time.
+// Tasks without own interval are always due; others are due when interval passed since their last run.
+func (dp DiscoveryProfile) DueTasks(runs map[string]time.Time, now time.Time) []dproto.TaskType {
+	result := make([]dproto.TaskType, 0)
+	for _, t := range AllTaskTypes() {
+		interval, ok := dp.TaskIntervals[t.String()]
+		if !ok || interval <= 0 {
+			result = append(result, t)
+			continue
+		}
+		last, ok := runs[t.String()]
+		if !ok || !last.Add(time.Duration(interval) * time.Second).After(now.Add(taskDueSlack)) {
+			result = append(result, t)
+		}
+	}
+
+	return result
+}
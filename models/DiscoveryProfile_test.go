@@ -0,0 +1,71 @@
+package models
+
+import (
+	"github.com/ircop/dproto"
+	"testing"
+	"time"
+)
+
+func TestParseTaskIntervals(t *testing.T) {
+	intervals, err := ParseTaskIntervals("config:86400, LLDP:3600,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intervals) != 2 || intervals["CONFIG"] != 86400 || intervals["LLDP"] != 3600 {
+		t.Errorf("unexpected intervals: %v", intervals)
+	}
+
+	for _, wrong := range []string{"config", "nosuchtask:10", "config:-1", "config:x"} {
+		if _, err := ParseTaskIntervals(wrong); err == nil {
+			t.Errorf("'%s' should not be parsed", wrong)
+		}
+	}
+}
+
+func TestDueTasks(t *testing.T) {
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	dp := DiscoveryProfile{TaskIntervals:map[string]int64{"CONFIG":86400, "LLDP":3600}}
+
+	// never run: everything is due
+	if due := dp.DueTasks(nil, now); len(due) != len(AllTaskTypes()) {
+		t.Errorf("expected all tasks, got %v", due)
+	}
+
+	runs := map[string]time.Time{
+		"CONFIG":now.Add(-time.Hour * 2),
+		// jitter of box discovery should not postpone the task
+		"LLDP":now.Add(-time.Hour).Add(time.Second * 20),
+	}
+	due := dp.DueTasks(runs, now)
+	has := make(map[dproto.TaskType]bool)
+	for _, task := range due {
+		has[task] = true
+	}
+	if has[dproto.TaskType_CONFIG] {
+		t.Errorf("config should not be due")
+	}
+	if !has[dproto.TaskType_LLDP] || !has[dproto.TaskType_PLATFORM] || !has[dproto.TaskType_VLANS] {
+		t.Errorf("lldp and tasks without interval should be due: %v", due)
+	}
+}
+
+func TestParseLldpRules(t *testing.T) {
+	rules, err := ParseLldpRules("Name, mgmt,name", DefaultChassisRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0] != ChassisName || rules[1] != ChassisMgmt {
+		t.Errorf("unexpected rules: %v", rules)
+	}
+	if rules, err = ParseLldpRules("[ifindex description]", DefaultPortRules); err != nil || len(rules) != 2 {
+		t.Errorf("json array is parsed as %v (%v)", rules, err)
+	}
+	if _, err = ParseLldpRules("mac,ifindex", DefaultChassisRules); err == nil {
+		t.Errorf("port rule is accepted as chassis one")
+	}
+
+	dp := DiscoveryProfile{PortRules:[]string{PortIfIndex}}
+	if len(dp.LldpChassisRules()) != len(DefaultChassisRules) || dp.LldpPortRules()[0] != PortIfIndex {
+		t.Errorf("profile rules are %v, %v", dp.LldpChassisRules(), dp.LldpPortRules())
+	}
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"regexp"
+	"time"
+)
+
+const (
+	RunSuccess		= "success"
+	// some of requested sections returned errors
+	RunPartial		= "partial"
+	RunError		= "error"
+	RunAuthFailure	= "auth-failure"
+	RunTimeout		= "timeout"
+	// changeset deletes too much, it's held for approval
+	RunHeld			= "held"
+)
+
+// Discovery problems detected by ohandler itself. Codes are far from dproto ones, so they never clash.
+const (
+	ProblemAuthFailure		int64 = 100
+	ProblemTimeout			int64 = 101
+	ProblemStaleDiscovery	int64 = 102
+	ProblemLinkConflict		int64 = 103
+)
+
+var ProblemNames = map[int64]string{
+	ProblemAuthFailure:"AUTH_FAILURE",
+	ProblemTimeout:"TIMEOUT",
+	ProblemStaleDiscovery:"STALE_DISCOVERY",
+	ProblemLinkConflict:"LINK_CONFLICT",
+}
+
+// workers report authentication problems as plain error text only
+var reAuthError = regexp.MustCompile(`(?i)auth|login|password|permission denied|access denied`)
+
+// DiscoveryRun is a result of single box discovery of object
+type DiscoveryRun struct {
+	TableName struct{} `sql:"discovery_runs" json:"-"`
+
+	ID			int64				`json:"id"`
+	ObjectID	int64				`json:"object_id"`
+	RequestID	string				`json:"request_id"`
+	StartedAt	time.Time			`json:"started_at"`
+	FinishedAt	time.Time			`json:"finished_at"`
+	Outcome		string				`json:"outcome"`
+	Error		string				`json:"error"`
+	Tasks		[]string			`json:"tasks" sql:",array"`
+	// errors and amount of applied changes by section (dproto task name)
+	Errors		map[string]string	`json:"errors"`
+	Changes		map[string]int64	`json:"changes"`
+}
+
+// ErrorOutcome returns outcome of run, failed with given worker error
+func ErrorOutcome(errorText string) string {
+	if reAuthError.MatchString(errorText) {
+		return RunAuthFailure
+	}
+	return RunError
+}
+
+// DiscoveryRunsByObject returns page of object runs, newest first, and total amount of them
+func DiscoveryRunsByObject(objectID int64, limit int, offset int) ([]DiscoveryRun, int, error) {
+	runs := make([]DiscoveryRun, 0)
+	cnt, err := db.DB.Model(&runs).Where(`object_id = ?`, objectID).
+		Order(`started_at DESC`).Limit(limit).Offset(offset).SelectAndCount()
+	if err != nil && err != pg.ErrNoRows {
+		return runs, 0, err
+	}
+
+	return runs, cnt, nil
+}
+
+// DiscoveryRunsPrune removes runs older than given period
+func DiscoveryRunsPrune(retention time.Duration) error {
+	_, err := db.DB.Model(&DiscoveryRun{}).Where(`started_at < ?`, time.Now().Add(-retention)).Delete()
+	return err
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+// Domain is isolated network part with it's own set of pingers/discoverers
+type Domain struct {
+	TableName struct{} `sql:"domains" json:"-"`
+
+	ID			int64		`json:"id"`
+	Name		string		`json:"name"`
+	CreatedAt	*time.Time	`json:"created_at"`
+}
+
+func DomainsAll() ([]Domain, error) {
+	var domains []Domain
+	err := db.DB.Model(&domains).Order(`name`).Select()
+	if err != nil && err != pg.ErrNoRows {
+		return domains, err
+	}
+
+	return domains, nil
+}
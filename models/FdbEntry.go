@@ -0,0 +1,98 @@
+package models
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+// FdbEntry is MAC address, learned on object port in vlan. Entries, that are not in the last discovered FDB
+// of object, are inactive: they are history of MAC.
+type FdbEntry struct {
+	TableName struct{} `sql:"fdb_entries" json:"-"`
+
+	ID			int64		`json:"id"`
+	ObjectID	int64		`json:"object_id"`
+	// interface is not known, if it's removed after entry was seen
+	InterfaceID	int64		`json:"interface_id"`
+	Port		string		`json:"port"`
+	Mac			string		`json:"mac" sql:"type:macaddr"`
+	Vlan		int64		`json:"vlan" sql:",notnull"`
+	Active		bool		`json:"active" sql:",notnull"`
+	FirstSeen	time.Time	`json:"first_seen" sql:"default:now()"`
+	LastSeen	time.Time	`json:"last_seen" sql:"default:now()"`
+}
+
+// FdbStore replaces active FDB of object with given entries in transaction. Entries, that are gone, become
+// inactive; inactive ones, not seen since given time, are removed (zero time keeps them forever).
+func FdbStore(tx orm.DB, objectID int64, list []FdbEntry, removeBefore time.Time) error {
+	if len(list) > 0 {
+		_, err := tx.Model(&list).
+			OnConflict(`(object_id, port, mac, vlan) DO UPDATE`).
+			Set(`last_seen = now()`).
+			Set(`active = true`).
+			Set(`interface_id = EXCLUDED.interface_id`).
+			Insert()
+		if err != nil {
+			return err
+		}
+	}
+
+	// now() is the same during transaction, so stored ones are seen at it
+	_, err := tx.Model(&FdbEntry{}).Set(`active = false`).Where(`object_id = ?`, objectID).
+		Where(`active`).Where(`last_seen < now()`).Update()
+	if err != nil || removeBefore.IsZero() {
+		return err
+	}
+
+	_, err = tx.Model(&FdbEntry{}).Where(`object_id = ?`, objectID).Where(`NOT active`).
+		Where(`last_seen < ?`, removeBefore).Delete()
+	return err
+}
+
+// FdbFind returns page of active FDB entries of object (optionally of single interface), ordered by port,
+// and total amount of them
+func FdbFind(objectID int64, interfaceID int64, limit int, offset int) ([]FdbEntry, int, error) {
+	list := make([]FdbEntry, 0)
+	q := db.DB.Model(&list).Where(`object_id = ?`, objectID).Where(`active`)
+	if interfaceID != 0 {
+		q.Where(`interface_id = ?`, interfaceID)
+	}
+
+	cnt, err := q.OrderExpr(`natsort(port), vlan, mac`).Limit(limit).Offset(offset).SelectAndCount()
+	if err != nil && err != pg.ErrNoRows {
+		return list, 0, err
+	}
+
+	return list, cnt, nil
+}
+
+// FdbEdge returns active entries of MAC on edge ports: ports without links, that are not uplinks and not
+// port-channels with linked members. Usually it's the only access port, where MAC device is connected.
+func FdbEdge(mac string) ([]FdbEntry, error) {
+	list := make([]FdbEntry, 0)
+	_, err := db.DB.Query(&list, `SELECT f.* FROM fdb_entries f
+		WHERE f.mac = ? AND f.active AND f.interface_id IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM links l WHERE l.int1_id = f.interface_id OR l.int2_id = f.interface_id)
+		AND NOT EXISTS (SELECT 1 FROM objects o WHERE o.uplink_id = f.interface_id)
+		AND NOT EXISTS (SELECT 1 FROM po_members m JOIN links l ON l.int1_id = m.member_id OR l.int2_id = m.member_id
+			WHERE m.po_id = f.interface_id)
+		ORDER BY f.last_seen DESC, f.id DESC`, mac)
+	if err != nil && err != pg.ErrNoRows {
+		return list, err
+	}
+
+	return list, nil
+}
+
+// FdbHistory returns all entries of MAC, active and inactive, recently seen first
+func FdbHistory(mac string) ([]FdbEntry, error) {
+	list := make([]FdbEntry, 0)
+	err := db.DB.Model(&list).Where(`mac = ?`, mac).Order(`last_seen DESC`, `id DESC`).Select()
+	if err != nil && err != pg.ErrNoRows {
+		return list, err
+	}
+
+	return list, nil
+}
@@ -1,5 +1,11 @@
 package models
 
+import (
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
 type Interface struct {
 	TableName struct{} `sql:"interfaces"`
 
@@ -10,4 +16,65 @@ type Interface struct {
 	Shortname	string	`json:"shortname"`
 	Description	string	`json:"description"`
 	LldpID		string	`json:"lldp_id"`
+
+	AdminStatus		string		`json:"admin_status"`
+	OperStatus		string		`json:"oper_status"`
+	// bits per second
+	Speed			int64		`json:"speed"`
+	Duplex			string		`json:"duplex"`
+	Mtu				int64		`json:"mtu"`
+	Mac				string		`json:"mac"`
+	IfIndex			int64		`json:"if_index"`
+	// when oper status was changed last time, as seen by discovery
+	OperChangedAt	*time.Time	`json:"oper_changed_at"`
+}
+
+// InterfaceFilter selects interfaces; zero fields are not filtered
+type InterfaceFilter struct {
+	ObjectID	int64
+	Type		string
+	AdminStatus	string
+	OperStatus	string
+	// oper status is not changed since given time
+	OperSince	time.Time
+	Speed		int64
+	Mtu			int64
+	Mac			string
+}
+
+// InterfacesFind returns page of filtered interfaces, ordered by object and name, and total amount of them
+func InterfacesFind(f InterfaceFilter, limit int, offset int) ([]Interface, int, error) {
+	ints := make([]Interface, 0)
+	q := db.DB.Model(&ints)
+	if f.ObjectID != 0 {
+		q.Where(`object_id = ?`, f.ObjectID)
+	}
+	if f.Type != "" {
+		q.Where(`type = ?`, f.Type)
+	}
+	if f.AdminStatus != "" {
+		q.Where(`admin_status = ?`, f.AdminStatus)
+	}
+	if f.OperStatus != "" {
+		q.Where(`oper_status = ?`, f.OperStatus)
+	}
+	if !f.OperSince.IsZero() {
+		q.Where(`oper_changed_at <= ?`, f.OperSince)
+	}
+	if f.Speed != 0 {
+		q.Where(`speed = ?`, f.Speed)
+	}
+	if f.Mtu != 0 {
+		q.Where(`mtu = ?`, f.Mtu)
+	}
+	if f.Mac != "" {
+		q.Where(`lower(mac) = lower(?)`, f.Mac)
+	}
+
+	cnt, err := q.OrderExpr(`object_id, natsort(name)`).Limit(limit).Offset(offset).SelectAndCount()
+	if err != nil && err != pg.ErrNoRows {
+		return ints, 0, err
+	}
+
+	return ints, cnt, nil
 }
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"fmt"
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"sort"
+)
+
+// LagLink is logical link between two port-channels, made of member links. It's not stored, but derived
+// from member links and po_members.
+type LagLink struct {
+	Object1ID	int64	`json:"object1_id"`
+	Po1ID		int64	`json:"po1_id"`
+	Object2ID	int64	`json:"object2_id"`
+	Po2ID		int64	`json:"po2_id"`
+	Members		[]Link	`json:"members"`
+}
+
+// LagMismatch is member link, that doesn't fit into port-channels of both sides
+type LagMismatch struct {
+	Link	Link	`json:"link"`
+	Reason	string	`json:"reason"`
+}
+
+// LinksGroupLags groups member links of port-channels into LAG links. Links of ports, that are not members
+// on both ends, are returned as single ones.
+func LinksGroupLags(links []Link) ([]LagLink, []Link, []LagMismatch, error) {
+	intIDs := make([]int64, 0, len(links) * 2)
+	for i := range links {
+		intIDs = append(intIDs, links[i].Int1ID, links[i].Int2ID)
+	}
+
+	poOf := make(map[int64]int64)
+	if len(intIDs) > 0 {
+		var members []PoMember
+		if err := db.DB.Model(&members).Where(`member_id IN (?)`, pg.In(intIDs)).Select(); err != nil && err != pg.ErrNoRows {
+			return nil, nil, nil, err
+		}
+		for i := range members {
+			poOf[members[i].MemberID] = members[i].PoID
+		}
+	}
+
+	lags, singles, mismatches := GroupLags(links, poOf)
+	return lags, singles, mismatches, nil
+}
+
+// GroupLags groups links by port-channels of their ends, given port-channel ID by member interface ID.
+// Link with member port on one end only, and port-channel with members leading to several port-channels,
+// are reported as mismatches.
+func GroupLags(links []Link, poOf map[int64]int64) ([]LagLink, []Link, []LagMismatch) {
+	singles := make([]Link, 0)
+	mismatches := make([]LagMismatch, 0)
+	groups := make(map[[2]int64]*LagLink)
+	for _, l := range links {
+		po1, ok1 := poOf[l.Int1ID]
+		po2, ok2 := poOf[l.Int2ID]
+		switch {
+		case ok1 && ok2:
+			// port-channel with lower ID is the first end, so both directions get the same group
+			if po2 < po1 {
+				l.Object1ID, l.Object2ID, l.Int1ID, l.Int2ID = l.Object2ID, l.Object1ID, l.Int2ID, l.Int1ID
+				po1, po2 = po2, po1
+			}
+			key := [2]int64{po1, po2}
+			lag, ok := groups[key]
+			if !ok {
+				lag = &LagLink{Object1ID:l.Object1ID, Po1ID:po1, Object2ID:l.Object2ID, Po2ID:po2, Members:make([]Link, 0)}
+				groups[key] = lag
+			}
+			lag.Members = append(lag.Members, l)
+			continue
+		case ok1:
+			mismatches = append(mismatches, LagMismatch{Link:l, Reason:fmt.Sprintf("port %d is member of port-channel %d, but peer port %d is not", l.Int1ID, po1, l.Int2ID)})
+		case ok2:
+			mismatches = append(mismatches, LagMismatch{Link:l, Reason:fmt.Sprintf("port %d is member of port-channel %d, but peer port %d is not", l.Int2ID, po2, l.Int1ID)})
+		}
+		singles = append(singles, l)
+	}
+
+	lags := make([]LagLink, 0, len(groups))
+	peers := make(map[int64]int)
+	for _, lag := range groups {
+		lags = append(lags, *lag)
+		peers[lag.Po1ID]++
+		peers[lag.Po2ID]++
+	}
+	sort.Slice(lags, func(i, j int) bool {
+		if lags[i].Po1ID != lags[j].Po1ID {
+			return lags[i].Po1ID < lags[j].Po1ID
+		}
+		return lags[i].Po2ID < lags[j].Po2ID
+	})
+
+	// members of one port-channel should lead to the same peer port-channel
+	for _, lag := range lags {
+		for _, po := range []int64{lag.Po1ID, lag.Po2ID} {
+			if peers[po] < 2 {
+				continue
+			}
+			for _, l := range lag.Members {
+				mismatches = append(mismatches, LagMismatch{Link:l, Reason:fmt.Sprintf("members of port-channel %d lead to several port-channels", po)})
+			}
+			break
+		}
+	}
+
+	return lags, singles, mismatches
+}
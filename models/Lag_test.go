@@ -0,0 +1,38 @@
+package models
+
+import "testing"
+
+func TestGroupLags(t *testing.T) {
+	// po 10 (ports 1, 2) of object 1 <-> po 20 (ports 3, 4) of object 2; port 5 is not in port-channel,
+	// while it's peer 6 is member of po 20
+	poOf := map[int64]int64{1:10, 2:10, 3:20, 4:20, 6:20}
+	links := []Link{
+		{ID:1, Object1ID:1, Int1ID:1, Object2ID:2, Int2ID:3},
+		// reversed direction
+		{ID:2, Object1ID:2, Int1ID:4, Object2ID:1, Int2ID:2},
+		{ID:3, Object1ID:1, Int1ID:5, Object2ID:2, Int2ID:6},
+		{ID:4, Object1ID:1, Int1ID:7, Object2ID:3, Int2ID:8},
+	}
+
+	lags, singles, mismatches := GroupLags(links, poOf)
+	if len(lags) != 1 || len(lags[0].Members) != 2 || lags[0].Po1ID != 10 || lags[0].Po2ID != 20 {
+		t.Fatalf("unexpected lags: %+v", lags)
+	}
+	if m := lags[0].Members[1]; m.Int1ID != 2 || m.Object1ID != 1 {
+		t.Errorf("reversed member is not aligned to lag: %+v", m)
+	}
+	if len(singles) != 2 {
+		t.Errorf("unexpected single links: %+v", singles)
+	}
+	if len(mismatches) != 1 || mismatches[0].Link.ID != 3 {
+		t.Errorf("unexpected mismatches: %+v", mismatches)
+	}
+
+	// member of po 10 leads to another port-channel
+	poOf[9] = 30
+	links = append(links, Link{ID:5, Object1ID:1, Int1ID:1, Object2ID:3, Int2ID:9})
+	lags, _, mismatches = GroupLags(links, poOf)
+	if len(lags) != 2 || len(mismatches) != 4 {
+		t.Errorf("split lag is not reported: %d lags, mismatches %+v", len(lags), mismatches)
+	}
+}
@@ -1,6 +1,17 @@
 package models
 
-import "time"
+import (
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+// Link types: LLDP links are built and aged by discovery, manual ones are created by users and never aged
+const (
+	LinkTypeLldp	= "LLDP"
+	LinkTypeManual	= "MANUAL"
+)
 
 type Link struct {
 	TableName struct{} `sql:"links"`
@@ -12,4 +23,72 @@ type Link struct {
 	Int2ID			int64		`json:"int2_id" sql:"int2_id"`
 	LinkType		string		`json:"link_type" sql:"link_type"`
 	CreatedAt		*time.Time	`json:"created_at"`
+	// last time link was seen by LLDP of any of it's ends
+	LastConfirmedAt	*time.Time	`json:"last_confirmed_at" sql:"default:now()"`
+}
+
+// LinkConflict is LLDP adjacency, that is not stored as link, because manual link occupies one of it's ports
+type LinkConflict struct {
+	TableName struct{} `sql:"link_conflicts" json:"-"`
+
+	ID					int64		`json:"id"`
+	ObjectID			int64		`json:"object_id"`
+	LocalInterfaceID	int64		`json:"local_interface_id"`
+	NeighborID			int64		`json:"neighbor_id"`
+	NeighborInterfaceID	int64		`json:"neighbor_interface_id"`
+	// conflicting manual link
+	LinkID				int64		`json:"link_id"`
+	LastSeen			time.Time	`json:"last_seen" sql:"default:now()"`
+}
+
+// LinksConfirm stamps links as seen by LLDP now
+func LinksConfirm(tx orm.DB, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := tx.Model(&Link{}).Set(`last_confirmed_at = now()`).Where(`id IN (?)`, pg.In(ids)).Update()
+	return err
+}
+
+// LinksStale returns LLDP links of object, that are not confirmed since given time
+func LinksStale(tx orm.DB, objectID int64, since time.Time) ([]Link, error) {
+	links := make([]Link, 0)
+	err := tx.Model(&links).
+		WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+			q.Where(`object1_id = ?`, objectID).WhereOr(`object2_id = ?`, objectID)
+			return q, nil
+		}).
+		Where(`link_type <> ?`, LinkTypeManual).
+		Where(`last_confirmed_at < ?`, since).
+		Select()
+	if err != nil && err != pg.ErrNoRows {
+		return links, err
+	}
+
+	return links, nil
+}
+
+// LinkConflictsStore replaces link conflicts of object with given ones
+func LinkConflictsStore(tx orm.DB, objectID int64, list []LinkConflict) error {
+	if _, err := tx.Model(&LinkConflict{}).Where(`object_id = ?`, objectID).Delete(); err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return tx.Insert(&list)
+}
+
+// LinkConflicts returns link conflicts of object, or of all objects, if objectID is zero
+func LinkConflicts(objectID int64) ([]LinkConflict, error) {
+	list := make([]LinkConflict, 0)
+	q := db.DB.Model(&list).Order(`object_id`, `id`)
+	if objectID != 0 {
+		q.Where(`object_id = ?`, objectID)
+	}
+	if err := q.Select(); err != nil && err != pg.ErrNoRows {
+		return list, err
+	}
+
+	return list, nil
 }
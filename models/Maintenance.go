@@ -0,0 +1,171 @@
+package models
+
+import (
+	"fmt"
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+const (
+	RecurOnce	= ""
+	RecurDaily	= "daily"
+	RecurWeekly	= "weekly"
+)
+
+// Maintenance is planned window, when box discovery of affected objects is skipped and their
+// alive changes are not counted in availability. Window is scoped to objects and/or segments.
+type Maintenance struct {
+	TableName struct{} `sql:"maintenances" json:"-"`
+
+	ID			int64		`json:"id"`
+	Title		string		`json:"title"`
+	// first (or only) occurence of window
+	StartAt		time.Time	`json:"start_at"`
+	EndAt		time.Time	`json:"end_at"`
+	// RecurDaily/RecurWeekly repeats window until 'Until' (if set)
+	Recurrence	string		`json:"recurrence"`
+	Until		*time.Time	`json:"until"`
+	ObjectIDs	[]int64		`json:"object_ids" sql:",array"`
+	SegmentIDs	[]int64		`json:"segment_ids" sql:",array"`
+	CreatedAt	*time.Time	`json:"created_at"`
+}
+
+// Validate checks window times and recurrence
+func (m Maintenance) Validate() error {
+	if !m.EndAt.After(m.StartAt) {
+		return fmt.Errorf("Maintenance end should be after start")
+	}
+	if len(m.ObjectIDs) == 0 && len(m.SegmentIDs) == 0 {
+		return fmt.Errorf("Maintenance should have objects or segments")
+	}
+
+	switch m.Recurrence {
+	case RecurOnce:
+	case RecurDaily, RecurWeekly:
+		if m.EndAt.Sub(m.StartAt) >= m.period() {
+			return fmt.Errorf("Maintenance duration should be less than %s recurrence period", m.Recurrence)
+		}
+	default:
+		return fmt.Errorf("Unknown recurrence '%s'", m.Recurrence)
+	}
+
+	return nil
+}
+
+func (m Maintenance) period() time.Duration {
+	switch m.Recurrence {
+	case RecurDaily:
+		return time.Hour * 24
+	case RecurWeekly:
+		return time.Hour * 24 * 7
+	}
+	return 0
+}
+
+// Period is time interval [Start, End)
+type Period struct {
+	Start	time.Time	`json:"start"`
+	End		time.Time	`json:"end"`
+}
+
+// ActiveAt returns true, if one of window occurences contains t
+func (m Maintenance) ActiveAt(t time.Time) bool {
+	if t.Before(m.StartAt) {
+		return false
+	}
+	if m.Recurrence == RecurOnce {
+		return t.Before(m.EndAt)
+	}
+	if m.Until != nil && !t.Before(*m.Until) {
+		return false
+	}
+
+	return t.Before(m.lastStart(t).Add(m.EndAt.Sub(m.StartAt)))
+}
+
+// Occurences returns window occurences, that overlap [from, to), clipped by it
+func (m Maintenance) Occurences(from time.Time, to time.Time) []Period {
+	periods := make([]Period, 0)
+	if m.Recurrence != RecurOnce && m.Until != nil && m.Until.Before(to) {
+		to = *m.Until
+	}
+
+	start := m.StartAt
+	if from.After(start) {
+		start = m.lastStart(from)
+	}
+	for start.Before(to) {
+		p := Period{Start:start, End:start.Add(m.EndAt.Sub(m.StartAt))}
+		if p.End.After(from) {
+			if p.Start.Before(from) {
+				p.Start = from
+			}
+			if p.End.After(to) {
+				p.End = to
+			}
+			periods = append(periods, p)
+		}
+		if m.Recurrence == RecurOnce {
+			break
+		}
+		start = start.AddDate(0, 0, int(m.period().Hours() / 24))
+	}
+
+	return periods
+}
+
+// lastStart returns start of the last occurence before t; t should not be before window start.
+// Days are counted by calendar, so DST shifts don't move window.
+func (m Maintenance) lastStart(t time.Time) time.Time {
+	start := m.StartAt.In(t.Location())
+	if m.Recurrence == RecurOnce {
+		return start
+	}
+
+	days := int(t.Sub(start).Hours() / 24)
+	if m.Recurrence == RecurWeekly {
+		days -= days % 7
+	}
+	start = start.AddDate(0, 0, days)
+	if start.After(t) {
+		start = start.AddDate(0, 0, -int(m.period().Hours() / 24))
+	}
+
+	return start
+}
+
+// Covers returns true if window is scoped to object, or object is one of given objects of window segments
+func (m Maintenance) Covers(objectID int64, segmentObjects map[int64]bool) bool {
+	for _, id := range m.ObjectIDs {
+		if id == objectID {
+			return true
+		}
+	}
+
+	return len(m.SegmentIDs) > 0 && segmentObjects[objectID]
+}
+
+func MaintenancesAll() ([]Maintenance, error) {
+	var windows []Maintenance
+	err := db.DB.Model(&windows).Order(`start_at`).Select()
+	if err != nil && err != pg.ErrNoRows {
+		return windows, err
+	}
+
+	return windows, nil
+}
+
+// SegmentsObjectIDs returns IDs of objects, that belong to any of given segments
+func SegmentsObjectIDs(segmentIDs []int64) ([]int64, error) {
+	ids := make([]int64, 0)
+	if len(segmentIDs) == 0 {
+		return ids, nil
+	}
+	err := db.DB.Model(&ObjectSegment{}).ColumnExpr(`DISTINCT object_id`).Where(`segment_id IN (?)`, pg.In(segmentIDs)).Select(&ids)
+	if err != nil && err != pg.ErrNoRows {
+		return ids, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceActiveAt(t *testing.T) {
+	start := time.Date(2019, 3, 1, 2, 0, 0, 0, time.UTC)
+	until := start.AddDate(0, 1, 0)
+
+	tests := []struct {
+		name	string
+		m		Maintenance
+		at		time.Time
+		active	bool
+	}{
+		{"once before", Maintenance{StartAt:start, EndAt:start.Add(time.Hour)}, start.Add(-time.Minute), false},
+		{"once inside", Maintenance{StartAt:start, EndAt:start.Add(time.Hour)}, start.Add(time.Minute * 30), true},
+		{"once at end", Maintenance{StartAt:start, EndAt:start.Add(time.Hour)}, start.Add(time.Hour), false},
+		{"once next day", Maintenance{StartAt:start, EndAt:start.Add(time.Hour)}, start.AddDate(0, 0, 1), false},
+		{"daily next day", Maintenance{StartAt:start, EndAt:start.Add(time.Hour), Recurrence:RecurDaily}, start.AddDate(0, 0, 5).Add(time.Minute), true},
+		{"daily outside", Maintenance{StartAt:start, EndAt:start.Add(time.Hour), Recurrence:RecurDaily}, start.AddDate(0, 0, 5).Add(time.Hour * 2), false},
+		{"daily over midnight", Maintenance{StartAt:start.Add(time.Hour * 21), EndAt:start.Add(time.Hour * 25), Recurrence:RecurDaily}, start.AddDate(0, 0, 3), true},
+		{"daily until", Maintenance{StartAt:start, EndAt:start.Add(time.Hour), Recurrence:RecurDaily, Until:&until}, until.AddDate(0, 0, 1), false},
+		{"weekly same weekday", Maintenance{StartAt:start, EndAt:start.Add(time.Hour), Recurrence:RecurWeekly}, start.AddDate(0, 0, 14), true},
+		{"weekly other weekday", Maintenance{StartAt:start, EndAt:start.Add(time.Hour), Recurrence:RecurWeekly}, start.AddDate(0, 0, 15), false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.m.ActiveAt(tt.at); got != tt.active {
+			t.Errorf("%s: ActiveAt(%s) = %v, expected %v", tt.name, tt.at, got, tt.active)
+		}
+	}
+}
+
+func TestMaintenanceValidate(t *testing.T) {
+	start := time.Now()
+	if err := (Maintenance{StartAt:start, EndAt:start.Add(time.Hour), ObjectIDs:[]int64{1}}).Validate(); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err := (Maintenance{StartAt:start, EndAt:start, ObjectIDs:[]int64{1}}).Validate(); err == nil {
+		t.Errorf("empty window should not be valid")
+	}
+	if err := (Maintenance{StartAt:start, EndAt:start.Add(time.Hour)}).Validate(); err == nil {
+		t.Errorf("window without scope should not be valid")
+	}
+	if err := (Maintenance{StartAt:start, EndAt:start.Add(time.Hour * 25), Recurrence:RecurDaily, ObjectIDs:[]int64{1}}).Validate(); err == nil {
+		t.Errorf("daily window longer than day should not be valid")
+	}
+}
+
+func TestMaintenanceCovers(t *testing.T) {
+	m := Maintenance{ObjectIDs:[]int64{1}, SegmentIDs:[]int64{10}}
+	segmentObjects := map[int64]bool{2:true}
+	if !m.Covers(1, nil) || !m.Covers(2, segmentObjects) || m.Covers(3, segmentObjects) {
+		t.Errorf("wrong coverage of window %+v", m)
+	}
+
+	m.SegmentIDs = nil
+	if m.Covers(2, segmentObjects) {
+		t.Errorf("window without segments covers segment objects")
+	}
+}
+
+func TestMaintenanceOccurences(t *testing.T) {
+	start := time.Date(2019, 3, 1, 2, 0, 0, 0, time.UTC)
+	until := start.AddDate(0, 0, 3)
+	daily := Maintenance{StartAt:start, EndAt:start.Add(time.Hour), Recurrence:RecurDaily, Until:&until}
+
+	// from is inside of the first occurence, to is inside of the second one
+	periods := daily.Occurences(start.Add(time.Minute * 30), start.AddDate(0, 0, 1).Add(time.Minute * 10))
+	if len(periods) != 2 || !periods[0].Start.Equal(start.Add(time.Minute * 30)) ||
+		!periods[1].End.Equal(start.AddDate(0, 0, 1).Add(time.Minute * 10)) {
+		t.Errorf("daily occurences are %+v", periods)
+	}
+
+	if periods = daily.Occurences(start, start.AddDate(0, 0, 10)); len(periods) != 3 {
+		t.Errorf("expected 3 occurences before until, got %+v", periods)
+	}
+
+	once := Maintenance{StartAt:start, EndAt:start.Add(time.Hour)}
+	if periods = once.Occurences(start.AddDate(0, 0, -1), start.AddDate(0, 0, 1)); len(periods) != 1 ||
+		!periods[0].Start.Equal(start) || !periods[0].End.Equal(start.Add(time.Hour)) {
+		t.Errorf("single occurence is %+v", periods)
+	}
+	if periods = once.Occurences(start.Add(time.Hour), start.AddDate(0, 0, 1)); len(periods) != 0 {
+		t.Errorf("occurence after window end: %+v", periods)
+	}
+}
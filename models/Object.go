@@ -30,8 +30,11 @@ type Object struct {
  	Serial		string		`json:"serial"`
 	UplinkID	int64		`json:"uplink_id", sql:"uplink_id"`
 	ForeignID	sql.NullInt64	`json:"foreign_id"`
+	DomainID	int64		`json:"domain_id" sql:"domain_id"`
 
 	NextBox		time.Time	`json:"next_box"`
+	// last successful run of each box task type, by dproto task name
+	TaskRuns	map[string]time.Time	`json:"task_runs" sql:"task_runs"`
 }
 
 func (o *Object) GetInterfacesCount(intType string) (int, error) {
@@ -0,0 +1,186 @@
+package models
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"sort"
+	"time"
+)
+
+// ObjectState is alive/dead transition of object, reported by pinger
+type ObjectState struct {
+	TableName struct{} `sql:"object_states" json:"-"`
+
+	ID			int64		`json:"id"`
+	ObjectID	int64		`json:"object_id"`
+	Alive		bool		`json:"alive" sql:",notnull"`
+	ChangedAt	time.Time	`json:"changed_at"`
+	// transition happened during maintenance window
+	Maintenance	bool		`json:"maintenance" sql:",notnull"`
+}
+
+type Outage struct {
+	Start		time.Time	`json:"start"`
+	End			time.Time	`json:"end"`
+	Duration	int64		`json:"duration"`
+	Ongoing		bool		`json:"ongoing"`
+	// part of outage during maintenance windows, it's not counted in downtime
+	MaintenanceDuration	int64	`json:"maintenance_duration"`
+	// whole outage is during maintenance
+	Maintenance	bool		`json:"maintenance"`
+}
+
+type Availability struct {
+	ObjectID	int64		`json:"object_id"`
+	From		time.Time	`json:"from"`
+	To			time.Time	`json:"to"`
+	Percent		float64		`json:"availability"`
+	Downtime	int64		`json:"downtime"`
+	Outages		[]Outage	`json:"outages"`
+}
+
+// ObjectsAvailability calculates availability for every given object within [from, to). Maintenance are
+// periods of windows, covering objects, by object id.
+func ObjectsAvailability(objects []Object, maintenance map[int64][]Period, from time.Time, to time.Time) ([]Availability, error) {
+	result := make([]Availability, 0, len(objects))
+	if len(objects) == 0 {
+		return result, nil
+	}
+
+	ids := make([]int64, 0, len(objects))
+	for i := range objects {
+		ids = append(ids, objects[i].ID)
+	}
+
+	// state of every object at the beginning of period
+	var prev []ObjectState
+	_, err := db.DB.Query(&prev, `SELECT DISTINCT ON (object_id) * FROM object_states
+		WHERE object_id IN (?) AND changed_at < ? ORDER BY object_id, changed_at DESC`, pg.In(ids), from)
+	if err != nil {
+		return result, err
+	}
+
+	var states []ObjectState
+	if err = db.DB.Model(&states).Where(`object_id IN (?)`, pg.In(ids)).
+		Where(`changed_at >= ?`, from).Where(`changed_at < ?`, to).
+		Order(`changed_at`).Select(); err != nil && err != pg.ErrNoRows {
+		return result, err
+	}
+
+	prevMap := make(map[int64]bool, len(prev))
+	for i := range prev {
+		prevMap[prev[i].ObjectID] = prev[i].Alive
+	}
+	statesMap := make(map[int64][]ObjectState)
+	for i := range states {
+		statesMap[states[i].ObjectID] = append(statesMap[states[i].ObjectID], states[i])
+	}
+
+	for i := range objects {
+		oid := objects[i].ID
+		initial, ok := prevMap[oid]
+		if !ok {
+			// no history before period: take state opposite to the first transition, or current one
+			if len(statesMap[oid]) > 0 {
+				initial = !statesMap[oid][0].Alive
+			} else {
+				initial = objects[i].Alive
+			}
+		}
+		a := CalcAvailability(initial, statesMap[oid], maintenance[oid], from, to)
+		a.ObjectID = oid
+		result = append(result, a)
+	}
+
+	return result, nil
+}
+
+// CalcAvailability walks over sorted transitions, starting from initial state, and collects outages.
+// Parts of outages within maintenance periods are not counted in downtime.
+func CalcAvailability(initial bool, states []ObjectState, maintenance []Period, from time.Time, to time.Time) Availability {
+	a := Availability{
+		From:from,
+		To:to,
+		Outages:make([]Outage, 0),
+	}
+	if !to.After(from) {
+		a.Percent = 100
+		return a
+	}
+
+	alive := initial
+	var downSince time.Time
+	if !alive {
+		downSince = from
+	}
+
+	for i := range states {
+		st := states[i]
+		if st.ChangedAt.Before(from) || !st.ChangedAt.Before(to) || st.Alive == alive {
+			continue
+		}
+		if st.Alive {
+			a.Outages = append(a.Outages, Outage{Start:downSince, End:st.ChangedAt})
+		} else {
+			downSince = st.ChangedAt
+		}
+		alive = st.Alive
+	}
+	if !alive {
+		a.Outages = append(a.Outages, Outage{Start:downSince, End:to, Ongoing:true})
+	}
+
+	maintenance = mergePeriods(maintenance)
+	var down time.Duration
+	for i := range a.Outages {
+		o := &a.Outages[i]
+		d := o.End.Sub(o.Start)
+		var m time.Duration
+		for _, p := range maintenance {
+			if p.Start.Before(o.End) && p.End.After(o.Start) {
+				m += minTime(p.End, o.End).Sub(maxTime(p.Start, o.Start))
+			}
+		}
+		o.Duration = int64(d.Seconds())
+		o.MaintenanceDuration = int64(m.Seconds())
+		o.Maintenance = m > 0 && m == d
+		down += d - m
+	}
+	a.Downtime = int64(down.Seconds())
+	a.Percent = 100 * (1 - down.Seconds()/to.Sub(from).Seconds())
+
+	return a
+}
+
+// mergePeriods returns sorted periods, where overlapping ones are merged
+func mergePeriods(periods []Period) []Period {
+	sorted := make([]Period, len(periods))
+	copy(sorted, periods)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+
+	merged := make([]Period, 0, len(sorted))
+	for _, p := range sorted {
+		if n := len(merged); n > 0 && !p.Start.After(merged[n-1].End) {
+			merged[n-1].End = maxTime(merged[n-1].End, p.End)
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+func minTime(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalcAvailabilityNoChanges(t *testing.T) {
+	from := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour * 10)
+
+	a := CalcAvailability(true, nil, nil, from, to)
+	if a.Percent != 100 || len(a.Outages) != 0 {
+		t.Fatalf("alive object without changes: got %v%% and %d outages", a.Percent, len(a.Outages))
+	}
+
+	a = CalcAvailability(false, nil, nil, from, to)
+	if a.Percent != 0 || len(a.Outages) != 1 || !a.Outages[0].Ongoing {
+		t.Fatalf("dead object without changes: got %v%% and %d outages", a.Percent, len(a.Outages))
+	}
+}
+
+func TestCalcAvailabilityOutages(t *testing.T) {
+	from := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour * 10)
+	states := []ObjectState{
+		{Alive:false, ChangedAt:from.Add(time.Hour)},
+		{Alive:true, ChangedAt:from.Add(time.Hour * 2)},
+		// duplicate state must not start another outage
+		{Alive:true, ChangedAt:from.Add(time.Hour * 3)},
+		{Alive:false, ChangedAt:from.Add(time.Hour * 9)},
+	}
+
+	a := CalcAvailability(true, states, nil, from, to)
+	if len(a.Outages) != 2 {
+		t.Fatalf("expected 2 outages, got %d", len(a.Outages))
+	}
+	if a.Outages[0].Duration != 3600 || a.Outages[0].Ongoing {
+		t.Fatalf("wrong first outage: %+v", a.Outages[0])
+	}
+	if !a.Outages[1].Ongoing || !a.Outages[1].End.Equal(to) {
+		t.Fatalf("second outage should last till the end of period: %+v", a.Outages[1])
+	}
+	if a.Downtime != 7200 || a.Percent != 80 {
+		t.Fatalf("expected 7200s downtime and 80%%, got %ds and %v%%", a.Downtime, a.Percent)
+	}
+}
+
+func TestCalcAvailabilityMaintenance(t *testing.T) {
+	from := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour * 10)
+	states := []ObjectState{
+		{Alive:false, ChangedAt:from.Add(time.Hour)},
+		{Alive:true, ChangedAt:from.Add(time.Hour * 2)},
+		// outage continues after the end of window
+		{Alive:false, ChangedAt:from.Add(time.Hour * 4)},
+		{Alive:true, ChangedAt:from.Add(time.Hour * 7)},
+	}
+	maintenance := []Period{
+		{Start:from.Add(time.Minute * 30), End:from.Add(time.Hour * 3)},
+		// overlapping windows are not subtracted twice
+		{Start:from.Add(time.Hour * 3), End:from.Add(time.Hour * 5)},
+		{Start:from.Add(time.Hour * 4), End:from.Add(time.Hour * 5)},
+	}
+
+	a := CalcAvailability(true, states, maintenance, from, to)
+	if len(a.Outages) != 2 || !a.Outages[0].Maintenance || a.Outages[1].Maintenance {
+		t.Fatalf("expected maintenance outage and partial one, got %+v", a.Outages)
+	}
+	if a.Outages[1].MaintenanceDuration != 3600 {
+		t.Fatalf("expected 3600s of second outage in maintenance, got %+v", a.Outages[1])
+	}
+	if a.Downtime != 7200 || a.Percent != 80 {
+		t.Fatalf("expected 7200s downtime and 80%%, got %ds and %v%%", a.Downtime, a.Percent)
+	}
+
+	// outage, in progress at the beginning of period
+	a = CalcAvailability(false, []ObjectState{{Alive:true, ChangedAt:from.Add(time.Hour * 2)}},
+		[]Period{{Start:from, End:from.Add(time.Hour)}}, from, to)
+	if a.Downtime != 3600 || a.Outages[0].MaintenanceDuration != 3600 {
+		t.Fatalf("expected 3600s downtime of outage in progress, got %ds: %+v", a.Downtime, a.Outages)
+	}
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+// PendingChangeset is discovery changeset, that is not applied because it deletes too much.
+// It waits for approval or rejection; newer one of the same object replaces it.
+type PendingChangeset struct {
+	TableName struct{} `sql:"pending_changesets" json:"-"`
+
+	ID			int64				`json:"id"`
+	ObjectID	int64				`json:"object_id"`
+	RequestID	string				`json:"request_id"`
+	CreatedAt	time.Time			`json:"created_at"`
+	Deletions	int					`json:"deletions"`
+	Changeset	json.RawMessage		`json:"changeset,omitempty"`
+}
+
+// PendingChangesetHold stores changeset instead of previous pending one of the same object
+func PendingChangesetHold(p *PendingChangeset) error {
+	return db.DB.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Model(&PendingChangeset{}).Where(`object_id = ?`, p.ObjectID).Delete(); err != nil {
+			return err
+		}
+		return tx.Insert(p)
+	})
+}
+
+// PendingChangesets returns pending changesets without their changes, newest first. Zero objectID means all objects.
+func PendingChangesets(objectID int64) ([]PendingChangeset, error) {
+	list := make([]PendingChangeset, 0)
+	q := db.DB.Model(&list).Column("id", "object_id", "request_id", "created_at", "deletions").Order(`id DESC`)
+	if objectID != 0 {
+		q.Where(`object_id = ?`, objectID)
+	}
+	if err := q.Select(); err != nil && err != pg.ErrNoRows {
+		return list, err
+	}
+
+	return list, nil
+}
+
+// PendingChangesetByID returns nil if there is no such changeset
+func PendingChangesetByID(id int64) (*PendingChangeset, error) {
+	p := PendingChangeset{ID:id}
+	err := db.DB.Model(&p).WherePK().Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// PendingChangesetTake removes changeset and returns it, so it's approved or rejected only once.
+// Returns nil if there is no such changeset.
+func PendingChangesetTake(tx orm.DB, id int64) (*PendingChangeset, error) {
+	var p PendingChangeset
+	_, err := tx.QueryOne(&p, `DELETE FROM pending_changesets WHERE id = ? RETURNING *`, id)
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
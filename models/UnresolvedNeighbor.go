@@ -0,0 +1,84 @@
+package models
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/ircop/ohandler/db"
+	"time"
+)
+
+// UnresolvedNeighbor is LLDP neighbor, whose chassis (or port) is not found in inventory
+type UnresolvedNeighbor struct {
+	TableName struct{} `sql:"unresolved_neighbors" json:"-"`
+
+	ID					int64		`json:"id"`
+	ObjectID			int64		`json:"object_id"`
+	LocalInterfaceID	int64		`json:"local_interface_id"`
+	LocalPort			string		`json:"local_port"`
+	ChassisID			string		`json:"chassis_id"`
+	PortID				string		`json:"port_id"`
+	// neighbor object, if only it's port is not found
+	NeighborID			int64		`json:"neighbor_id"`
+	FirstSeen			time.Time	`json:"first_seen" sql:"default:now()"`
+	LastSeen			time.Time	`json:"last_seen" sql:"default:now()"`
+}
+
+// UnresolvedNeighborsStore replaces unresolved neighbors of object with given ones in transaction.
+// Already known ones keep their first seen time.
+func UnresolvedNeighborsStore(tx orm.DB, objectID int64, list []UnresolvedNeighbor) error {
+	if len(list) > 0 {
+		_, err := tx.Model(&list).
+			OnConflict(`(object_id, local_port, chassis_id, port_id) DO UPDATE`).
+			Set(`last_seen = now()`).
+			Set(`local_interface_id = EXCLUDED.local_interface_id`).
+			Set(`neighbor_id = EXCLUDED.neighbor_id`).
+			Insert()
+		if err != nil {
+			return err
+		}
+	}
+
+	// now() is the same during transaction, so stored ones are seen at it
+	_, err := tx.Model(&UnresolvedNeighbor{}).Where(`object_id = ?`, objectID).Where(`last_seen < now()`).Delete()
+	return err
+}
+
+// UnresolvedNeighborsFind returns page of unresolved neighbors of objects in segment (or of single object),
+// recently seen first, and total amount of them. Zero IDs are not filtered.
+func UnresolvedNeighborsFind(segmentID int64, objectID int64, limit int, offset int) ([]UnresolvedNeighbor, int, error) {
+	list := make([]UnresolvedNeighbor, 0)
+	q := db.DB.Model(&list)
+	if segmentID != 0 {
+		q.Where(`object_id IN (SELECT object_id FROM object_segments WHERE segment_id = ?)`, segmentID)
+	}
+	if objectID != 0 {
+		q.Where(`object_id = ?`, objectID)
+	}
+
+	cnt, err := q.Order(`last_seen DESC`, `id DESC`).Limit(limit).Offset(offset).SelectAndCount()
+	if err != nil && err != pg.ErrNoRows {
+		return list, 0, err
+	}
+
+	return list, cnt, nil
+}
+
+// UnresolvedNeighborByID returns nil if there is no such neighbor
+func UnresolvedNeighborByID(id int64) (*UnresolvedNeighbor, error) {
+	n := UnresolvedNeighbor{ID:id}
+	err := db.DB.Model(&n).WherePK().Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &n, nil
+}
+
+// UnresolvedNeighborsRemove removes all unresolved neighbors with given chassis ID, f.e. when it's object is created
+func UnresolvedNeighborsRemove(chassisID string) error {
+	_, err := db.DB.Model(&UnresolvedNeighbor{}).Where(`chassis_id = ?`, chassisID).Delete()
+	return err
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/ircop/ohandler/cfg"
+	"github.com/ircop/ohandler/cluster"
 	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/dbwatch"
 	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/logger"
 	"github.com/ircop/ohandler/rest"
 	"github.com/ircop/ohandler/streamer"
+	"github.com/ircop/ohandler/taskparser"
 	"github.com/ircop/ohandler/tasks"
 	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -47,39 +54,126 @@ func main() {
 		config.DBUser, config.DBPassword); err != nil {
 			logger.Err("Cannot initialize DB: %s", err.Error())
 		}
+	if err := db.Migrate(); err != nil {
+		logger.Err("%s", err.Error())
+		return
+	}
 
 	logger.Log("Starting object handler instance")
 
-	if err = handler.StoreProfiles(); err != nil {
-		logger.Err("Failed to store auth profiles: %s", err.Error())
-		return
-	}
-	if err = handler.StoreDiscoveryProfiles(); err != nil {
-		logger.Err("Failed to store discovery profiles: %s", err.Error())
+	// paused until this instance is elected
+	tasks.InitScheduler(config)
+	tasks.Instance = config.ClusterInstance
+
+	// changes made outside of this process. Listening starts before state is loaded, so changes made
+	// meanwhile are not missed: then state is kept fresh by notifications, or reloaded if they could be lost.
+	dbwatch.Start(func() error {
+		if err := loadState(); err != nil {
+			return err
+		}
+		if cluster.IsLeader() {
+			tasks.ScheduleObjects()
+			streamer.Nats.DbSyncAll()
+		}
+		return nil
+	})
+
+	// followers need state for REST too
+	if err = loadState(); err != nil {
+		logger.Err("%s", err.Error())
 		return
 	}
-	if err = streamer.Init(config.NatsURL, config.NatsReplies, config.NatsTasks, config.NatsDB); err != nil {
+	if err = streamer.Init(config); err != nil {
 		logger.Err("Failed to init NATS-client: %s", err.Error())
 		return
 	}
 
+	// replies to requests sent before restart
+	streamer.OnUnknownReply = tasks.LateReply
+	tasks.StartRunsPruning(config.BoxRunsRetention)
+	tasks.HoldDeletions = config.BoxHoldDeletions
+	taskparser.LinkMaxAge = config.BoxLinkMaxAge
+	taskparser.FdbRetention = config.BoxFdbRetention
+	taskparser.ArpRetention = config.BoxArpRetention
+
+	/*
+	Leader (or single instance):
+	- reloads objects: notifications don't cover state columns, written by previous leader (alive, next_box, etc.)
+	- plans box discoveries of all objects
+	- handles db requests and ping updates; runs db sync, as we have just started
+	 */
+	cluster.Init(config, func() {
+		if err := handler.StoreObjects(); err != nil {
+			logger.Err("Leader: failed to reload objects: %s", err.Error())
+		}
+		tasks.ScheduleObjects()
+		tasks.Sched.Resume()
+		if err := streamer.Nats.StartLeading(); err != nil {
+			logger.Err("Leader: failed to subscribe domains: %s", err.Error())
+		}
+	}, func() {
+		tasks.Sched.Pause()
+		streamer.Nats.StopLeading()
+	})
+
+	web := rest.New(config)
+	go func() {
+		logger.Log("Listening RPC...")
+		web.Listen()
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	logger.Log("Got %s, shutting down...", <-sig)
+	shutdown(web, config.ShutdownTimeout)
+}
+
+/*
+Shutdown:
+- stop planning new box discoveries
+- stop REST, waiting for active requests
+- wait for running discoveries; interrupt the rest after timeout (they stay in DB for restart)
+- close bus connection
+ */
+func shutdown(web *rest.Rest, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tasks.Sched.Pause()
+	if err := web.Shutdown(ctx); err != nil {
+		logger.Err("Failed to stop REST: %s", err.Error())
+	}
+	tasks.Drain(ctx)
+	if err := streamer.Nats.Close(); err != nil {
+		logger.Err("Failed to close bus: %s", err.Error())
+	}
+
+	logger.Log("Stopped")
+}
+
+// loadState reads profiles, domains, maintenance windows and objects into memory
+func loadState() error {
+	if err := handler.StoreProfiles(); err != nil {
+		return fmt.Errorf("Failed to store auth profiles: %s", err.Error())
+	}
+	if err := handler.StoreDiscoveryProfiles(); err != nil {
+		return fmt.Errorf("Failed to store discovery profiles: %s", err.Error())
+	}
+	if err := handler.StoreDomains(); err != nil {
+		return fmt.Errorf("Failed to store domains: %s", err.Error())
+	}
+	if err := handler.StoreMaintenances(); err != nil {
+		return fmt.Errorf("Failed to store maintenance windows: %s", err.Error())
+	}
+
 	/*
 	- select all object from DB
 	- handle them to some struct, like 'type Object struct { mgmt: string, id: string, authProfile: string, profile: int?, timer: afterFunc ( ... discover ... )  }
 	- set timers: X timeout +- some random value
 	 */
-	 if err = handler.StoreObjects(); err != nil {
-		logger.Err("Failed to store objects: %s", err.Error())
-		return
-	 }
-
-	 tasks.ScheduleObjects()
-
-	// run db sync, as we have just started
-	streamer.Nats.DbSync(streamer.Nats.DbChan)
+	if err := handler.StoreObjects(); err != nil {
+		return fmt.Errorf("Failed to store objects: %s", err.Error())
+	}
 
-	 web := rest.New(config)
-	 logger.Log("Listening RPC...")
-	 web.Listen()
-	 //select{}
+	return nil
 }
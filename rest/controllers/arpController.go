@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"github.com/ircop/ohandler/models"
+	"net"
+	"time"
+)
+
+type ArpController struct {
+	HTTPController
+}
+
+// GET returns IP-to-MAC bindings of ip (optionally existed at given time: at=2006-01-02 15:04:05), or IPs,
+// used by mac. Without them, returns page of active ARP table of object_id.
+func (c *ArpController) GET(ctx *HTTPContext) {
+	result := make(map[string]interface{})
+
+	if ctx.Params["ip"] != "" || ctx.Params["mac"] != "" {
+		var list []models.ArpEntry
+		if ctx.Params["ip"] != "" {
+			ip := net.ParseIP(ctx.Params["ip"])
+			if ip == nil {
+				ReturnError(ctx.W, "Wrong ip address", true)
+				return
+			}
+			var at time.Time
+			var err error
+			if ctx.Params["at"] != "" {
+				if at, err = c.TimeParam(ctx, "at"); err != nil {
+					ReturnError(ctx.W, err.Error(), true)
+					return
+				}
+			}
+			if list, err = models.ArpByIP(ip.String(), at); err != nil {
+				ReturnError(ctx.W, err.Error(), true)
+				return
+			}
+		} else {
+			m, err := net.ParseMAC(ctx.Params["mac"])
+			if err != nil {
+				ReturnError(ctx.W, "Wrong mac address", true)
+				return
+			}
+			if list, err = models.ArpByMac(m.String()); err != nil {
+				ReturnError(ctx.W, err.Error(), true)
+				return
+			}
+		}
+
+		objIDs := make([]int64, 0)
+		for i := range list {
+			objIDs = append(objIDs, list[i].ObjectID)
+		}
+		names, err := objectNames(objIDs)
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+		rows := make([]interface{}, 0, len(list))
+		for i := range list {
+			rows = append(rows, map[string]interface{}{
+				"entry":list[i],
+				"object_name":names[list[i].ObjectID],
+			})
+		}
+
+		result["bindings"] = rows
+		WriteJSON(ctx.W, result)
+		return
+	}
+
+	objectID, err := c.IntParam(ctx, "object_id")
+	if err != nil {
+		ReturnError(ctx.W, "Wrong object ID", true)
+		return
+	}
+	limit, offset := c.PageParams(ctx, 50)
+
+	list, total, err := models.ArpFind(objectID, limit, offset)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	result["total"] = total
+	result["rows"] = list
+	WriteJSON(ctx.W, result)
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/models"
+	"time"
+)
+
+type AvailabilityController struct {
+	HTTPController
+}
+
+// GET returns outages timeline and availability of object (object_id) or segment (segment_id) within [from, to).
+// Period defaults to last 30 days.
+func (c *AvailabilityController) GET(ctx *HTTPContext) {
+	to, err := c.TimeParam(ctx, "to")
+	if err != nil {
+		to = time.Now()
+	}
+	from, err := c.TimeParam(ctx, "from")
+	if err != nil {
+		from = to.AddDate(0, 0, -30)
+	}
+	if !to.After(from) {
+		ReturnError(ctx.W, "'to' should be after 'from'", true)
+		return
+	}
+
+	var objects []models.Object
+	if oid, err := c.IntParam(ctx, "object_id"); err == nil {
+		err = db.DB.Model(&objects).Where(`id = ?`, oid).Select()
+		if err != nil && err != pg.ErrNoRows {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+		if len(objects) == 0 {
+			NotFound(ctx.W)
+			return
+		}
+	} else if sid, err := c.IntParam(ctx, "segment_id"); err == nil {
+		err = db.DB.Model(&objects).
+			Join(`JOIN object_segments AS s ON s.object_id = object.id`).
+			Where(`s.segment_id = ?`, sid).
+			Order(`id`).
+			Select()
+		if err != nil && err != pg.ErrNoRows {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+	} else {
+		ReturnError(ctx.W, "object_id or segment_id required", true)
+		return
+	}
+
+	// outages are not counted during maintenance windows
+	maintenance := make(map[int64][]models.Period, len(objects))
+	for i := range objects {
+		maintenance[objects[i].ID] = handler.MaintenancePeriods(objects[i].ID, from, to)
+	}
+
+	avail, err := models.ObjectsAvailability(objects, maintenance, from, to)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	result := make(map[string]interface{})
+	result["from"] = from
+	result["to"] = to
+	result["objects"] = avail
+
+	// segment availability is an average of it's objects
+	var total float64 = 100
+	if len(avail) > 0 {
+		total = 0
+		for i := range avail {
+			total += avail[i].Percent
+		}
+		total = total / float64(len(avail))
+	}
+	result["availability"] = total
+
+	WriteJSON(ctx.W, result)
+}
@@ -15,8 +15,11 @@ import (
 	"strings"
 	"time"
 	"math"
+	"regexp"
 )
 
+var reIds = regexp.MustCompile(`\d+`)
+
 // HTTPContext definition
 // context is used mostly for parameter passing over requests
 type HTTPContext struct {
@@ -25,6 +28,8 @@ type HTTPContext struct {
 	W            	http.ResponseWriter
 	Params       	map[string]string
 	UnauthRoutes 	[]string
+	// token of authorized request
+	Token			models.RestToken
 
 	//DashTemplates	string
 	Config *cfg.Cfg
@@ -160,6 +165,7 @@ func (c *HTTPController) checkAuth(ctx *HTTPContext) bool {
 		return false
 	}
 
+	ctx.Token = t
 	if t.Api {
 		return true
 	}
@@ -182,6 +188,44 @@ func (c *HTTPController) checkAuth(ctx *HTTPContext) bool {
 }
 
 
+// Source returns source of changes, made by this request: user login or api key
+func (ctx *HTTPContext) Source() string {
+	if ctx.Token.Api {
+		return models.SourceApiKey(ctx.Token.ID)
+	}
+
+	var u models.User
+	if err := db.DB.Model(&u).Where(`id = ?`, ctx.Token.UserID).First(); err != nil {
+		return models.SourceUser(fmt.Sprintf("#%d", ctx.Token.UserID))
+	}
+	return models.SourceUser(u.Login)
+}
+
+// journal stores change events of request. Change is made already, so failure is only logged.
+func journal(events ...models.ChangeEvent) {
+	if err := models.ChangeEventsInsert(db.DB, events); err != nil {
+		logger.RestErr("Cannot store change events: %s", err.Error())
+	}
+}
+
+// objectNames returns names of objects by id
+func objectNames(objIDs []int64) (map[int64]string, error) {
+	names := make(map[int64]string)
+	if len(objIDs) == 0 {
+		return names, nil
+	}
+
+	var objects []models.Object
+	if err := db.DB.Model(&objects).Column("id", "name").Where(`id in (?)`, pg.In(objIDs)).Select(); err != nil {
+		return nil, err
+	}
+	for i := range objects {
+		names[objects[i].ID] = objects[i].Name
+	}
+
+	return names, nil
+}
+
 // CheckParams return true of false after checking of all passed param names in params map
 func (c *HTTPController) CheckParams(ctx *HTTPContext, names []string) []string {
 	ret := make([]string, 0)
@@ -209,6 +253,52 @@ func (c *HTTPController) IntParam(ctx *HTTPContext, name string) (int64, error)
 	return i, nil
 }
 
+// TimeParam returns time, parsed from unix timestamp or 'YYYY-MM-DD[ HH:MM:SS]' parameter value, or error
+func (c *HTTPController) TimeParam(ctx *HTTPContext, name string) (time.Time, error) {
+	param, ok := ctx.Params[name]
+	if !ok || param == "" {
+		return time.Time{}, fmt.Errorf("Parameter '%s' doesn't exist", name)
+	}
+
+	if ts, err := strconv.ParseInt(param, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, param, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Parameter '%s' is not a time (%s)", name, param)
+}
+
+// IdsParam returns IDs, found in parameter value (json array or comma-separated list)
+func (c *HTTPController) IdsParam(ctx *HTTPContext, name string) []int64 {
+	ids := make([]int64, 0)
+	for _, m := range reIds.FindAllString(ctx.Params[name], -1) {
+		if id, err := strconv.ParseInt(m, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// PageParams returns limit and offset from 'pagesize' and 'page' (starting from 1) parameters
+func (c *HTTPController) PageParams(ctx *HTTPContext, defaultLimit int) (int, int) {
+	limit := defaultLimit
+	if size, err := strconv.Atoi(ctx.Params["pagesize"]); err == nil && size > 0 {
+		limit = size
+	}
+
+	offset := 0
+	if page, err := strconv.Atoi(ctx.Params["page"]); err == nil && page > 1 {
+		offset = (page - 1) * limit
+	}
+
+	return limit, offset
+}
+
 // OPTIONS handler
 func (c *HTTPController) OPTIONS(ctx *HTTPContext) {
 	returnOk(ctx.W)
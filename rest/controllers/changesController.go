@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"github.com/ircop/ohandler/models"
+)
+
+type ChangesController struct {
+	HTTPController
+}
+
+// GET returns change events, newest first. Filters: object_id, entity, entity_id, action, source, from, to.
+func (c *ChangesController) GET(ctx *HTTPContext) {
+	var f models.ChangeEventFilter
+	var err error
+	if _, ok := ctx.Params["object_id"]; ok {
+		if f.ObjectID, err = c.IntParam(ctx, "object_id"); err != nil {
+			ReturnError(ctx.W, "Wrong object ID", true)
+			return
+		}
+	}
+	if _, ok := ctx.Params["entity_id"]; ok {
+		if f.EntityID, err = c.IntParam(ctx, "entity_id"); err != nil {
+			ReturnError(ctx.W, "Wrong entity ID", true)
+			return
+		}
+	}
+	if ctx.Params["from"] != "" {
+		if f.From, err = c.TimeParam(ctx, "from"); err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+	}
+	if ctx.Params["to"] != "" {
+		if f.To, err = c.TimeParam(ctx, "to"); err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+	}
+	f.Entity = ctx.Params["entity"]
+	f.Action = ctx.Params["action"]
+	f.Source = ctx.Params["source"]
+	limit, offset := c.PageParams(ctx, 50)
+
+	events, total, err := models.ChangeEventsFind(f, limit, offset)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	result := make(map[string]interface{})
+	result["total"] = total
+	result["rows"] = events
+	WriteJSON(ctx.W, result)
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"github.com/ircop/ohandler/tasks"
+)
+
+type ChangesetsController struct {
+	HTTPController
+}
+
+// GET returns pending changeset with changes by id, or list of pending changesets (optionally of object_id)
+func (c *ChangesetsController) GET(ctx *HTTPContext) {
+	result := make(map[string]interface{})
+
+	if _, ok := ctx.Params["id"]; ok {
+		id, err := c.IntParam(ctx, "id")
+		if err != nil {
+			ReturnError(ctx.W, "Wrong changeset ID", true)
+			return
+		}
+		p, err := models.PendingChangesetByID(id)
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+		if p == nil {
+			NotFound(ctx.W)
+			return
+		}
+		result["changeset"] = p
+		WriteJSON(ctx.W, result)
+		return
+	}
+
+	var objectID int64
+	if _, ok := ctx.Params["object_id"]; ok {
+		var err error
+		if objectID, err = c.IntParam(ctx, "object_id"); err != nil {
+			ReturnError(ctx.W, "Wrong object ID", true)
+			return
+		}
+	}
+	list, err := models.PendingChangesets(objectID)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	result["changesets"] = list
+	WriteJSON(ctx.W, result)
+}
+
+// POST approves pending changeset by id: it's applied to DB. If it can't be applied anymore, it stays pending.
+func (c *ChangesetsController) POST(ctx *HTTPContext) {
+	id, err := c.IntParam(ctx, "id")
+	if err != nil {
+		ReturnError(ctx.W, "Wrong changeset ID", true)
+		return
+	}
+
+	cs, changes, err := tasks.ApproveChangeset(id, ctx.Source())
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	if cs == nil {
+		NotFound(ctx.W)
+		return
+	}
+	logger.Rest("Changeset #%d of %s is approved", id, cs.Name)
+
+	result := make(map[string]interface{})
+	result["changes"] = changes
+	WriteJSON(ctx.W, result)
+}
+
+// DELETE rejects pending changeset by id
+func (c *ChangesetsController) DELETE(ctx *HTTPContext) {
+	id, err := c.IntParam(ctx, "id")
+	if err != nil {
+		ReturnError(ctx.W, "Wrong changeset ID", true)
+		return
+	}
+
+	found, err := tasks.RejectChangeset(id)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	if !found {
+		NotFound(ctx.W)
+		return
+	}
+
+	returnOk(ctx.W)
+}
@@ -1,6 +1,9 @@
 package controllers
 
-import "github.com/ircop/dproto"
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/models"
+)
 
 type DiscoveryProblemsController struct {
 	HTTPController
@@ -16,6 +19,12 @@ func (c *DiscoveryProblemsController) GET(ctx *HTTPContext) {
 		item["title"] = name
 		list = append(list, item)
 	}
+	for id, name := range models.ProblemNames {
+		item := make(map[string]interface{})
+		item["id"] = id
+		item["title"] = name
+		list = append(list, item)
+	}
 
 	result := make(map[string]interface{})
 	result["problems"] = list
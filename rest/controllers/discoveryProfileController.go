@@ -124,6 +124,21 @@ func (c *DiscoveryProfileController) Save(ctx *HTTPContext) {
 	if ctx.Params["monitored"] == "true" {
 		monitored = true
 	}
+	taskIntervals, err := models.ParseTaskIntervals(ctx.Params["task_intervals"])
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	chassisRules, err := models.ParseLldpRules(ctx.Params["chassis_rules"], models.DefaultChassisRules)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	portRules, err := models.ParseLldpRules(ctx.Params["port_rules"], models.DefaultPortRules)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
 
 	// check for same title
 	cnt, err := db.DB.Model(&models.DiscoveryProfile{}).Where(`title = ?`, ctx.Params["title"]).Where(`id != ?`, id).Count()
@@ -151,6 +166,16 @@ func (c *DiscoveryProfileController) Save(ctx *HTTPContext) {
 	dp.PeriodicInterval = perInt
 	dp.PingInterval = pingInt
 	dp.Monitored = monitored
+	// intervals are kept as is, when not passed
+	if _, ok := ctx.Params["task_intervals"]; ok {
+		dp.TaskIntervals = taskIntervals
+	}
+	if _, ok := ctx.Params["chassis_rules"]; ok {
+		dp.ChassisRules = chassisRules
+	}
+	if _, ok := ctx.Params["port_rules"]; ok {
+		dp.PortRules = portRules
+	}
 
 	if err = db.DB.Update(&dp); err != nil {
 		ReturnError(ctx.W, err.Error(), true)
@@ -216,6 +241,21 @@ func (c *DiscoveryProfileController) Add(ctx *HTTPContext) {
 		monitored = true
 	}
 	title := strings.Trim(ctx.Params["title"], " ")
+	taskIntervals, err := models.ParseTaskIntervals(ctx.Params["task_intervals"])
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	chassisRules, err := models.ParseLldpRules(ctx.Params["chassis_rules"], models.DefaultChassisRules)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	portRules, err := models.ParseLldpRules(ctx.Params["port_rules"], models.DefaultPortRules)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
 
 	// check for same title
 	cnt, err := db.DB.Model(&models.DiscoveryProfile{}).Where(`title = ?`, title).Count()
@@ -234,6 +274,9 @@ func (c *DiscoveryProfileController) Add(ctx *HTTPContext) {
 		PeriodicInterval:perInt,
 		BoxInterval:boxInt,
 		Title:title,
+		TaskIntervals:taskIntervals,
+		ChassisRules:chassisRules,
+		PortRules:portRules,
 	}
 
 	if err = db.DB.Insert(&dp); err != nil {
@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"github.com/ircop/ohandler/models"
+)
+
+type DiscoveryRunsController struct {
+	HTTPController
+}
+
+// GET returns discovery runs of object, newest first
+func (c *DiscoveryRunsController) GET(ctx *HTTPContext) {
+	objectID, err := c.IntParam(ctx, "object_id")
+	if err != nil {
+		ReturnError(ctx.W, "Wrong object ID", true)
+		return
+	}
+	limit, offset := c.PageParams(ctx, 20)
+
+	runs, total, err := models.DiscoveryRunsByObject(objectID, limit, offset)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	result := make(map[string]interface{})
+	result["total"] = total
+	result["rows"] = runs
+	WriteJSON(ctx.W, result)
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"github.com/ircop/ohandler/streamer"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type DomainsController struct {
+	HTTPController
+}
+
+// domain name becomes part of NATS subjects, so keep it simple
+var reDomainName = regexp.MustCompile(`^[a-z0-9_\-]{1,64}$`)
+
+func (c *DomainsController) GET(ctx *HTTPContext) {
+	domains := make([]models.Domain, 0)
+	handler.Domains.Range(func(_, dInt interface{}) bool {
+		domains = append(domains, dInt.(models.Domain))
+		return true
+	})
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+
+	result := make(map[string]interface{})
+	result["domains"] = domains
+	result["default"] = streamer.DefaultDomain
+	WriteJSON(ctx.W, result)
+}
+
+// POST creates new domain and subscribes to it's subjects
+func (c *DomainsController) POST(ctx *HTTPContext) {
+	name := strings.ToLower(strings.Trim(ctx.Params["name"], " "))
+	if !reDomainName.MatchString(name) || name == streamer.DefaultDomain {
+		ReturnError(ctx.W, "Wrong domain name", true)
+		return
+	}
+
+	cnt, err := db.DB.Model(&models.Domain{}).Where(`name = ?`, name).Count()
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	if cnt > 0 {
+		ReturnError(ctx.W, fmt.Sprintf("Domain '%s' already exist", name), true)
+		return
+	}
+
+	d := models.Domain{Name:name}
+	if err = db.DB.Insert(&d); err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	handler.Domains.Store(d.ID, d)
+
+	logger.Rest("Adding domain '%s'", name)
+	if err = streamer.Nats.AddDomain(d); err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	returnOk(ctx.W)
+}
+
+func (c *DomainsController) DELETE(ctx *HTTPContext) {
+	id, err := c.IntParam(ctx, "id")
+	if err != nil {
+		ReturnError(ctx.W, "Wrong domain ID", true)
+		return
+	}
+
+	dInt, ok := handler.Domains.Load(id)
+	if !ok {
+		NotFound(ctx.W)
+		return
+	}
+	d := dInt.(models.Domain)
+
+	cnt, err := db.DB.Model(&models.Object{}).Where(`domain_id = ?`, id).Count()
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	if cnt > 0 {
+		ReturnError(ctx.W, fmt.Sprintf("Cannot delete: there is %d objects in this domain.", cnt), true)
+		return
+	}
+
+	if _, err = db.DB.Model(&models.Domain{}).Where(`id = ?`, id).Delete(); err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	logger.Rest("Deleting domain '%s'", d.Name)
+	if err = streamer.Nats.RemoveDomain(d); err != nil {
+		logger.RestErr("Failed to unsubscribe domain '%s': %s", d.Name, err.Error())
+	}
+	handler.Domains.Delete(id)
+
+	returnOk(ctx.W)
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"github.com/ircop/ohandler/models"
+	"net"
+)
+
+type FdbController struct {
+	HTTPController
+}
+
+// GET looks up MAC: returns it's edge ports (where MAC device is connected) and history of ports, where it was seen.
+// Without mac, returns page of active FDB of object_id (optionally of interface_id).
+func (c *FdbController) GET(ctx *HTTPContext) {
+	result := make(map[string]interface{})
+
+	if ctx.Params["mac"] != "" {
+		m, err := net.ParseMAC(ctx.Params["mac"])
+		if err != nil {
+			ReturnError(ctx.W, "Wrong mac address", true)
+			return
+		}
+		edge, err := models.FdbEdge(m.String())
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+		history, err := models.FdbHistory(m.String())
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+		objIDs := make([]int64, 0)
+		for _, e := range append(edge, history...) {
+			objIDs = append(objIDs, e.ObjectID)
+		}
+		names, err := objectNames(objIDs)
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+
+		result["edge"] = c.rows(edge, names)
+		result["history"] = c.rows(history, names)
+		WriteJSON(ctx.W, result)
+		return
+	}
+
+	objectID, err := c.IntParam(ctx, "object_id")
+	if err != nil {
+		ReturnError(ctx.W, "Wrong object ID", true)
+		return
+	}
+	var interfaceID int64
+	if _, ok := ctx.Params["interface_id"]; ok {
+		if interfaceID, err = c.IntParam(ctx, "interface_id"); err != nil {
+			ReturnError(ctx.W, "Wrong interface ID", true)
+			return
+		}
+	}
+	limit, offset := c.PageParams(ctx, 50)
+
+	list, total, err := models.FdbFind(objectID, interfaceID, limit, offset)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	result["total"] = total
+	result["rows"] = list
+	WriteJSON(ctx.W, result)
+}
+
+func (c *FdbController) rows(list []models.FdbEntry, names map[int64]string) []interface{} {
+	rows := make([]interface{}, 0, len(list))
+	for i := range list {
+		rows = append(rows, map[string]interface{}{
+			"entry":list[i],
+			"object_name":names[list[i].ObjectID],
+		})
+	}
+	return rows
+}
@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"github.com/ircop/ohandler/models"
+	"time"
+)
+
+type InterfacesController struct {
+	HTTPController
+}
+
+// GET returns filtered interfaces of all objects. Filters: object_id, type, admin_status, oper_status,
+// oper_days (oper status is not changed for given amount of days), speed, mtu, mac.
+// F.e. ports, that are down for 30 days: oper_status=down&oper_days=30
+func (c *InterfacesController) GET(ctx *HTTPContext) {
+	f := models.InterfaceFilter{
+		Type:ctx.Params["type"],
+		AdminStatus:ctx.Params["admin_status"],
+		OperStatus:ctx.Params["oper_status"],
+		Mac:ctx.Params["mac"],
+	}
+	ints := map[string]*int64{"object_id":&f.ObjectID, "speed":&f.Speed, "mtu":&f.Mtu}
+	for name, dst := range ints {
+		if ctx.Params[name] == "" {
+			continue
+		}
+		v, err := c.IntParam(ctx, name)
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+		*dst = v
+	}
+	if ctx.Params["oper_days"] != "" {
+		days, err := c.IntParam(ctx, "oper_days")
+		if err != nil || days < 0 {
+			ReturnError(ctx.W, "Wrong oper_days", true)
+			return
+		}
+		f.OperSince = time.Now().AddDate(0, 0, -int(days))
+	}
+	limit, offset := c.PageParams(ctx, 50)
+
+	rows, total, err := models.InterfacesFind(f, limit, offset)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	// object names of found interfaces
+	objIDs := make([]int64, 0)
+	for i := range rows {
+		objIDs = append(objIDs, rows[i].ObjectID)
+	}
+	names, err := objectNames(objIDs)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	items := make([]interface{}, 0, len(rows))
+	for i := range rows {
+		items = append(items, map[string]interface{}{
+			"interface":rows[i],
+			"object_name":names[rows[i].ObjectID],
+		})
+	}
+
+	result := make(map[string]interface{})
+	result["total"] = total
+	result["rows"] = items
+	WriteJSON(ctx.W, result)
+}
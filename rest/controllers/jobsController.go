@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/models"
+	"github.com/ircop/ohandler/tasks"
+	"strings"
+)
+
+type JobsController struct {
+	HTTPController
+}
+
+// params of ObjectsController.formatWhere, any of them makes filter job
+var jobFilterParams = []string{"segments", "models", "ipname", "dproblems", "alive"}
+
+// GET returns job with objects by id, or list of all jobs
+func (c *JobsController) GET(ctx *HTTPContext) {
+	result := make(map[string]interface{})
+
+	id := strings.Trim(ctx.Params["id"], " ")
+	if id == "" {
+		result["jobs"] = tasks.JobsList()
+		WriteJSON(ctx.W, result)
+		return
+	}
+
+	jInt, ok := tasks.Jobs.Load(id)
+	if !ok {
+		NotFound(ctx.W)
+		return
+	}
+	result["job"] = jInt.(*tasks.Job).Info(true)
+	WriteJSON(ctx.W, result)
+}
+
+// POST starts box discovery job for object_id, object_ids, segment_id or objects filter.
+// Optional 'tasks' limits requested task types ("config,lldp").
+// With 'dry_run' results are not applied: computed changesets are returned with job objects.
+func (c *JobsController) POST(ctx *HTTPContext) {
+	taskTypes, err := models.ParseTaskTypes(ctx.Params["tasks"])
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	objects := make([]models.Object, 0)
+	query := db.DB.Model(&objects)
+
+	if _, ok := ctx.Params["object_id"]; ok {
+		id, err := c.IntParam(ctx, "object_id")
+		if err != nil {
+			ReturnError(ctx.W, "Wrong object ID", true)
+			return
+		}
+		query.Where(`id = ?`, id)
+	} else if _, ok := ctx.Params["object_ids"]; ok {
+		ids := c.IdsParam(ctx, "object_ids")
+		if len(ids) == 0 {
+			ReturnError(ctx.W, "Wrong object IDs", true)
+			return
+		}
+		query.Where(`id IN (?)`, pg.In(ids))
+	} else if _, ok := ctx.Params["segment_id"]; ok {
+		segmentID, err := c.IntParam(ctx, "segment_id")
+		if err != nil {
+			ReturnError(ctx.W, "Wrong segment ID", true)
+			return
+		}
+		query.Join(`JOIN object_segments AS os ON os.object_id = object.id`).
+			Where(`os.segment_id = ?`, segmentID)
+	} else {
+		// filter should be set explicitly, job for all objects is never started by mistake
+		filtered := false
+		for _, p := range jobFilterParams {
+			if v := strings.Trim(ctx.Params[p], " "); v != "" && v != "[]" {
+				filtered = true
+			}
+		}
+		if !filtered {
+			ReturnError(ctx.W, "One of object_id, object_ids, segment_id or objects filter is required", true)
+			return
+		}
+		(&ObjectsController{}).formatWhere(ctx, query)
+	}
+
+	if err = query.Select(); err != nil && err != pg.ErrNoRows {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	if len(objects) == 0 {
+		ReturnError(ctx.W, "No objects found", true)
+		return
+	}
+
+	dryRun := ctx.Params["dry_run"] == "true"
+	job, err := tasks.StartJob(objects, taskTypes, dryRun)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	result := make(map[string]interface{})
+	result["job"] = job.Info(false)
+	WriteJSON(ctx.W, result)
+}
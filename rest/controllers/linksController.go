@@ -2,8 +2,10 @@ package controllers
 
 import (
 	"fmt"
+	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
 	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/logger"
 	"github.com/ircop/ohandler/models"
 	"strings"
 )
@@ -12,7 +14,46 @@ type LinksController struct {
 	HTTPController
 }
 
-// todo: log
+// GET returns LLDP adjacencies, conflicting with manual links, and port-channel links with their mismatches
+// (optionally of object_id)
+func (c *LinksController) GET(ctx *HTTPContext) {
+	var objectID int64
+	if _, ok := ctx.Params["object_id"]; ok {
+		var err error
+		if objectID, err = c.IntParam(ctx, "object_id"); err != nil {
+			ReturnError(ctx.W, "Wrong object ID", true)
+			return
+		}
+	}
+
+	conflicts, err := models.LinkConflicts(objectID)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	// port-channel links, grouped from member links
+	var links []models.Link
+	q := db.DB.Model(&links)
+	if objectID != 0 {
+		q.Where(`object1_id = ?`, objectID).WhereOr(`object2_id = ?`, objectID)
+	}
+	if err = q.Select(); err != nil && err != pg.ErrNoRows {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	lags, _, mismatches, err := models.LinksGroupLags(links)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	result := make(map[string]interface{})
+	result["conflicts"] = conflicts
+	result["lags"] = lags
+	result["lag_mismatches"] = mismatches
+	WriteJSON(ctx.W, result)
+}
 
 func (c *LinksController) DELETE(ctx *HTTPContext) {
 	id, err := c.IntParam(ctx, "id")
@@ -21,10 +62,29 @@ func (c *LinksController) DELETE(ctx *HTTPContext) {
 		return
 	}
 
-	if _, err = db.DB.Model(&models.Link{}).Where(`id = ?`, id).Delete(); err != nil {
+	l := models.Link{ID:id}
+	if err = db.DB.Model(&l).WherePK().Select(); err != nil {
+		if err == pg.ErrNoRows {
+			NotFound(ctx.W)
+			return
+		}
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	err = db.DB.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Delete(&l); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%d:%d - %d:%d", l.Object1ID, l.Int1ID, l.Object2ID, l.Int2ID)
+		return models.ChangeEventsInsert(tx, models.LinkChangeEvents(l, key, models.ActionDelete, &l, nil, ctx.Source()))
+	})
+	if err != nil {
 		ReturnError(ctx.W, err.Error(), true)
 		return
 	}
+	logger.Rest("Link %d:%d - %d:%d is removed", l.Object1ID, l.Int1ID, l.Object2ID, l.Int2ID)
+
 	returnOk(ctx.W)
 }
 
@@ -94,12 +154,20 @@ func (c *LinksController) POST(ctx *HTTPContext) {
 		Int1ID:pid,
 		Object2ID:roid,
 		Int2ID:rpid,
-		LinkType:"MANUAL",
+		LinkType:models.LinkTypeManual,
 	}
-	if err = db.DB.Insert(&l); err != nil {
+	err = db.DB.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Insert(&l); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s:%s - %s:%s", o1.Name, p1.Name, o2.Name, p2.Name)
+		return models.ChangeEventsInsert(tx, models.LinkChangeEvents(l, key, models.ActionAdd, nil, &l, ctx.Source()))
+	})
+	if err != nil {
 		ReturnError(ctx.W, err.Error(), true)
 		return
 	}
+	logger.Rest("Manual link %s:%s - %s:%s is added", o1.Name, p1.Name, o2.Name, p2.Name)
 
 	returnOk(ctx.W)
 }
\ No newline at end of file
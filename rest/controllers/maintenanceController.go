@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+type MaintenanceController struct {
+	HTTPController
+}
+
+// GET returns all maintenance windows with their current state
+func (c *MaintenanceController) GET(ctx *HTTPContext) {
+	windows := make([]models.Maintenance, 0)
+	handler.Maintenances.Range(func(_, mInt interface{}) bool {
+		windows = append(windows, mInt.(models.Maintenance))
+		return true
+	})
+	sort.Slice(windows, func(i, j int) bool { return windows[i].StartAt.Before(windows[j].StartAt) })
+
+	now := time.Now()
+	list := make([]interface{}, 0, len(windows))
+	for i := range windows {
+		item := make(map[string]interface{})
+		item["maintenance"] = windows[i]
+		item["active"] = windows[i].ActiveAt(now)
+		list = append(list, item)
+	}
+
+	result := make(map[string]interface{})
+	result["maintenances"] = list
+	WriteJSON(ctx.W, result)
+}
+
+// POST creates maintenance window
+func (c *MaintenanceController) POST(ctx *HTTPContext) {
+	var m models.Maintenance
+	if !c.fill(ctx, &m) {
+		return
+	}
+
+	if err := db.DB.Insert(&m); err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	if err := handler.StoreMaintenance(m); err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	logger.Rest("Adding maintenance #%d '%s'", m.ID, m.Title)
+
+	result := make(map[string]interface{})
+	result["maintenance"] = m
+	WriteJSON(ctx.W, result)
+}
+
+// PATCH updates maintenance window by id
+func (c *MaintenanceController) PATCH(ctx *HTTPContext) {
+	id, err := c.IntParam(ctx, "id")
+	if err != nil {
+		ReturnError(ctx.W, "Wrong maintenance ID", true)
+		return
+	}
+	mInt, ok := handler.Maintenances.Load(id)
+	if !ok {
+		NotFound(ctx.W)
+		return
+	}
+	m := mInt.(models.Maintenance)
+	if !c.fill(ctx, &m) {
+		return
+	}
+
+	if err = db.DB.Update(&m); err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	if err = handler.StoreMaintenance(m); err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	logger.Rest("Updating maintenance #%d '%s'", m.ID, m.Title)
+
+	returnOk(ctx.W)
+}
+
+func (c *MaintenanceController) DELETE(ctx *HTTPContext) {
+	id, err := c.IntParam(ctx, "id")
+	if err != nil {
+		ReturnError(ctx.W, "Wrong maintenance ID", true)
+		return
+	}
+	if _, ok := handler.Maintenances.Load(id); !ok {
+		NotFound(ctx.W)
+		return
+	}
+
+	if _, err = db.DB.Model(&models.Maintenance{}).Where(`id = ?`, id).Delete(); err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	handler.RemoveMaintenance(id)
+	logger.Rest("Deleting maintenance #%d", id)
+
+	returnOk(ctx.W)
+}
+
+// fill sets window fields from passed params and validates result. Returns false if error was returned.
+func (c *MaintenanceController) fill(ctx *HTTPContext, m *models.Maintenance) bool {
+	if title, ok := ctx.Params["title"]; ok {
+		m.Title = strings.Trim(title, " ")
+	}
+	if _, ok := ctx.Params["start"]; ok {
+		start, err := c.TimeParam(ctx, "start")
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return false
+		}
+		m.StartAt = start
+	}
+	if _, ok := ctx.Params["end"]; ok {
+		end, err := c.TimeParam(ctx, "end")
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return false
+		}
+		m.EndAt = end
+	}
+	if recurrence, ok := ctx.Params["recurrence"]; ok {
+		m.Recurrence = strings.ToLower(strings.Trim(recurrence, " "))
+	}
+	if u, ok := ctx.Params["until"]; ok {
+		m.Until = nil
+		if strings.Trim(u, " ") != "" {
+			until, err := c.TimeParam(ctx, "until")
+			if err != nil {
+				ReturnError(ctx.W, err.Error(), true)
+				return false
+			}
+			m.Until = &until
+		}
+	}
+	if _, ok := ctx.Params["object_ids"]; ok {
+		m.ObjectIDs = c.IdsParam(ctx, "object_ids")
+	}
+	if _, ok := ctx.Params["segment_ids"]; ok {
+		m.SegmentIDs = c.IdsParam(ctx, "segment_ids")
+	}
+
+	if err := m.Validate(); err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return false
+	}
+	return true
+}
@@ -47,10 +47,24 @@ func (c *MapController) GET(ctx *HTTPContext) {
 		o["label"] = objs[i].Name
 		oarr = append(oarr, o)
 	}
-	for i := range links {
+	// LAG is drawn as one edge
+	lags, singles, _, err := models.LinksGroupLags(links)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	for i := range lags {
+		l := make(map[string]interface{})
+		l["from"] = lags[i].Object1ID
+		l["to"] = lags[i].Object2ID
+		l["lag"] = true
+		l["members"] = len(lags[i].Members)
+		larr = append(larr, l)
+	}
+	for i := range singles {
 		l := make(map[string]interface{})
-		l["from"] = links[i].Object1ID
-		l["to"] = links[i].Object2ID
+		l["from"] = singles[i].Object1ID
+		l["to"] = singles[i].Object2ID
 		larr = append(larr, l)
 	}
 
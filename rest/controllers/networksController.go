@@ -106,5 +106,15 @@ func (c *NetworksController) GET(ctx *HTTPContext) {
 
 	result := make(map[string]interface{})
 	result["nets"] = nets
+
+	// hosts of network, known by ARP of it's ip interfaces
+	if pid > 0 {
+		hosts, err := models.ArpNetworkHosts(pid)
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+		result["hosts"] = hosts
+	}
 	WriteJSON(ctx.W, result)
 }
@@ -40,6 +40,9 @@ type objParams struct {
 	OsID	int64
 	AuthID	int64
 	DiscID	int64
+	DomainID	int64
+	// domain_id is passed: objects without it are not moved on update
+	DomainSet	bool
 
 	Trash	bool
 }
@@ -67,6 +70,12 @@ func (c *ObjectController) GetLinks(ctx *HTTPContext, obj models.Object) {
 		return
 	}
 
+	lags, _, mismatches, err := models.LinksGroupLags(links)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(),true)
+		return
+	}
+
 	objIDs := make([]int64,0)
 	intIDs := make([]int64,0)
 	objIdName := make(map[int64]string)
@@ -80,6 +89,10 @@ func (c *ObjectController) GetLinks(ctx *HTTPContext, obj models.Object) {
 			intIDs = append(intIDs, links[i].Int1ID)
 		}
 	}
+	// remote port-channels of LAGs
+	for i := range lags {
+		intIDs = append(intIDs, lags[i].Po1ID, lags[i].Po2ID)
+	}
 
 	// select objects and interfaces
 	var objects []models.Object
@@ -135,10 +148,33 @@ func (c *ObjectController) GetLinks(ctx *HTTPContext, obj models.Object) {
 				break
 			}
 		}
+
+		// port-channel is linked, if it's members are linked to the same remote port-channel
+		if ints[i].Type == dproto.InterfaceType_AGGREGATED.String() {
+			for n := range lags {
+				if lags[n].Po1ID == ints[i].ID {
+					item["remote_port"] = intIdName[lags[n].Po2ID]
+					item["remote_port_id"] = lags[n].Po2ID
+					item["remote_object"] = objIdName[lags[n].Object2ID]
+					item["remote_object_id"] = lags[n].Object2ID
+					item["lag_members"] = len(lags[n].Members)
+					break
+				}
+				if lags[n].Po2ID == ints[i].ID {
+					item["remote_port"] = intIdName[lags[n].Po1ID]
+					item["remote_port_id"] = lags[n].Po1ID
+					item["remote_object"] = objIdName[lags[n].Object1ID]
+					item["remote_object_id"] = lags[n].Object1ID
+					item["lag_members"] = len(lags[n].Members)
+					break
+				}
+			}
+		}
 		ifaces = append(ifaces, item)
 	}
 
 	result["ifaces"] = ifaces
+	result["lag_mismatches"] = mismatches
 
 	WriteJSON(ctx.W, result)
 }
@@ -251,6 +287,14 @@ func (c *ObjectController) GetInterfaces(ctx *HTTPContext, obj models.Object) {
 		item["name"] = iface.Name
 		item["shortname"] = iface.Shortname
 		item["description"] = iface.Description
+		item["admin_status"] = iface.AdminStatus
+		item["oper_status"] = iface.OperStatus
+		item["oper_changed_at"] = iface.OperChangedAt
+		item["speed"] = iface.Speed
+		item["duplex"] = iface.Duplex
+		item["mtu"] = iface.Mtu
+		item["mac"] = iface.Mac
+		item["if_index"] = iface.IfIndex
 		//logger.Debug("if: %s", iface.Name)
 		switch iface.Type {
 		case dproto.InterfaceType_PHISYCAL.String(), dproto.InterfaceType_AGGREGATED.String(), dproto.InterfaceType_MANAGEMENT.String():
@@ -272,6 +316,20 @@ func (c *ObjectController) GetInterfaces(ctx *HTTPContext, obj models.Object) {
 	WriteJSON(ctx.W, result)
 }
 
+// GetHistory returns page of object change events, newest first
+func (c *ObjectController) GetHistory(ctx *HTTPContext, obj models.Object) {
+	limit, offset := c.PageParams(ctx, 50)
+	events, total, err := models.ChangeEventsFind(models.ChangeEventFilter{ObjectID:obj.ID}, limit, offset)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	result := make(map[string]interface{})
+	result["total"] = total
+	result["history"] = events
+	WriteJSON(ctx.W, result)
+}
 
 func (c *ObjectController) GET(ctx *HTTPContext) {
 	id, err := c.IntParam(ctx, "id")
@@ -301,6 +359,9 @@ func (c *ObjectController) GET(ctx *HTTPContext) {
 	case "vlans":
 		c.GetVlans(ctx, obj)
 		return
+	case "history":
+		c.GetHistory(ctx, obj)
+		return
 	}
 
 	// Count interfaces
@@ -364,8 +425,9 @@ func (c *ObjectController) DELETE(ctx *HTTPContext) {
 		ReturnError(ctx.W, err.Error(), true)
 		return
 	}
+	journal(models.NewChangeEvent(dbo.ID, "object", dbo.ID, dbo.Name, models.ActionDelete, &dbo, nil, ctx.Source()))
 
-	mo.(*handler.ManagedObject).BoxTimer.Stop()
+	tasks.Sched.Remove(id)
 	handler.Objects.Delete(id)
 
 	streamer.UpdateObject(dbo, true)
@@ -397,6 +459,7 @@ func (c *ObjectController) PUT(ctx *HTTPContext) {
 	mo := moInt.(*handler.ManagedObject)
 
 	o := mo.DbObject
+	old := o
 	params, err := c.checkFields(ctx)
 	if err != nil {
 		ReturnError(ctx.W, err.Error(), true)
@@ -433,18 +496,26 @@ func (c *ObjectController) PUT(ctx *HTTPContext) {
 	if o.DiscoveryID != params.DiscID {
 		sendUpdate = true
 	}
+	// object moves to another domain: old domain pollers should forget it
+	if !params.DomainSet {
+		params.DomainID = o.DomainID
+	}
+	oldDomain := o
+	domainChanged := o.DomainID != params.DomainID
 
 	o.Name = params.Name
 	o.Mgmt = params.Mgmt
 	o.AuthID = params.AuthID
 	o.ProfileID = int32(params.OsID)
 	o.DiscoveryID = params.DiscID
+	o.DomainID = params.DomainID
 	o.ForeignID = foreign
 
 	if err = db.DB.Update(&o); err != nil {
 		ReturnError(ctx.W, err.Error(), true)
 		return
 	}
+	journal(models.NewChangeEvent(o.ID, "object", o.ID, o.Name, models.ActionUpdate, &old, &o, ctx.Source()))
 
 	// 1) Update DBO in memory
 	// 2) re-schedule
@@ -454,7 +525,13 @@ func (c *ObjectController) PUT(ctx *HTTPContext) {
 
 	tasks.SheduleBox(mo, false)
 
-	if sendUpdate {
+	if domainChanged {
+		logger.Debug("Moving %s to domain '%s'", o.Name, streamer.DomainName(o.DomainID))
+		go func() {
+			streamer.UpdateObject(oldDomain, true)
+			streamer.UpdateObject(o, false)
+		}()
+	} else if sendUpdate {
 		logger.Debug("Sending update about %s", o.Name)
 		go streamer.UpdateObject(o, false)
 	}
@@ -508,6 +585,7 @@ func (c *ObjectController) updateSegments(ctx *HTTPContext, dbo models.Object) e
 	//logger.Debug("OLD SEGS: %+v", oldSegs)
 
 	// remove old and add new segments
+	changed := false
 	for i := range newSegs {
 		//logger.Debug(" -- new seg: %d", newSegs[i])
 		found := false
@@ -524,6 +602,7 @@ func (c *ObjectController) updateSegments(ctx *HTTPContext, dbo models.Object) e
 			if err := db.DB.Insert(&s); err != nil {
 				return err
 			}
+			changed = true
 		}
 	}
 
@@ -540,9 +619,15 @@ func (c *ObjectController) updateSegments(ctx *HTTPContext, dbo models.Object) e
 			if _, err := db.DB.Model(&models.ObjectSegment{}).Where(`id = ?`, oldSegs[i].ID).Delete(); err != nil {
 				return err
 			}
+			changed = true
 		}
 	}
 
+	// segment-scoped maintenance windows should cover new members
+	if changed {
+		handler.ReloadMaintenanceSegments()
+	}
+
 	return nil
 }
 
@@ -569,32 +654,37 @@ func (c *ObjectController) PATCH(ctx *HTTPContext) {
 
 // ADD
 func (c *ObjectController) POST(ctx *HTTPContext) {
-	params, err := c.checkFields(ctx)
-	if err != nil {
+	if _, err := c.addObject(ctx); err != nil {
 		ReturnError(ctx.W, err.Error(), true)
 		return
 	}
 
+	returnOk(ctx.W)
+}
+
+// addObject creates object from request parameters, schedules it's discovery and sends it to pollers
+func (c *ObjectController) addObject(ctx *HTTPContext) (*models.Object, error) {
+	params, err := c.checkFields(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check uniq name, mgmt
 	cnt, err := db.DB.Model(&models.Object{}).Where(`name = ?`, params.Name).Count()
 	if err != nil {
-		ReturnError(ctx.W, err.Error(), true)
-		return
+		return nil, err
 	}
 	if cnt > 0 {
-		ReturnError(ctx.W, "This name is already taken", true)
-		return
+		return nil, fmt.Errorf("This name is already taken")
 	}
 
 	if !params.Trash {
 		cnt, err = db.DB.Model(&models.Object{}).Where(`mgmt = ?`, params.Mgmt).Count()
 		if err != nil {
-			ReturnError(ctx.W, err.Error(), true)
-			return
+			return nil, err
 		}
 		if cnt > 0 {
-			ReturnError(ctx.W, "This mgmt addr is already taken", true)
-			return
+			return nil, fmt.Errorf("This mgmt addr is already taken")
 		}
 	}
 
@@ -610,24 +700,24 @@ func (c *ObjectController) POST(ctx *HTTPContext) {
 		AuthID:params.AuthID,
 		DiscoveryID:params.DiscID,
 		ProfileID:int32(params.OsID),
+		DomainID:params.DomainID,
 		ForeignID:foreign,
 	}
 
 	if err := db.DB.Insert(&o); err != nil {
-		ReturnError(ctx.W, err.Error(), true)
-		return
+		return nil, err
 	}
+	journal(models.NewChangeEvent(o.ID, "object", o.ID, o.Name, models.ActionAdd, nil, &o, ctx.Source()))
 
+	// DB watch may store it first: then box is sheduled and pollers are updated already
 	mo := handler.ManagedObject{DbObject:o}
-	handler.Objects.Store(o.ID, &mo)
-
-	tasks.SheduleBox(&mo, true)
+	if _, loaded := handler.Objects.LoadOrStore(o.ID, &mo); !loaded {
+		tasks.SheduleBox(&mo, true)
+		go streamer.UpdateObject(o, false)
+	}
 	c.updateSegments(ctx, o)
 
-
-	go streamer.UpdateObject(o, false)
-
-	returnOk(ctx.W)
+	return &o, nil
 }
 
 func (c *ObjectController) checkFields(ctx *HTTPContext) (objParams, error) {
@@ -709,6 +799,21 @@ func (c *ObjectController) checkFields(ctx *HTTPContext) (objParams, error) {
 		return params, fmt.Errorf("Wrong discovery profile ID")
 	}
 
+	// domain is optional: objects without it belong to default domain
+	if _, ok := ctx.Params["domain_id"]; ok {
+		params.DomainSet = true
+		if ctx.Params["domain_id"] != "" {
+			domainID, err := c.IntParam(ctx, "domain_id")
+			if err != nil || domainID < 0 {
+				return params, fmt.Errorf("Wrong domain ID")
+			}
+			if _, ok := handler.Domains.Load(domainID); !ok && domainID > 0 {
+				return params, fmt.Errorf("Wrong domain ID")
+			}
+			params.DomainID = domainID
+		}
+	}
+
 	params.Name = name
 	//params.Mgmt = ip.String()
 	params.OsID = profileID
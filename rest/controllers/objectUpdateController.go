@@ -41,12 +41,14 @@ func (c *ObjectUpdateController) POST(ctx *HTTPContext) {
 			ReturnError(ctx.W, "Wrong foreign ID", true)
 			return
 		}
+		old := o
 		o.ForeignID.Valid = true
 		o.ForeignID.Int64 = fid
 		if err = db.DB.Update(&o); err != nil {
 			ReturnError(ctx.W, err.Error(), true)
 			return
 		}
+		journal(models.NewChangeEvent(o.ID, "object", o.ID, "foreign_id", models.ActionUpdate, old.ForeignID.Int64, fid, ctx.Source()))
 	}
 
 	returnOk(ctx.W)
@@ -12,11 +12,15 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ObjectsController struct {
 	HTTPController
 }
+
+// objects without successful discovery for this amount of days are stale, if stale_days is not set
+const defaultStaleDays int64 = 7
 /*
 type webObj struct {
 	ID			int64		`json:"id"`
@@ -142,6 +146,23 @@ func (c *ObjectsController) formatWhere(ctx *HTTPContext, query *orm.Query) {
 				query.Join(`LEFT JOIN interfaces ifs ON ifs.object_id = object.id`).
 					Where(`ifs.id IS NULL`)
 				break
+			case models.ProblemAuthFailure:
+				query.Where(`(SELECT outcome FROM discovery_runs dr WHERE dr.object_id = object.id ORDER BY started_at DESC LIMIT 1) = ?`, models.RunAuthFailure)
+				break
+			case models.ProblemTimeout:
+				query.Where(`(SELECT outcome FROM discovery_runs dr WHERE dr.object_id = object.id ORDER BY started_at DESC LIMIT 1) = ?`, models.RunTimeout)
+				break
+			case models.ProblemStaleDiscovery:
+				days := defaultStaleDays
+				if d, err := strconv.ParseInt(ctx.Params["stale_days"], 10, 64); err == nil && d > 0 {
+					days = d
+				}
+				query.Where(`NOT EXISTS (SELECT 1 FROM discovery_runs dr WHERE dr.object_id = object.id AND dr.outcome IN (?, ?) AND dr.started_at > ?)`,
+					models.RunSuccess, models.RunPartial, time.Now().Add(-time.Duration(days) * time.Hour * 24))
+				break
+			case models.ProblemLinkConflict:
+				query.Where(`EXISTS (SELECT 1 FROM link_conflicts lc WHERE lc.object_id = object.id)`)
+				break
 			}
 		}
 	}
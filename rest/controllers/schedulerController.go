@@ -0,0 +1,15 @@
+package controllers
+
+import "github.com/ircop/ohandler/tasks"
+
+type SchedulerController struct {
+	HTTPController
+}
+
+// GET returns box discovery queue depth, lag and in-flight discoveries
+func (c *SchedulerController) GET(ctx *HTTPContext) {
+	result := make(map[string]interface{})
+	result["scheduler"] = tasks.Sched.Stats()
+
+	WriteJSON(ctx.W, result)
+}
@@ -0,0 +1,19 @@
+package controllers
+
+import (
+	"github.com/ircop/ohandler/cluster"
+	"github.com/ircop/ohandler/streamer"
+)
+
+type StatusController struct {
+	HTTPController
+}
+
+// GET returns state of message bus connection and cluster role of this instance
+func (c *StatusController) GET(ctx *HTTPContext) {
+	result := make(map[string]interface{})
+	result["bus"] = streamer.Nats.Status()
+	result["cluster"] = cluster.Node.Status()
+
+	WriteJSON(ctx.W, result)
+}
@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"net"
+	"strings"
+)
+
+type UnresolvedNeighborsController struct {
+	HTTPController
+}
+
+// GET returns unresolved neighbor with suggested params of it's object by id, or list of unresolved neighbors
+// (optionally of segment_id or object_id)
+func (c *UnresolvedNeighborsController) GET(ctx *HTTPContext) {
+	result := make(map[string]interface{})
+
+	if _, ok := ctx.Params["id"]; ok {
+		n, suggested, err := c.suggest(ctx)
+		if err != nil {
+			ReturnError(ctx.W, err.Error(), true)
+			return
+		}
+		if n == nil {
+			NotFound(ctx.W)
+			return
+		}
+		result["neighbor"] = n
+		result["suggested"] = suggested
+		WriteJSON(ctx.W, result)
+		return
+	}
+
+	var segmentID, objectID int64
+	var err error
+	if _, ok := ctx.Params["segment_id"]; ok {
+		if segmentID, err = c.IntParam(ctx, "segment_id"); err != nil {
+			ReturnError(ctx.W, "Wrong segment ID", true)
+			return
+		}
+	}
+	if _, ok := ctx.Params["object_id"]; ok {
+		if objectID, err = c.IntParam(ctx, "object_id"); err != nil {
+			ReturnError(ctx.W, "Wrong object ID", true)
+			return
+		}
+	}
+	limit, offset := c.PageParams(ctx, 50)
+
+	list, total, err := models.UnresolvedNeighborsFind(segmentID, objectID, limit, offset)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	// names of local objects
+	objIDs := make([]int64, 0)
+	for i := range list {
+		objIDs = append(objIDs, list[i].ObjectID)
+	}
+	names, err := objectNames(objIDs)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+
+	rows := make([]interface{}, 0, len(list))
+	for i := range list {
+		rows = append(rows, map[string]interface{}{
+			"neighbor":list[i],
+			"object_name":names[list[i].ObjectID],
+		})
+	}
+
+	result["total"] = total
+	result["rows"] = rows
+	WriteJSON(ctx.W, result)
+}
+
+// POST creates object from unresolved neighbor by id. Object params, that are not passed, are taken from suggested ones.
+// Neighbors, whose chassis is in inventory already, are rejected.
+func (c *UnresolvedNeighborsController) POST(ctx *HTTPContext) {
+	n, suggested, err := c.suggest(ctx)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	if n == nil {
+		NotFound(ctx.W)
+		return
+	}
+	for k, v := range suggested {
+		if _, ok := ctx.Params[k]; !ok {
+			ctx.Params[k] = v
+		}
+	}
+
+	oc := ObjectController{}
+	o, err := oc.addObject(ctx)
+	if err != nil {
+		ReturnError(ctx.W, err.Error(), true)
+		return
+	}
+	logger.Rest("Object %s is created from unresolved neighbor '%s'", o.Name, n.ChassisID)
+
+	// neighbor is resolved by the next discovery of it's neighbors
+	if err = models.UnresolvedNeighborsRemove(n.ChassisID); err != nil {
+		logger.RestErr("Cannot remove unresolved neighbor '%s': %s", n.ChassisID, err.Error())
+	}
+
+	result := make(map[string]interface{})
+	result["object_id"] = o.ID
+	WriteJSON(ctx.W, result)
+}
+
+// suggest returns unresolved neighbor by id and params of object to create from it: profiles, domain and segments
+// are the same as of local object; name and mgmt are taken from chassis ID, if it's hostname or ip address.
+func (c *UnresolvedNeighborsController) suggest(ctx *HTTPContext) (*models.UnresolvedNeighbor, map[string]string, error) {
+	id, err := c.IntParam(ctx, "id")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Wrong neighbor ID")
+	}
+	n, err := models.UnresolvedNeighborByID(id)
+	if err != nil || n == nil {
+		return nil, nil, err
+	}
+	// chassis is in inventory, only port is not found: object would be duplicated
+	if n.NeighborID != 0 {
+		return nil, nil, fmt.Errorf("Neighbor is object #%d already, only it's port '%s' is not found", n.NeighborID, n.PortID)
+	}
+
+	var local models.Object
+	if err = db.DB.Model(&local).Where(`id = ?`, n.ObjectID).Select(); err != nil {
+		return nil, nil, err
+	}
+	var segs []models.ObjectSegment
+	if err = db.DB.Model(&segs).Where(`object_id = ?`, local.ID).Select(); err != nil && err != pg.ErrNoRows {
+		return nil, nil, err
+	}
+	segIDs := make([]string, 0, len(segs))
+	for i := range segs {
+		segIDs = append(segIDs, fmt.Sprintf("%d", segs[i].SegmentID))
+	}
+
+	suggested := map[string]string{
+		"profile_id":fmt.Sprintf("%d", local.ProfileID),
+		"auth_id":fmt.Sprintf("%d", local.AuthID),
+		"discovery_id":fmt.Sprintf("%d", local.DiscoveryID),
+		"domain_id":fmt.Sprintf("%d", local.DomainID),
+		"segments":strings.Join(segIDs, ","),
+	}
+	if ip := net.ParseIP(n.ChassisID); ip != nil {
+		suggested["mgmt"] = ip.String()
+	} else if !isMac(n.ChassisID) {
+		suggested["name"] = strings.SplitN(n.ChassisID, ".", 2)[0]
+	}
+
+	return n, suggested, nil
+}
+
+// isMac returns true for any mac format, including huawei one (xxxx-xxxx-xxxx)
+func isMac(s string) bool {
+	if _, err := net.ParseMAC(s); err == nil {
+		return true
+	}
+	_, err := net.ParseMAC(strings.Replace(s, "-", ".", -1))
+	return err == nil
+}
@@ -1,6 +1,7 @@
 package rest
 
 import (
+	"context"
 	"fmt"
 	"github.com/ircop/ohandler/cfg"
 	"github.com/ircop/ohandler/logger"
@@ -16,6 +17,7 @@ type Rest struct {
 	cert		string
 	key			string
 	config		*cfg.Cfg
+	server		*http.Server
 //	dashTemplates	string
 }
 
@@ -28,10 +30,12 @@ func New(cfg *cfg.Cfg) *Rest {
 		listenPort:cfg.RestPort,
 		config:cfg,
 	}
+	r.server = &http.Server{Handler:r.getRouter()}
 
 	return &r
 }
 
+// Listen serves REST until Shutdown is called
 func (r *Rest) Listen() {
 	listener, err := net.Listen("tcp4", fmt.Sprintf("%s:%d", r.listenIP, r.listenPort))
 	if err != nil {
@@ -39,10 +43,17 @@ func (r *Rest) Listen() {
 		log.Fatal(err.Error())
 	}
 
-	router := r.getRouter()
 	if r.ssl {
-		log.Fatal(http.ServeTLS(listener, router, r.cert, r.key))
+		err = r.server.ServeTLS(listener, r.cert, r.key)
 	} else {
-		log.Fatal(http.Serve(listener, router))
+		err = r.server.Serve(listener)
 	}
-}
\ No newline at end of file
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// Shutdown stops accepting new requests and waits for active ones until ctx is done
+func (r *Rest) Shutdown(ctx context.Context) error {
+	return r.server.Shutdown(ctx)
+}
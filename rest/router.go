@@ -33,6 +33,19 @@ func (r *Rest) getRouter() *mux.Router {
 	router.HandleFunc("/keys", r.obs(&controllers.ApiKeysController{}))
 	router.HandleFunc("/models", r.obs(&controllers.ModelsController{}))
 	router.HandleFunc("/discovery-problems", r.obs(&controllers.DiscoveryProblemsController{}))
+	router.HandleFunc("/availability", r.obs(&controllers.AvailabilityController{}))
+	router.HandleFunc("/domains", r.obs(&controllers.DomainsController{}))
+	router.HandleFunc("/status", r.obs(&controllers.StatusController{}))
+	router.HandleFunc("/jobs", r.obs(&controllers.JobsController{}))
+	router.HandleFunc("/discovery-runs", r.obs(&controllers.DiscoveryRunsController{}))
+	router.HandleFunc("/scheduler", r.obs(&controllers.SchedulerController{}))
+	router.HandleFunc("/maintenance", r.obs(&controllers.MaintenanceController{}))
+	router.HandleFunc("/changesets", r.obs(&controllers.ChangesetsController{}))
+	router.HandleFunc("/changes", r.obs(&controllers.ChangesController{}))
+	router.HandleFunc("/interfaces", r.obs(&controllers.InterfacesController{}))
+	router.HandleFunc("/unresolved-neighbors", r.obs(&controllers.UnresolvedNeighborsController{}))
+	router.HandleFunc("/fdb", r.obs(&controllers.FdbController{}))
+	router.HandleFunc("/arp", r.obs(&controllers.ArpController{}))
 
 	router.HandleFunc("/dash/port", r.obs(&dash.PortController{}))
 	router.HandleFunc("/dash/object", r.obs(&dash.ObjectController{}))
@@ -0,0 +1,9 @@
+// +build dprotonext
+
+package streamer
+
+import "github.com/ircop/dproto"
+
+func setBoxTasks(message *dproto.BoxRequest, tasks []dproto.TaskType) {
+	message.Tasks = tasks
+}
@@ -0,0 +1,10 @@
+// +build !dprotonext
+
+package streamer
+
+import "github.com/ircop/dproto"
+
+// Released dproto has no BoxRequest.Tasks yet: box runs all tasks, and sections of not requested ones
+// are not compared.
+func setBoxTasks(message *dproto.BoxRequest, tasks []dproto.TaskType) {
+}
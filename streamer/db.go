@@ -6,19 +6,22 @@ import (
 	"github.com/golang/protobuf/ptypes/any"
 	"github.com/google/uuid"
 	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/bus"
 	"github.com/ircop/ohandler/db"
 	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/logger"
 	"github.com/ircop/ohandler/models"
-	nats "github.com/nats-io/go-nats-streaming"
 	"time"
 )
 
-func (n *NatsClient) dbPacket(msg *nats.Msg, dbChan string) {
+// interfaces are selected for this amount of objects at once
+const interfacesBatch = 1000
+
+func (n *NatsClient) dbPacket(msg bus.Msg, domainID int64) {
 	defer msg.Ack()
 
 	var packet dproto.DPacket
-	err := proto.Unmarshal(msg.Data, &packet)
+	err := proto.Unmarshal(msg.Data(), &packet)
 	if err != nil {
 		logger.Err("Failed to parse dproto packet: %s", err.Error())
 		return
@@ -26,20 +29,25 @@ func (n *NatsClient) dbPacket(msg *nats.Msg, dbChan string) {
 
 	// got and parsed DB packet.
 	if packet.PacketType == dproto.PacketType_DB_REQUEST {
-		logger.Debug("Got DBD Sync request")
-		n.DbSync(dbChan)
+		since, err := dbRequestSince(packet.Payload)
+		if err != nil {
+			logger.Err("Failed to unmarshal DB request: %s", err.Error())
+		}
+
+		if since > 0 {
+			logger.Debug("Got DB changes request for domain '%s' since %d", DomainName(domainID), since)
+			n.DbChanges(domainID, since)
+			return
+		}
+
+		logger.Debug("Got DBD Sync request for domain '%s'", DomainName(domainID))
+		n.DbSync(domainID)
 		return
 	}
 }
 
-func sendUpdate(objects []*dproto.DBObject) {
-	if len(objects) < 1 {
-		return
-	}
-	update := dproto.DBUpdate{
-		Objects:objects,
-	}
-	bts, err := proto.Marshal(&update)
+func sendUpdate(domainID int64, seq int64, objects []*dproto.DBObject) {
+	bts, err := proto.Marshal(newDBUpdate(objects, seq))
 	if err != nil {
 		logger.Err("Failed to marshal DB update: %s", err.Error())
 		return
@@ -57,27 +65,56 @@ func sendUpdate(objects []*dproto.DBObject) {
 		return
 	}
 
-	SendLock.Lock()
-	defer SendLock.Unlock()
-	_, err = Nats.Conn.PublishAsync(Nats.DbChan, packetBts, func(g string, e error) {
-		if e != nil {
-			logger.Err("Error recieving NATS DBUpdate ACK: %s", e.Error())
-		}
-	})
-	if err != nil {
+	if err = Nats.Publish(Nats.DbSubject(domainID), packetBts); err != nil {
 		logger.Err("Failed to send NATS DBUpdate: %s", err.Error())
 	}
 }
 
-// Update banch of objects by ids.
-// Separate this function for calling as gorouting
-func UpdateObjects(objects []models.Object, removed bool) {
-	dprofiles, aprofiles := handler.GetProfiles()
+// loadPollInterfaces selects interfaces of given objects in batches and returns them by object id
+func loadPollInterfaces(ids []int64) (map[int64][]*dproto.PollInterface, error) {
+	result := make(map[int64][]*dproto.PollInterface, len(ids))
+
+	for start := 0; start < len(ids); start += interfacesBatch {
+		end := start + interfacesBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		ifs := make([]models.Interface, 0)
+		if err := db.DB.Model(&ifs).Where(`object_id IN (?)`, pg.In(ids[start:end])).Select(); err != nil && err != pg.ErrNoRows {
+			return result, err
+		}
+		for i := range ifs {
+			result[ifs[i].ObjectID] = append(result[ifs[i].ObjectID], &dproto.PollInterface{
+				ID:ifs[i].ID,
+				Name:ifs[i].Name,
+				Shortname:ifs[i].Shortname,
+			})
+		}
+	}
+
+	return result, nil
+}
 
+// buildDBObjects converts objects into dproto objects, with their interfaces.
+// Removed objects are sent without interfaces.
+func buildDBObjects(objects []models.Object, removed bool) []*dproto.DBObject {
+	dprofiles, aprofiles := handler.GetProfiles()
+	result := make([]*dproto.DBObject, 0, len(objects))
 
-	DBObjects := make([]*dproto.DBObject, 0)
+	ids := make([]int64, 0, len(objects))
 	for i := range objects {
+		ids = append(ids, objects[i].ID)
+	}
+	interfaces := make(map[int64][]*dproto.PollInterface)
+	if !removed {
+		var err error
+		if interfaces, err = loadPollInterfaces(ids); err != nil {
+			logger.Err("Cannot select objects interfaces: %s", err.Error())
+		}
+	}
 
+	for i := range objects {
 		dbo := objects[i]
 		ap, ok := aprofiles[dbo.AuthID]
 		if !ok {
@@ -86,12 +123,15 @@ func UpdateObjects(objects []models.Object, removed bool) {
 		}
 		dp, ok := dprofiles[dbo.DiscoveryID]
 		if !ok {
-			logger.Err("Failed to find discovery profile for %s (%d)", dbo.Name, dbo.AuthID)
+			logger.Err("Failed to find discovery profile for %s (%d)", dbo.Name, dbo.DiscoveryID)
 			continue
 		}
 
-		interfaces := make([]*dproto.PollInterface, 0)
-		o := dproto.DBObject{
+		ifs := interfaces[dbo.ID]
+		if ifs == nil {
+			ifs = make([]*dproto.PollInterface, 0)
+		}
+		result = append(result, &dproto.DBObject{
 			Addr:dbo.Mgmt,
 			ID:dbo.ID,
 			PingInterval:dp.PingInterval,
@@ -99,27 +139,32 @@ func UpdateObjects(objects []models.Object, removed bool) {
 			RoCommunity:ap.RoCommunity,
 			Alive:dbo.Alive,
 			Removed:removed,
-			Interfaces:interfaces,
-		}
+			Interfaces:ifs,
+		})
+	}
 
-		ifs := make([]models.Interface, 0)
-		if err := db.DB.Model(&ifs).Where(`object_id = ?`, dbo.ID).Select(); err != nil && err != pg.ErrNoRows {
-			logger.Err("Cannot select object interfaces: ")
-		} else {
-			for i := range ifs {
-				iface := dproto.PollInterface{
-					ID:ifs[i].ID,
-					Name:ifs[i].Name,
-					Shortname:ifs[i].Shortname,
-				}
-				interfaces = append(interfaces, &iface)
-			}
-			o.Interfaces = interfaces
-		}
-		DBObjects = append(DBObjects, &o)
+	return result
+}
+
+// Update banch of objects by ids.
+// Separate this function for calling as gorouting
+func UpdateObjects(objects []models.Object, removed bool) {
+	// objects are sent to pollers of their own domain only
+	byDomain := make(map[int64][]models.Object)
+	for i := range objects {
+		byDomain[objects[i].DomainID] = append(byDomain[objects[i].DomainID], objects[i])
 	}
 
-	sendUpdate(DBObjects)
+	for domainID := range byDomain {
+		seq, err := models.DbChangesAdd(byDomain[domainID], removed)
+		if err != nil {
+			// update without sequence number would be lost by incremental sync: pollers get snapshot instead
+			logger.Err("Failed to store db changes: %s", err.Error())
+			Nats.DbSync(domainID)
+			continue
+		}
+		sendUpdate(domainID, seq, buildDBObjects(byDomain[domainID], removed))
+	}
 }
 
 // Send update event when:
@@ -128,123 +173,110 @@ func UpdateObjects(objects []models.Object, removed bool) {
 // - changed alive?
 func UpdateObject(dbo models.Object, removed bool) {
 	logger.Debug("Broadcasting object #%d (%s) update", dbo.ID, dbo.Name)
+	UpdateObjects([]models.Object{dbo}, removed)
+}
 
-	dpInt, ok := handler.DiscoveryProfiles.Load(dbo.DiscoveryID)
-	if !ok {
-		logger.Err("UpdateObject: failed to find discovery profile for %s (%d)", dbo.Name, dbo.DiscoveryID)
+// DbSyncAll runs full db sync for default and all known domains
+func (n *NatsClient) DbSyncAll() {
+	if !n.IsLeading() {
 		return
 	}
-	apInt, ok := handler.AuthProfiles.Load(dbo.AuthID)
-	if !ok {
-		logger.Err("UpdateObject: failed to find auth profile for %s (%d)", dbo.Name, dbo.AuthID)
+	n.DbSync(0)
+	handler.Domains.Range(func(id, _ interface{}) bool {
+		n.DbSync(id.(int64))
+		return true
+	})
+}
+
+// DbChanges sends objects changed after given sequence number.
+// If poller is too far behind (or changes were already pruned), it gets full snapshot instead.
+func (n *NatsClient) DbChanges(domainID int64, since int64) {
+	first, last, err := models.DbChangesRange()
+	if err != nil {
+		logger.Err("Cannot select db changes range: %s", err.Error())
+		n.DbSync(domainID)
 		return
 	}
-	dp := dpInt.(models.DiscoveryProfile)
-	ap := apInt.(models.AuthProfile)
-
-	interfaces := make([]*dproto.PollInterface, 0)
-	o := dproto.DBObject{
-		Addr:dbo.Mgmt,
-		ID:dbo.ID,
-		PingInterval:dp.PingInterval,
-		PollInterval:dp.PeriodicInterval,
-		RoCommunity:ap.RoCommunity,
-		Alive:dbo.Alive,
-		Removed:removed,
-		Interfaces:interfaces,
+	if since < first-1 || last-since > int64(n.config.DbSyncMaxChanges) {
+		logger.Debug("Domain '%s': %d is too old (changes %d..%d), sending snapshot", DomainName(domainID), since, first, last)
+		n.DbSync(domainID)
+		return
 	}
-	logger.Debug("SENDING DBO: %+#v", o)
-	// get object interfaces
-	ifs := make([]models.Interface, 0)
-	if err := db.DB.Model(&ifs).Where(`object_id = ?`, dbo.ID).Select(); err != nil && err != pg.ErrNoRows {
-		logger.Err("Cannot select object interfaces: ")
-	} else {
-		for i := range ifs {
-			iface := dproto.PollInterface{
-				ID:ifs[i].ID,
-				Name:ifs[i].Name,
-				Shortname:ifs[i].Shortname,
-			}
-			interfaces = append(interfaces, &iface)
+
+	changes, err := models.DbChangesSince(domainID, since)
+	if err != nil {
+		logger.Err("Cannot select db changes: %s", err.Error())
+		n.DbSync(domainID)
+		return
+	}
+
+	// changes are applied by last state of object: removed, or current in-memory one
+	current := make([]models.Object, 0)
+	removed := make([]models.Object, 0)
+	for i := range changes {
+		moInt, ok := handler.Objects.Load(changes[i].ObjectID)
+		if changes[i].Removed || !ok {
+			removed = append(removed, models.Object{ID:changes[i].ObjectID})
+			continue
 		}
-		o.Interfaces = interfaces
+		mo := moInt.(*handler.ManagedObject)
+		mo.MX.Lock()
+		current = append(current, mo.DbObject)
+		mo.MX.Unlock()
+	}
+
+	objects := buildDBObjects(current, false)
+	for i := range removed {
+		objects = append(objects, &dproto.DBObject{ID:removed[i].ID, Removed:true, Interfaces:make([]*dproto.PollInterface, 0)})
 	}
 
-	sendUpdate([]*dproto.DBObject{&o})
+	// empty update is sent too: poller should know it is up to date
+	sendUpdate(domainID, last, objects)
 }
 
-func (n *NatsClient) DbSync(dbChan string) {
+// DbSync sends all objects of given domain to it's db subject
+func (n *NatsClient) DbSync(domainID int64) {
+	if !n.IsLeading() {
+		return
+	}
 	defer func() {
-		// after end of sync, shedule next sync in 15 minutes.
-		// todo: configure sync interval
-		if n.SyncTimer != nil {
-			n.SyncTimer.Stop()
-			n.SyncTimer = nil
+		// after end of sync, shedule next one
+		if _, ok := handler.Domains.Load(domainID); !ok && domainID != 0 {
+			// domain was removed
+			return
+		}
+		n.MX.Lock()
+		if t, ok := n.syncTimers[domainID]; ok {
+			t.Stop()
 		}
-		n.SyncTimer = time.AfterFunc(time.Minute * 15, func(){
-			n.DbSync(dbChan)
+		n.syncTimers[domainID] = time.AfterFunc(n.config.DbSyncInterval, func(){
+			n.DbSync(domainID)
 		})
+		n.MX.Unlock()
+
+		if err := models.DbChangesPrune(n.config.DbSyncRetention); err != nil {
+			logger.Err("Failed to prune old db changes: %s", err.Error())
+		}
 	}()
 
-	// send all objects to channel.
-	//dprofiles := make(map[int64]models.DiscoveryProfile, 0)
-	dbObjects := make([]*dproto.DBObject, 0)
-	// store dprofiles into map
-	//handler.DiscoveryProfiles.Range(func(key, dpInt interface{}) bool {
-	//	dp := dpInt.(models.DiscoveryProfile)
-	//	dprofiles[dp.ID] = dp
-	//	return true
-	//})
-	dprofiles, aprofiles := handler.GetProfiles()
+	// sequence is taken before objects, so pollers can't miss changes made during snapshot
+	_, seq, err := models.DbChangesRange()
+	if err != nil {
+		logger.Err("Cannot select db changes range: %s", err.Error())
+	}
 
+	objects := make([]models.Object, 0)
 	handler.Objects.Range(func(k, oInt interface{}) bool {
 		mo := oInt.(*handler.ManagedObject)
 		mo.MX.Lock()
 		dbo := mo.DbObject
 		mo.MX.Unlock()
-
-		dp, ok := dprofiles[dbo.DiscoveryID]
-		if !ok {
-			logger.Err("DB SYNC: No discovery profile with id %d for %s", dbo.DiscoveryID, dbo.Name)
-			return true
-		}
-		ap, ok := aprofiles[dbo.AuthID]
-		if !ok {
-			logger.Err("DB SYNC: No auth profile with id %d for %s", dbo.AuthID, dbo.Name)
-			return true
-		}
-
-		interfaces := make([]*dproto.PollInterface, 0)
-		obj := dproto.DBObject{
-			Addr:dbo.Mgmt,
-			ID:dbo.ID,
-			PingInterval:dp.PingInterval,
-			PollInterval:dp.PeriodicInterval,
-			RoCommunity:ap.RoCommunity,
-			Alive:dbo.Alive,
-			Removed:false,
-			Interfaces:interfaces,
-		}
-
-		// get object interfaces
-		ifs := make([]models.Interface, 0)
-		if err := db.DB.Model(&ifs).Where(`object_id = ?`, dbo.ID).Select(); err != nil && err != pg.ErrNoRows {
-			logger.Err("Cannot select object interfaces: ")
-		} else {
-			for i := range ifs {
-				iface := dproto.PollInterface{
-					ID:ifs[i].ID,
-					Name:ifs[i].Name,
-					Shortname:ifs[i].Shortname,
-				}
-				interfaces = append(interfaces, &iface)
-			}
-			obj.Interfaces = interfaces
+		if dbo.DomainID == domainID {
+			objects = append(objects, dbo)
 		}
-
-		dbObjects = append(dbObjects, &obj)
 		return true
 	})
+	dbObjects := buildDBObjects(objects, false)
 
 	// stored all objects ; send them to given channel
 	id, err := uuid.NewRandom()
@@ -252,11 +284,7 @@ func (n *NatsClient) DbSync(dbChan string) {
 		logger.Err("Cannot generate uuid: %s", err.Error())
 		return
 	}
-	reply := dproto.DBD{
-		ReplyID:id.String(),
-		Objects:dbObjects,
-	}
-	bts, err := proto.Marshal(&reply)
+	bts, err := proto.Marshal(newDBD(id.String(), dbObjects, seq))
 	if err != nil {
 		logger.Err("Cannot marshal dproto DBD: %s", err.Error())
 		return
@@ -275,14 +303,7 @@ func (n *NatsClient) DbSync(dbChan string) {
 		return
 	}
 
-	SendLock.Lock()
-	defer SendLock.Unlock()
-	_, err = Nats.Conn.PublishAsync(dbChan, packetBts, func(g string, e error) {
-		if e != nil {
-			logger.Err("Error recieving NATS DBD ACK: %s", e.Error())
-		}
-	})
-	if err != nil {
+	if err = n.Publish(n.DbSubject(domainID), packetBts); err != nil {
 		logger.Err("Failed to send NATS DBD: %s", err.Error())
 	}
 }
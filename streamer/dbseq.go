@@ -0,0 +1,37 @@
+// +build dprotonext
+
+package streamer
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/ircop/dproto"
+)
+
+// dbRequestSince returns sequence number of changes, poller has already. Old pollers send request
+// without payload: they always get full snapshot.
+func dbRequestSince(payload *any.Any) (int64, error) {
+	if payload == nil {
+		return 0, nil
+	}
+	var request dproto.DBRequest
+	if err := proto.Unmarshal(payload.Value, &request); err != nil {
+		return 0, err
+	}
+	return request.Since, nil
+}
+
+func newDBUpdate(objects []*dproto.DBObject, seq int64) *dproto.DBUpdate {
+	return &dproto.DBUpdate{
+		Objects:objects,
+		Seq:seq,
+	}
+}
+
+func newDBD(replyID string, objects []*dproto.DBObject, seq int64) *dproto.DBD {
+	return &dproto.DBD{
+		ReplyID:replyID,
+		Objects:objects,
+		Seq:seq,
+	}
+}
@@ -0,0 +1,28 @@
+// +build !dprotonext
+
+package streamer
+
+import (
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/ircop/dproto"
+)
+
+// Released dproto has no DBRequest message and sequence numbers yet: pollers always get full snapshots.
+// Build with 'dprotonext' tag against dproto, that has them, to enable incremental sync.
+
+func dbRequestSince(payload *any.Any) (int64, error) {
+	return 0, nil
+}
+
+func newDBUpdate(objects []*dproto.DBObject, seq int64) *dproto.DBUpdate {
+	return &dproto.DBUpdate{
+		Objects:objects,
+	}
+}
+
+func newDBD(replyID string, objects []*dproto.DBObject, seq int64) *dproto.DBD {
+	return &dproto.DBD{
+		ReplyID:replyID,
+		Objects:objects,
+	}
+}
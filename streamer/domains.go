@@ -0,0 +1,84 @@
+package streamer
+
+import (
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+)
+
+// DefaultDomain is the name of domain for objects without domain_id
+const DefaultDomain = "default"
+
+// DomainName returns name of domain by ID. Zero ID means default domain.
+func DomainName(domainID int64) string {
+	if domainID == 0 {
+		return DefaultDomain
+	}
+	dInt, ok := handler.Domains.Load(domainID)
+	if !ok {
+		logger.Err("Unknown domain #%d, using default one", domainID)
+		return DefaultDomain
+	}
+
+	return dInt.(models.Domain).Name
+}
+
+// Subjects of the default domain are the configured ones, so existing workers keep working as before.
+// Unknown domains use them too: requests go to default workers instead of subject, that nobody listens.
+func domainSubject(base string, domainID int64) string {
+	if domainID == 0 {
+		return base
+	}
+	dInt, ok := handler.Domains.Load(domainID)
+	if !ok {
+		logger.Err("Unknown domain #%d, using default subject '%s'", domainID, base)
+		return base
+	}
+
+	return base + "-" + dInt.(models.Domain).Name
+}
+
+// TasksSubject returns subject where box requests for given domain are sent
+func (n *NatsClient) TasksSubject(domainID int64) string {
+	return domainSubject(n.TasksChan, domainID)
+}
+
+// DbSubject returns subject where DB requests/updates for given domain are sent
+func (n *NatsClient) DbSubject(domainID int64) string {
+	return domainSubject(n.DbChan, domainID)
+}
+
+// PingSubject returns subject where pingers of given domain send their updates
+func (n *NatsClient) PingSubject(domainID int64) string {
+	return "ping-" + DomainName(domainID)
+}
+
+// AddDomain subscribes to db/ping subjects of new domain at runtime and sends it's (empty) db to pollers.
+// Followers don't subscribe: new leader subscribes to all domains.
+func (n *NatsClient) AddDomain(d models.Domain) error {
+	if !n.IsLeading() {
+		return nil
+	}
+	if err := n.subscribeDomain(d.ID); err != nil {
+		return err
+	}
+
+	logger.Log("Subscribed to domain '%s'", d.Name)
+	go n.DbSync(d.ID)
+	return nil
+}
+
+// RemoveDomain drops durable subscriptions of removed domain
+func (n *NatsClient) RemoveDomain(d models.Domain) error {
+	n.MX.Lock()
+	if t, ok := n.syncTimers[d.ID]; ok {
+		t.Stop()
+		delete(n.syncTimers, d.ID)
+	}
+	n.MX.Unlock()
+
+	if err := n.removeSubscription(n.DbSubject(d.ID)); err != nil {
+		return err
+	}
+	return n.removeSubscription(n.PingSubject(d.ID))
+}
@@ -0,0 +1,27 @@
+package streamer
+
+import (
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/models"
+	"testing"
+)
+
+func TestDomainSubjects(t *testing.T) {
+	n := &NatsClient{TasksChan:"tasks", DbChan:"db"}
+	handler.Domains.Store(int64(5), models.Domain{ID:5, Name:"east"})
+	defer handler.Domains.Delete(int64(5))
+
+	if s := n.TasksSubject(0); s != "tasks" {
+		t.Errorf("default domain tasks subject is '%s'", s)
+	}
+	if s := n.TasksSubject(5); s != "tasks-east" {
+		t.Errorf("domain tasks subject is '%s'", s)
+	}
+	// unknown domain is served by default workers
+	if s := n.TasksSubject(6); s != "tasks" {
+		t.Errorf("unknown domain tasks subject is '%s'", s)
+	}
+	if s := n.DbSubject(6); s != "db" {
+		t.Errorf("unknown domain db subject is '%s'", s)
+	}
+}
@@ -4,17 +4,19 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/any"
 	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/bus"
 	"github.com/ircop/ohandler/db"
 	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/logger"
-	nats "github.com/nats-io/go-nats-streaming"
+	"github.com/ircop/ohandler/models"
+	"time"
 )
 
-func PingUpdate(msg *nats.Msg) {
+func PingUpdate(msg bus.Msg) {
 	defer msg.Ack()
 
 	var packet dproto.DPacket
-	err := proto.Unmarshal(msg.Data, &packet)
+	err := proto.Unmarshal(msg.Data(), &packet)
 	if err != nil {
 		logger.Err("Cannot unmarshal ping DPacket: %s", err.Error())
 		return
@@ -34,7 +36,10 @@ func processUpdate(payload *any.Any) {
 
 	oid := update.OID
 	alive := update.Alive
-	//ts := update.Updated // todo: write/notify change time
+	changedAt := time.Now()
+	if update.Updated > 0 {
+		changedAt = time.Unix(update.Updated, 0)
+	}
 
 	moInt, ok := handler.Objects.Load(oid)
 	if !ok {
@@ -51,10 +56,22 @@ func processUpdate(payload *any.Any) {
 		// update
 		logger.Debug("Setting %s (#%d) state to %v", dbo.Name, oid, alive)
 		dbo.Alive = alive
-		if err := db.DB.Update(&dbo); err != nil {
+		// other columns in memory may be older than DB ones
+		if _, err := db.DB.Model(&dbo).Column("alive").WherePK().Update(); err != nil {
 			logger.Err("Failed to update object %s in DB: %s", dbo.Name, err.Error())
 			return
 		}
 		mo.DbObject = dbo
+
+		// keep transitions history for availability reports; maintenance outages are not counted there
+		state := models.ObjectState{
+			ObjectID:oid,
+			Alive:alive,
+			ChangedAt:changedAt,
+			Maintenance:handler.InMaintenance(oid),
+		}
+		if err := db.DB.Insert(&state); err != nil {
+			logger.Err("Failed to store %s state change: %s", dbo.Name, err.Error())
+		}
 	}
 }
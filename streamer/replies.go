@@ -1,26 +1,79 @@
 package streamer
 
 import (
+	"context"
+	"errors"
 	"github.com/golang/protobuf/proto"
 	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/bus"
 	"github.com/ircop/ohandler/logger"
-	nats "github.com/nats-io/go-nats-streaming"
-	"github.com/sasha-s/go-deadlock"
 	"sync"
-	"time"
 )
 
+var (
+	ErrBoxTimeout	= errors.New("Box request timed out")
+	ErrBoxCanceled	= errors.New("Box request canceled")
+	// request is not awaited anymore because of shutdown; reply may be applied after restart
+	ErrBoxShutdown	= errors.New("Box request interrupted by shutdown")
+)
+
+// OnUnknownReply is called for replies, that are not awaited by this process (e.g. sent before restart)
+var OnUnknownReply func(reply *dproto.BoxResponse)
+
+// BoxResult is a reply to box request. Err is set on worker error (with Response), timeout or cancel.
+type BoxResult struct {
+	Response		*dproto.BoxResponse
+	Err				error
+}
+
 //var TaskPool	sync.Map
 var BoxPool	sync.Map
 type WaitingBox struct {
 	RequestID		string
 	//Type			dproto.PacketType
-	Timer			*time.Timer
 
-	ErrorCB			func(string)
-	AnswerCB		func(response dproto.BoxResponse)
+	result			chan BoxResult
+	cancel			context.CancelFunc
+	once			sync.Once
+}
+
+func newWaitingBox(requestID string, cancel context.CancelFunc) *WaitingBox {
+	return &WaitingBox{
+		RequestID:requestID,
+		result:make(chan BoxResult, 1),
+		cancel:cancel,
+	}
+}
+
+// finish removes request from pool and sends result. Only first call has effect.
+func (w *WaitingBox) finish(result BoxResult) {
+	w.once.Do(func() {
+		BoxPool.Delete(w.RequestID)
+		w.result <- result
+		close(w.result)
+		w.cancel()
+	})
+}
+
+// wait finishes request with timeout/cancel error when context is done
+func (w *WaitingBox) wait(ctx context.Context) {
+	<-ctx.Done()
+	if ctx.Err() == context.DeadlineExceeded {
+		w.finish(BoxResult{Err:ErrBoxTimeout})
+		return
+	}
+	w.finish(BoxResult{Err:ErrBoxCanceled})
+}
 
-	MX				deadlock.Mutex
+// InterruptAll stops waiting for all outstanding requests with ErrBoxShutdown. Returns amount of them.
+func InterruptAll() int {
+	cnt := 0
+	BoxPool.Range(func(_, wInt interface{}) bool {
+		wInt.(*WaitingBox).finish(BoxResult{Err:ErrBoxShutdown})
+		cnt++
+		return true
+	})
+	return cnt
 }
 
 /*
@@ -29,11 +82,11 @@ We have recieved a message. We must:
 2) ensure packetType is BOX REPLY
 3) unmarshal any to box reply and work with box reply
  */
-func taskReply(msg *nats.Msg) {
+func taskReply(msg bus.Msg) {
 	defer msg.Ack()
 
 	var packet dproto.DPacket
-	err := proto.Unmarshal(msg.Data, &packet)
+	err := proto.Unmarshal(msg.Data(), &packet)
 	if err != nil {
 		logger.Err("Failed to parse dproto packet: %s", err.Error())
 		return
@@ -53,27 +106,17 @@ func taskReply(msg *nats.Msg) {
 
 	waitingInterface, ok := BoxPool.Load(reply.ReplyID)
 	if !ok {
+		if OnUnknownReply != nil {
+			OnUnknownReply(&reply)
+			return
+		}
 		logger.Err("Got unknown reply ID: %s", reply.ReplyID)
 		return
 	}
-	BoxPool.Delete(reply.ReplyID)
-
-	waitingTask := waitingInterface.(*WaitingBox)
-	waitingTask.MX.Lock()
-	if waitingTask.Timer != nil {
-		waitingTask.Timer.Stop()
-		waitingTask.Timer = nil
-	}
-	waitingTask.MX.Unlock()
 
+	result := BoxResult{Response:&reply}
 	if reply.Error != "" {
-		if waitingTask.ErrorCB != nil {
-			waitingTask.ErrorCB(reply.Error)
-		}
-		return
-	}
-
-	if waitingTask.AnswerCB != nil {
-		waitingTask.AnswerCB(reply)
+		result.Err = errors.New(reply.Error)
 	}
+	waitingInterface.(*WaitingBox).finish(result)
 }
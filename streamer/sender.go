@@ -1,29 +1,58 @@
 package streamer
 
 import (
+	"context"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes/any"
 	"github.com/google/uuid"
 	"github.com/ircop/dproto"
 	"github.com/ircop/ohandler/logger"
-	"github.com/sasha-s/go-deadlock"
 	"time"
 )
 
-var SendLock deadlock.Mutex
+// BoxParams describe box discovery request
+type BoxParams struct {
+	DomainID		int64
+	Host			string
+	Protocol		dproto.Protocol
+	Profile			dproto.ProfileType
+	Login			string
+	Password		string
+	Enable			string
+	// requested task types; empty means all of them. Without 'dprotonext' build tag box always runs all of them.
+	Tasks			[]dproto.TaskType
+	// BeforeSend is called before request is published, e.g. to store it. Request is not sent, if it fails.
+	BeforeSend		func(requestID string, deadline time.Time) error
+}
+
+// BoxHandle is returned by SendBox. Exactly one result is sent to Result channel: worker reply,
+// ErrBoxTimeout, ErrBoxCanceled or ErrBoxShutdown.
+type BoxHandle struct {
+	RequestID		string
+	Result			<-chan BoxResult
+	// reply is not awaited after this time
+	Deadline		time.Time
 
-func SendBox(host string, protocol dproto.Protocol, profile dproto.ProfileType, login string, password string, enable string,
-	errorCB func(string), answerCB func(response dproto.BoxResponse), timeoutCB func()) {
+	cancel			context.CancelFunc
+}
+
+// Cancel stops waiting for the reply and removes request from BoxPool. Late reply will be ignored.
+func (h *BoxHandle) Cancel() {
+	h.cancel()
+}
 
+// SendBox publishes box request to tasks subject of params.DomainID.
+// Reply is awaited until ctx is done; if ctx has no deadline, configured box.timeout is used.
+func SendBox(ctx context.Context, params BoxParams) (*BoxHandle, error) {
 	// unique request ID
 	id, err := uuid.NewRandom()
 	if err != nil {
-		logger.Err("Cannot generate task uuid: %s", err.Error())
-		return
+		return nil, fmt.Errorf("Cannot generate task uuid: %s", err.Error())
 	}
 
 	var port int64 = 22
-	if protocol == dproto.Protocol_TELNET {
+	if params.Protocol == dproto.Protocol_TELNET {
 		port = 23
 	}
 
@@ -31,31 +60,22 @@ func SendBox(host string, protocol dproto.Protocol, profile dproto.ProfileType,
 		RequestID:	id.String(),
 		// todo: do we need this tout?
 		Timeout:	120,
-		Login:		login,
-		Password:	password,
-		Profile:	profile,
-		Host:		host,
-		Proto:		protocol,
-		Enable:		enable,
+		Login:		params.Login,
+		Password:	params.Password,
+		Profile:	params.Profile,
+		Host:		params.Host,
+		Proto:		params.Protocol,
+		Enable:		params.Enable,
 		Port:		port,
 	}
+	setBoxTasks(&message, params.Tasks)
 
 	// bytes of task struct. This will be marshaled into ANY
 	bts, err := proto.Marshal(&message)
 	if err != nil {
-		logger.Err("Cannot marshal task message: %s", err.Error())
-		return
+		return nil, fmt.Errorf("Cannot marshal task message: %s", err.Error())
 	}
 
-	wt := WaitingBox{
-		RequestID:	id.String(),
-		ErrorCB:	errorCB,
-		AnswerCB:	answerCB,
-	}
-	wt.Timer = time.AfterFunc(time.Minute * 15, timeoutCB)	// todo: configure wait timer
-	BoxPool.Store(id.String(), &wt)
-
-
 	packet := dproto.DPacket{
 		PacketType:dproto.PacketType_BOX_REQUEST,
 		Payload: &any.Any{
@@ -66,20 +86,41 @@ func SendBox(host string, protocol dproto.Protocol, profile dproto.ProfileType,
 
 	packetBts, err := proto.Marshal(&packet)
 	if err != nil {
-		logger.Err("Cannot marshal dproto packet: %s", err.Error())
-		return
+		return nil, fmt.Errorf("Cannot marshal dproto packet: %s", err.Error())
 	}
 
+	var cancel context.CancelFunc
+	if _, ok := ctx.Deadline(); ok {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(ctx, Nats.config.BoxTimeout)
+	}
+
+	deadline, _ := ctx.Deadline()
+	if params.BeforeSend != nil {
+		if err = params.BeforeSend(id.String(), deadline); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
+	// request is stored before sending, reply can come faster than Publish returns
+	wt := newWaitingBox(id.String(), cancel)
+	BoxPool.Store(id.String(), wt)
+	go wt.wait(ctx)
+
 	// send this task
 	logger.Log("Sending box request '%s'", id.String())
-	SendLock.Lock()
-	defer SendLock.Unlock()
-	_, err = Nats.Conn.PublishAsync(Nats.TasksChan, packetBts, func(g string, e error) {
-		if e != nil {
-			logger.Err("Error recieving NATS ACK: %s", e.Error())
-		}
-	})
-	if err != nil {
-		logger.Err("Failed to send NATS BOX request: %s", err.Error())
+	if err = Nats.Publish(Nats.TasksSubject(params.DomainID), packetBts); err != nil {
+		BoxPool.Delete(id.String())
+		cancel()
+		return nil, fmt.Errorf("Failed to send box request: %s", err.Error())
 	}
+
+	return &BoxHandle{
+		RequestID:id.String(),
+		Result:wt.result,
+		Deadline:deadline,
+		cancel:cancel,
+	}, nil
 }
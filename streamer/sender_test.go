@@ -0,0 +1,121 @@
+package streamer
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/bus"
+	"github.com/ircop/ohandler/cfg"
+	"testing"
+	"time"
+)
+
+// startMemory starts streamer on memory bus; worker answers every box request with given error text
+func startMemory(t *testing.T, workerError string, answer bool) {
+	b := bus.NewMemory()
+	config := &cfg.Cfg{NatsTasks:"tasks", NatsReplies:"replies", NatsDB:"db", BoxTimeout:time.Minute}
+	if err := Start(config, b); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Subscribe("tasks", bus.SubOptions{}, func(msg bus.Msg) {
+		msg.Ack()
+		if !answer {
+			return
+		}
+		var packet dproto.DPacket
+		var request dproto.BoxRequest
+		proto.Unmarshal(msg.Data(), &packet)
+		proto.Unmarshal(packet.Payload.Value, &request)
+
+		bts, _ := proto.Marshal(&dproto.BoxResponse{ReplyID:request.RequestID, Error:workerError})
+		bts, _ = proto.Marshal(&dproto.DPacket{
+			PacketType:dproto.PacketType_BOX_REPLY,
+			Payload:&any.Any{TypeUrl:dproto.PacketType_BOX_REPLY.String(), Value:bts},
+		})
+		b.Publish("replies", bts)
+	})
+}
+
+func waitResult(t *testing.T, h *BoxHandle) BoxResult {
+	select {
+	case r := <-h.Result:
+		return r
+	case <-time.After(time.Second * 5):
+		t.Fatal("no result")
+	}
+	return BoxResult{}
+}
+
+func TestSendBoxReply(t *testing.T) {
+	startMemory(t, "", true)
+	h, err := SendBox(context.Background(), BoxParams{Host:"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := waitResult(t, h)
+	if r.Err != nil || r.Response == nil || r.Response.ReplyID != h.RequestID {
+		t.Errorf("unexpected result: %+v", r)
+	}
+	if _, ok := BoxPool.Load(h.RequestID); ok {
+		t.Errorf("request is still in pool")
+	}
+}
+
+func TestSendBoxWorkerError(t *testing.T) {
+	startMemory(t, "auth failed", true)
+	h, _ := SendBox(context.Background(), BoxParams{Host:"10.0.0.1"})
+
+	r := waitResult(t, h)
+	if r.Err == nil || r.Err.Error() != "auth failed" {
+		t.Errorf("expected worker error, got %+v", r)
+	}
+}
+
+func TestSendBoxTimeoutAndCancel(t *testing.T) {
+	startMemory(t, "", false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+	defer cancel()
+	h, _ := SendBox(ctx, BoxParams{Host:"10.0.0.1"})
+	if r := waitResult(t, h); r.Err != ErrBoxTimeout {
+		t.Errorf("expected timeout, got %+v", r)
+	}
+
+	h, _ = SendBox(context.Background(), BoxParams{Host:"10.0.0.1"})
+	h.Cancel()
+	if r := waitResult(t, h); r.Err != ErrBoxCanceled {
+		t.Errorf("expected cancel, got %+v", r)
+	}
+	if _, ok := BoxPool.Load(h.RequestID); ok {
+		t.Errorf("canceled request is still in pool")
+	}
+}
+
+func TestSendBoxBeforeSend(t *testing.T) {
+	startMemory(t, "", true)
+	stored := ""
+	h, err := SendBox(context.Background(), BoxParams{Host:"10.0.0.1", BeforeSend:func(id string, deadline time.Time) error {
+		if deadline.IsZero() {
+			t.Errorf("request has no deadline")
+		}
+		stored = id
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := waitResult(t, h); r.Err != nil || stored != h.RequestID {
+		t.Errorf("request %s is not stored before reply: %+v", h.RequestID, r)
+	}
+
+	// request, that can't be stored, is not sent
+	_, err = SendBox(context.Background(), BoxParams{Host:"10.0.0.1", BeforeSend:func(string, time.Time) error {
+		return errors.New("db is down")
+	}})
+	if err == nil {
+		t.Errorf("request is sent without being stored")
+	}
+}
@@ -1,80 +1,206 @@
 package streamer
 
 import (
-	"fmt"
+	"github.com/ircop/ohandler/bus"
+	"github.com/ircop/ohandler/cfg"
+	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/logger"
-	nats "github.com/nats-io/go-nats-streaming"
-	"os"
-	"strings"
+	"github.com/sasha-s/go-deadlock"
 	"time"
 )
 
 type NatsClient struct {
-	Conn			nats.Conn
-	URL				string
+	Bus				bus.Bus
 	RepliesChan		string
 	TasksChan		string
 	DbChan			string
-	SyncTimer		*time.Timer
+	syncTimers		map[int64]*time.Timer
+
+	config			*cfg.Cfg
+	subs			map[string]bus.Subscription
+	// only leader handles db requests and ping updates
+	leading			bool
+	MX				deadlock.Mutex
 }
 
 var Nats NatsClient
 
-//var NatsConn nats.Conn
+// Init connects to the bus, configured by bus.backend, and subscribes to replies.
+// Domains are subscribed by StartLeading.
+func Init(config *cfg.Cfg) error {
+	logger.Log("Initializing message bus (%s)...", config.BusBackend)
 
-func Init(url string, repliesChan string, tasksChan string, dbChan string) error {
-	logger.Log("Initializing NATS client...")
-	var err error
+	b, err := bus.New(config)
+	if err != nil {
+		return err
+	}
+
+	return Start(config, b)
+}
 
-	hostname, err := os.Hostname()
+// Start subscribes streamer to box replies on given bus
+func Start(config *cfg.Cfg, b bus.Bus) error {
+	Nats.config = config
+	Nats.Bus = b
+	Nats.RepliesChan = config.NatsReplies
+	Nats.TasksChan = config.NatsTasks
+	Nats.DbChan = config.NatsDB
+	Nats.subs = make(map[string]bus.Subscription)
+	Nats.syncTimers = make(map[int64]*time.Timer)
+
+	// pollers could miss object updates while we were away
+	b.OnReconnect(Nats.DbSyncAll)
+
+	// every instance may send box requests (e.g. jobs), so in cluster mode every one needs it's own replies
+	durable := Nats.RepliesChan
+	if config.ClusterEnabled {
+		durable = Nats.RepliesChan + "-" + config.ClusterInstance
+	}
+	sub, err := b.Subscribe(Nats.RepliesChan, bus.SubOptions{
+		Durable:durable,
+		MaxInflight:config.NatsRepliesInflight,
+		AckWait:config.NatsRepliesAckWait,
+	}, func(msg bus.Msg) {
+		// handle reply
+		go taskReply(msg)
+	})
 	if err != nil {
-		return fmt.Errorf("Cannot discover hostname: %s", err.Error())
+		return err
 	}
-	hostname = strings.Replace(hostname, ".", "-", -1) + "-client"
+	Nats.MX.Lock()
+	Nats.subs[Nats.RepliesChan] = sub
+	Nats.MX.Unlock()
 
-	Nats.RepliesChan = repliesChan
-	Nats.TasksChan = tasksChan
-	Nats.DbChan = dbChan
-	Nats.URL = url
+	return nil
+}
 
-	if Nats.Conn, err = nats.Connect("test-cluster", hostname, nats.NatsURL(Nats.URL)); err != nil {
+// StartLeading subscribes to db and ping subjects of all domains and sends db to pollers
+func (n *NatsClient) StartLeading() error {
+	n.MX.Lock()
+	n.leading = true
+	n.MX.Unlock()
+
+	if err := n.subscribeDomain(0); err != nil {
+		return err
+	}
+	var err error
+	handler.Domains.Range(func(id, _ interface{}) bool {
+		if err = n.subscribeDomain(id.(int64)); err != nil {
+			return false
+		}
+		return true
+	})
+	if err != nil {
 		return err
 	}
 
-	// Subscribe to task-replies channel
-	_, err = Nats.Conn.Subscribe(repliesChan, func(msg *nats.Msg) {
-			// handle reply
-			go taskReply(msg)
-		},
-		nats.DurableName(repliesChan),
-		nats.MaxInflight(300),		// max. simultaneous updates. Todo: configure it
-		nats.SetManualAckMode(),
-		nats.AckWait(time.Minute * 15),	// todo: configure  this timeout
-	)
+	go n.DbSyncAll()
+	return nil
+}
+
+// StopLeading closes domain subscriptions and stops periodic db syncs. Durable subscriptions are kept,
+// so messages, published until new leader subscribes, are not lost.
+func (n *NatsClient) StopLeading() {
+	n.MX.Lock()
+	n.leading = false
+	for domainID, t := range n.syncTimers {
+		t.Stop()
+		delete(n.syncTimers, domainID)
+	}
+	subjects := make([]string, 0, len(n.subs))
+	for subject := range n.subs {
+		if subject != n.RepliesChan {
+			subjects = append(subjects, subject)
+		}
+	}
+	n.MX.Unlock()
+
+	for _, subject := range subjects {
+		if sub := n.takeSubscription(subject); sub != nil {
+			if err := sub.Close(); err != nil {
+				logger.Err("Failed to close subscription %s: %s", subject, err.Error())
+			}
+		}
+	}
+}
+
+// IsLeading returns true if this instance handles db requests and ping updates
+func (n *NatsClient) IsLeading() bool {
+	n.MX.Lock()
+	defer n.MX.Unlock()
+	return n.leading
+}
+
+// subscribeDomain subscribes to db and ping subjects of given domain
+func (n *NatsClient) subscribeDomain(domainID int64) error {
+	err := n.addSubscription(n.DbSubject(domainID), n.config.NatsDBInflight, n.config.NatsDBAckWait, func(msg bus.Msg) {
+		go n.dbPacket(msg, domainID)
+	})
 	if err != nil {
 		return err
 	}
 
-	// subscribe to DB channel
-	_, err = Nats.Conn.Subscribe(dbChan, func(msg *nats.Msg) {
-		go Nats.dbPacket(msg, dbChan)
-	},
-		nats.DurableName(dbChan),
-		nats.MaxInflight(10),
-		nats.SetManualAckMode(),
-		nats.AckWait(time.Minute * 3),
-	)
-
-	// subscribe to pingupdates channel.
-	// TODO: this should be made dynamicly, for each 'domain' (future)
-	_, err = Nats.Conn.Subscribe("ping-default", func(msg *nats.Msg) {
+	return n.addSubscription(n.PingSubject(domainID), n.config.NatsPingInflight, n.config.NatsPingAckWait, func(msg bus.Msg) {
 		go PingUpdate(msg)
-	},
-		nats.DurableName("ping-default"),
-		nats.MaxInflight(5000),
-		nats.SetManualAckMode(),
-		nats.AckWait(time.Minute * 1),
-	)
+	})
+}
+
+// addSubscription subscribes to subject with durable name equal to subject
+func (n *NatsClient) addSubscription(subject string, inflight int, ackWait time.Duration, cb bus.Handler) error {
+	sub, err := n.Bus.Subscribe(subject, bus.SubOptions{
+		Durable:subject,
+		MaxInflight:inflight,
+		AckWait:ackWait,
+	}, cb)
+	if err != nil {
+		return err
+	}
+
+	n.MX.Lock()
+	n.subs[subject] = sub
+	n.MX.Unlock()
+	return nil
+}
 
+// takeSubscription removes subscription of subject from client and returns it; nil if there is no such one
+func (n *NatsClient) takeSubscription(subject string) bus.Subscription {
+	n.MX.Lock()
+	defer n.MX.Unlock()
+	sub, ok := n.subs[subject]
+	if !ok {
+		return nil
+	}
+	delete(n.subs, subject)
+	return sub
+}
+
+// removeSubscription unsubscribes durable subscription, so server forgets it's state
+func (n *NatsClient) removeSubscription(subject string) error {
+	if sub := n.takeSubscription(subject); sub != nil {
+		return sub.Unsubscribe()
+	}
 	return nil
 }
+
+// Close stops db syncs and closes bus connection. Durable subscriptions are kept.
+func (n *NatsClient) Close() error {
+	n.MX.Lock()
+	n.leading = false
+	for domainID, t := range n.syncTimers {
+		t.Stop()
+		delete(n.syncTimers, domainID)
+	}
+	n.MX.Unlock()
+
+	return n.Bus.Close()
+}
+
+// Publish sends message to given subject
+func (n *NatsClient) Publish(subject string, data []byte) error {
+	return n.Bus.Publish(subject, data)
+}
+
+// Status returns current bus connection state
+func (n *NatsClient) Status() bus.Status {
+	return n.Bus.Status()
+}
@@ -7,130 +7,157 @@ import (
 	"github.com/ircop/ohandler/models"
 	"github.com/ircop/ohandler/logger"
 	"github.com/ircop/ohandler/db"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"fmt"
 	"net"
 )
 
-// ParseBoxResult parses response and updates object in DB and memory (if neded)
-func ParseBoxResult(response dproto.BoxResponse, mo *handler.ManagedObject, dbo models.Object) {
+// ParseBoxResult computes changeset of response and applies it in single transaction, with object row locked.
+// Changeset is not applied, if apply returns false for it. Any failure rolls back all changes.
+// Returns changeset, errors of sections and amount of applied changes, by dproto task name.
+func ParseBoxResult(response dproto.BoxResponse, tasks []dproto.TaskType, mo *handler.ManagedObject, apply func(*Changeset) bool) (*Changeset, map[string]string, map[string]int64, error) {
+	mo.MX.Lock()
+	dbo := mo.DbObject
+	mo.MX.Unlock()
+
+	var cs *Changeset
+	var errors map[string]string
+	var changes map[string]int64
+	err := db.DB.RunInTransaction(func(tx *pg.Tx) error {
+		// results are computed from the state, that can't be changed by concurrent run until we are done
+		if err := tx.Model(&dbo).WherePK().For("UPDATE").Select(); err != nil {
+			return fmt.Errorf("Cannot lock object: %s", err.Error())
+		}
+		cs, errors = ComputeChangeset(tx, response, tasks, dbo)
+		if !apply(cs) {
+			return nil
+		}
+		var err error
+		changes, err = ApplyTx(tx, cs, models.SourceDiscovery)
+		return err
+	})
+	if err != nil {
+		return cs, errors, nil, err
+	}
+	if changes != nil {
+		Applied(cs, mo)
+	}
+
+	return cs, errors, changes, nil
+}
+
+// ComputeChangeset compares response with DB state of object and returns changes, needed to store it. DB is not modified.
+// Only requested sections are reconciled: missing section of not-requested task is not a deletion.
+// Empty tasks means all sections were requested.
+// Returns errors of requested sections, by dproto task name.
+func ComputeChangeset(tx orm.DB, response dproto.BoxResponse, tasks []dproto.TaskType, dbo models.Object) (*Changeset, map[string]string) {
 	// check for global error, just in case
 	//if response.Type == dproto.PacketType_ERROR {
 	//	return
 	//}
 
-	// platform
-	if e, ok := response.Errors[dproto.TaskType_PLATFORM.String()]; ok {
-		logger.Err("%s: Error in %s: %s", dbo.Name, dproto.TaskType_PLATFORM.String(), e)
-	} else {
-		comparePlatform(response.Platform, mo, dbo)
-	}
-
-	// after parsing platform, DBO may be changed
-	mo.MX.Lock()
-	dbo = mo.DbObject
-	mo.MX.Unlock()
-
-	// Interfaces
-	if e, ok := response.Errors[dproto.TaskType_INTERFACES.String()]; ok {
-		logger.Err("%s: Error in %s: %s", dbo.Name, dproto.TaskType_INTERFACES.String(), e)
-	} else {
-		compareInterfaces(response.Interfaces, mo, dbo)
-	}
+	cs := newChangeset(dbo)
+	errors := make(map[string]string)
 
-	// Lldp
-	if e, ok := response.Errors[dproto.TaskType_LLDP.String()]; ok {
-		logger.Err("%s: Error in %s: %s", dbo.Name, dproto.TaskType_LLDP.String(), e)
-	} else {
-		compareLldp(response.LldpNeighbors, mo, dbo)
+	if len(tasks) == 0 {
+		tasks = models.AllTaskTypes()
 	}
-
-	// Vlans
-	if e, ok := response.Errors[dproto.TaskType_VLANS.String()]; ok {
-		logger.Err("%s: Error in %s: %s", dbo.Name, dproto.TaskType_VLANS.String(), e)
-	} else {
-		processVlans(response.Vlans, mo, dbo)
+	requested := make(map[dproto.TaskType]bool, len(tasks))
+	for _, t := range tasks {
+		requested[t] = true
 	}
 
-	// IPs
-	if e, ok := response.Errors[dproto.TaskType_IPS.String()]; ok {
-		logger.Err("%s: Error in %s: %s", dbo.Name, dproto.TaskType_IPS.String(), e)
-	} else {
-		processIpifs(response.Ipifs, mo, dbo)
+	// interfaces by name and shortname; interfaces, planned to be added, are placed here without ID
+	ifaces, err := getIfnamesAll(tx, dbo.ID)
+	if err != nil {
+		logger.Err("%s: %s", dbo.Name, err.Error())
+		for t := range requested {
+			errors[t.String()] = err.Error()
+		}
+		return cs, errors
 	}
 
-	// UPLINK
-	if e, ok := response.Errors[dproto.TaskType_UPLINK.String()]; ok {
-		logger.Err("%s: Error in %s: %s", dbo.Name, dproto.TaskType_UPLINK.String(), e)
-	} else {
-		processUplink(response.Uplink, mo, dbo)
-	}
+	// compute compares section, if it was requested and has no error. Failed section is not changed at all.
+	compute := func(t dproto.TaskType, f func() error) {
+		if !requested[t] {
+			return
+		}
+		if e, ok := response.Errors[t.String()]; ok {
+			logger.Err("%s: Error in %s: %s", dbo.Name, t.String(), e)
+			errors[t.String()] = e
+			return
+		}
+		n := len(cs.Changes)
+		if err := f(); err != nil {
+			logger.Err("%s: %s: %s", dbo.Name, t.String(), err.Error())
+			errors[t.String()] = err.Error()
+			cs.Changes = cs.Changes[:n]
+			return
+		}
+		cs.Tasks = append(cs.Tasks, t.String())
+	}
+
+	compute(dproto.TaskType_PLATFORM, func() error {
+		return comparePlatform(tx, cs, response.Platform, dbo)
+	})
+	compute(dproto.TaskType_INTERFACES, func() error {
+		return compareInterfaces(tx, cs, response.Interfaces, ifaces, dbo)
+	})
+	compute(dproto.TaskType_LLDP, func() error {
+		return compareLldp(tx, cs, response.LldpNeighbors, ifaces, dbo)
+	})
+	compute(dproto.TaskType_VLANS, func() error {
+		return processVlans(tx, cs, response.Vlans, ifaces, dbo)
+	})
+	compute(dproto.TaskType_IPS, func() error {
+		return processIpifs(tx, cs, response.Ipifs, ifaces, dbo)
+	})
+	compute(dproto.TaskType_UPLINK, func() error {
+		return processUplink(cs, response.Uplink, ifaces, dbo)
+	})
+	compute(dproto.TaskType_CONFIG, func() error {
+		return processConfig(tx, cs, response.Config, dbo)
+	})
+	computeFdb(compute, cs, &response, ifaces, dbo)
+	computeArp(compute, cs, &response, ifaces, dbo)
+
+	return cs, errors
+}
 
-	if e, ok := response.Errors[dproto.TaskType_CONFIG.String()]; ok {
-		logger.Err("%s: Error in %s: %s", dbo.Name, dproto.TaskType_CONFIG.String(), e)
-	} else {
-		processConfig(response.Config, mo, dbo)
+// inMaintenance returns true if object is in maintenance window, so given DB entry should not be deleted:
+// device may be reloaded or replaced, and it's partial results are not trusted.
+func inMaintenance(dbo models.Object, what string) bool {
+	if !handler.InMaintenance(dbo.ID) {
+		return false
 	}
+	logger.Update("%s: maintenance: keeping %s", dbo.Name, what)
+	return true
 }
 
-
-func comparePlatform(platform *dproto.Platform, mo *handler.ManagedObject, dbo models.Object) {
+func comparePlatform(tx orm.DB, cs *Changeset, platform *dproto.Platform, dbo models.Object) error {
 	// platform contains: model, version, revision, serial, macaddresses array
-	if platform.Model == "" && platform.Serial == "" && platform.Revision == "" && platform.Serial == "" {
+	if platform == nil || (platform.Model == "" && platform.Serial == "" && platform.Revision == "" && platform.Version == "") {
 		// something wrong, skip it
 		logger.Err("%s: skipping empty platform result", dbo.Name)
-		return
+		return nil
 	}
 
-	// todo: should we write changes log into some db? Lets say, Clickhouse?
-	mod := false
-	if platform.Model != dbo.Model {
-		mod = true
-		//logger.Debug("%s: changing model '%s' => '%s'", dbo.Name, dbo.Model, platform.Model)
-		logger.UpdateFormatted(dbo.Name, "Model", dbo.Model, platform.Model)
-		dbo.Model = platform.Model
-	}
-	if platform.Revision != dbo.Revision {
-		mod = true
-		//logger.Debug("%s: changing revision '%s' => '%s'", dbo.Name, dbo.Revision, platform.Revision)
-		logger.UpdateFormatted(dbo.Name, "Revision", dbo.Revision, platform.Revision)
-		dbo.Revision = platform.Revision
-	}
-	if platform.Version != dbo.Version {
-		mod = true
-		//logger.Debug("%s: changing version '%s' => '%s'", dbo.Name, dbo.Version, platform.Version)
-		logger.UpdateFormatted(dbo.Name, "Version", dbo.Version, platform.Version)
-		dbo.Version = platform.Version
-	}
-	if platform.Serial != dbo.Serial {
-		mod = true
-		//logger.Debug("%s: changing serial '%s' => '%s'", dbo.Name, dbo.Serial, platform.Serial)
-		logger.UpdateFormatted(dbo.Name, "Serial", dbo.Serial, platform.Serial)
-		dbo.Serial = platform.Serial
-	}
-
-	// update if needed
-	if mod {
-		err := db.DB.Update(&dbo)
-		if err != nil {
-			logger.Err("Failed to update %s db model: %s", dbo.Name, err.Error())
-			logger.Update("Failed to update %s db model: %s", dbo.Name, err.Error())
-		} else {
-			mo.MX.Lock()
-			mo.DbObject = dbo
-			mo.MX.Unlock()
-			handler.Objects.Store(dbo.ID, mo)
-		}
+	old := Platform{Model:dbo.Model, Revision:dbo.Revision, Version:dbo.Version, Serial:dbo.Serial}
+	discovered := Platform{Model:platform.Model, Revision:platform.Revision, Version:platform.Version, Serial:platform.Serial}
+	if discovered != old {
+		cs.add(SectionPlatform, OpUpdate, fmt.Sprintf("%s %s (%s)", discovered.Model, discovered.Version, discovered.Serial), &old, &discovered, nil)
 	}
 
 	// macs...
-	compareMacs(platform.Macs, mo, dbo)
+	return compareMacs(tx, cs, platform.Macs, dbo)
 }
 
-func compareMacs(newMacsArr []string, mo *handler.ManagedObject, dbo models.Object) {
+func compareMacs(tx orm.DB, cs *Changeset, newMacsArr []string, dbo models.Object) error {
 	oldMacsArr := make([]models.ObjectMac, 0)
-	err := db.DB.Model(&oldMacsArr).Where(`object_id = ?`, dbo.ID).Select()
+	err := tx.Model(&oldMacsArr).Where(`object_id = ?`, dbo.ID).Select()
 	if err != nil {
-		logger.Err("Failed to select object %d macs: %s", dbo.ID, err.Error())
-		return
+		return fmt.Errorf("Failed to select object macs: %s", err.Error())
 	}
 
 	// fill maps to simplify macs search by hash
@@ -140,52 +167,40 @@ func compareMacs(newMacsArr []string, mo *handler.ManagedObject, dbo models.Obje
 	for _, mac := range oldMacsArr {
 		m, e := net.ParseMAC(mac.Mac)
 		if e != nil {
-			logger.Err("%s: failed to parse old DB mac '%s': %s", dbo.Name, mac.Mac, e.Error())
-			logger.Update("%s: failed to parse old DB mac '%s': %s", dbo.Name, mac.Mac, e.Error())
-			return
+			return fmt.Errorf("failed to parse old DB mac '%s': %s", mac.Mac, e.Error())
 		}
 		oldMacs[m.String()] = mac
 	}
 	for _, mac := range newMacsArr {
 		m, e := net.ParseMAC(mac)
 		if e != nil {
-			logger.Err("%s: failed to parse platform mac '%s': %s", dbo.Name, mac, e.Error())
-			logger.Update("%s: failed to parse platform mac '%s': %s", dbo.Name, mac, e.Error())
-			return
+			return fmt.Errorf("failed to parse platform mac '%s': %s", mac, e.Error())
 		}
 		newMacs[m.String()] = true
 	}
 
 	// compare them
 	// remove non-existing macs
-	for mac, mdl := range oldMacs {
+	for mac := range oldMacs {
 		if _, ok := newMacs[mac]; !ok {
-			// remove old
-			logger.Update("%s: removing mac '%s' from DB", dbo.Name, mac)
-			err := db.DB.Delete(&mdl)
-			if err != nil {
-				logger.Err("%s: Failed to remove object mac '%s': %s", dbo.Name, mac, err.Error())
-				logger.Update("%s: Failed to remove object mac '%s': %s", dbo.Name, mac, err.Error())
-				return
+			if inMaintenance(dbo, "mac " + mac) {
+				continue
 			}
+			mdl := oldMacs[mac]
+			cs.add(SectionMacs, OpDelete, mac, &mdl, nil, nil)
 		}
 	}
 
 	// add newly discovered macs, thet are not in DB
-	for mac, _ := range newMacs {
+	for mac := range newMacs {
 		if _, ok := oldMacs[mac]; !ok {
-			// add new mac
-			logger.Update("%s: adding chassis mac '%s'", dbo.Name, mac)
 			mdl := models.ObjectMac{
 				ObjectID:dbo.ID,
 				Mac:mac,
 			}
-			err := db.DB.Insert(&mdl)
-			if err != nil {
-				logger.Err("%s: Failed to insert new chassis mac '%s': %s", dbo.Name, mac, err.Error())
-				logger.Update("%s: Failed to insert new chassis mac '%s': %s", dbo.Name, mac, err.Error())
-				return
-			}
+			cs.add(SectionMacs, OpAdd, mac, nil, &mdl, nil)
 		}
 	}
+
+	return nil
 }
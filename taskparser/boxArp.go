@@ -0,0 +1,50 @@
+// +build dprotonext
+
+package taskparser
+
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"fmt"
+	"net"
+)
+
+// computeArp compares ARP entries of response, if ARP task was requested
+func computeArp(compute func(dproto.TaskType, func() error), cs *Changeset, response *dproto.BoxResponse,
+	ifaces map[string]models.Interface, dbo models.Object) {
+	compute(dproto.TaskType_ARP, func() error {
+		return compareArp(cs, response.Arp, ifaces, dbo)
+	})
+}
+
+// compareArp places discovered ARP and IPv6 ND entries into changeset, like FDB: they replace active ARP table
+// of object when changeset is applied.
+func compareArp(cs *Changeset, entries []*dproto.ArpEntry, ifaces map[string]models.Interface, dbo models.Object) error {
+	arp := make([]models.ArpEntry, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		ip := net.ParseIP(e.IP)
+		m, err := net.ParseMAC(e.Mac)
+		if ip == nil || err != nil {
+			logger.Err("%s: skipping wrong ARP entry '%s' - '%s' on %s", dbo.Name, e.IP, e.Mac, e.Interface)
+			continue
+		}
+
+		entry := models.ArpEntry{ObjectID:dbo.ID, Port:e.Interface, IP:ip.String(), Mac:m.String(), Active:true}
+		if iface, ok := ifaces[e.Interface]; ok {
+			entry.InterfaceID = iface.ID
+			entry.Port = iface.Name
+		}
+
+		key := fmt.Sprintf("%s %s %s", entry.Port, entry.IP, entry.Mac)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		arp = append(arp, entry)
+	}
+
+	cs.Arp = arp
+	return nil
+}
@@ -0,0 +1,35 @@
+// +build dprotonext
+
+package taskparser
+
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/models"
+	"testing"
+)
+
+func TestCompareArp(t *testing.T) {
+	vlan := models.Interface{ID:7, Name:"Vlan10", Shortname:"Vl10"}
+	ifaces := map[string]models.Interface{vlan.Name:vlan, vlan.Shortname:vlan}
+	dbo := models.Object{ID:1, Name:"r1"}
+	cs := newChangeset(dbo)
+
+	err := compareArp(cs, []*dproto.ArpEntry{
+		{IP:"10.0.0.5", Mac:"0011.22aa.bbcc", Interface:"Vl10"},
+		{IP:"10.0.0.5", Mac:"00:11:22:AA:BB:CC", Interface:"Vlan10"},
+		{IP:"2001:DB8::5", Mac:"00:11:22:aa:bb:cc", Interface:"Vlan10"},
+	}, ifaces, dbo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cs.Arp) != 2 {
+		t.Fatalf("unexpected ARP entries: %+v", cs.Arp)
+	}
+	if e := cs.Arp[0]; e.InterfaceID != 7 || e.Port != "Vlan10" || e.Mac != "00:11:22:aa:bb:cc" || !e.Active {
+		t.Errorf("entry is not resolved: %+v", e)
+	}
+	if e := cs.Arp[1]; e.IP != "2001:db8::5" {
+		t.Errorf("ND entry ip is not normalized: %+v", e)
+	}
+}
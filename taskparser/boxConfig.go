@@ -1,29 +1,26 @@
 package taskparser
 
 import (
+	"fmt"
 	"github.com/go-pg/pg"
-	"github.com/ircop/ohandler/db"
-	"github.com/ircop/ohandler/handler"
-	"github.com/ircop/ohandler/logger"
+	"github.com/go-pg/pg/orm"
 	"github.com/ircop/ohandler/models"
 	"github.com/pmezard/go-difflib/difflib"
 	"strings"
 )
 
-func processConfig(newConfig string, mo *handler.ManagedObject, dbo models.Object) {
+func processConfig(tx orm.DB, cs *Changeset, newConfig string, dbo models.Object) error {
 	// nothing to compare, whoops.
 	if newConfig == "" {
-		return
+		return nil
 	}
 
 	// select and compare with last config
 	var prevCfg models.Config
-	err := db.DB.Model(&prevCfg).Where(`object_id = ?`, dbo.ID).Last()
+	err := tx.Model(&prevCfg).Where(`object_id = ?`, dbo.ID).Last()
 	if err != nil && err != pg.ErrNoRows {
-		logger.Err("%s: Failed to select prev.config: %s", dbo.Name, err.Error())
-		return
+		return fmt.Errorf("Failed to select prev.config: %s", err.Error())
 	}
-	//logger.Debug("GOT ID = %d", prevCfg.ID)
 	if err == pg.ErrNoRows {
 		// just insert new config
 		cfg := models.Config{
@@ -31,10 +28,8 @@ func processConfig(newConfig string, mo *handler.ManagedObject, dbo models.Objec
 			ObjectID:dbo.ID,
 			PrevDiff:"",
 		}
-		if err = db.DB.Insert(&cfg); err != nil {
-			logger.Err("%s: Failed to save new config: %s", dbo.Name, err.Error())
-		}
-		return
+		cs.add(SectionConfig, OpAdd, "first config", nil, &cfg, nil)
+		return nil
 	}
 
 	diff := difflib.ContextDiff{
@@ -45,23 +40,19 @@ func processConfig(newConfig string, mo *handler.ManagedObject, dbo models.Objec
 	}
 	result, err := difflib.GetContextDiffString(diff)
 	if err != nil {
-		logger.Err("%s: Failed to diff old+new configs: %s", dbo.Name, err.Error())
-		return
+		return fmt.Errorf("Failed to diff old+new configs: %s", err.Error())
 	}
 
 	if result != "" {
-		logger.Update("%s: Config was changed: \n%s", dbo.Name, result)
 		newone := models.Config{
 			Config:newConfig,
 			PrevDiff:result,
 			ObjectID:dbo.ID,
 		}
-		if err = db.DB.Insert(&newone); err != nil {
-			logger.Update("%s: Failed to insert new config: %s", dbo.Name, err.Error())
-			logger.Err("%s: Failed to insert new config: %s", dbo.Name, err.Error())
-			return
-		}
+		cs.add(SectionConfig, OpAdd, "changed config", nil, &newone, nil)
 	}
+
+	return nil
 }
 
 func prepareConfig(s string) []string {
@@ -0,0 +1,49 @@
+// +build dprotonext
+
+package taskparser
+
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"fmt"
+	"net"
+)
+
+// computeFdb compares FDB of response, if FDB task was requested
+func computeFdb(compute func(dproto.TaskType, func() error), cs *Changeset, response *dproto.BoxResponse,
+	ifaces map[string]models.Interface, dbo models.Object) {
+	compute(dproto.TaskType_FDB, func() error {
+		return compareFdb(cs, response.Fdb, ifaces, dbo)
+	})
+}
+
+// compareFdb places discovered FDB into changeset: it's not journaled, but replaces active FDB of object
+// when changeset is applied. Ports, added by the same changeset, are resolved then.
+func compareFdb(cs *Changeset, entries []*dproto.FdbEntry, ifaces map[string]models.Interface, dbo models.Object) error {
+	fdb := make([]models.FdbEntry, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		m, err := net.ParseMAC(e.Mac)
+		if err != nil {
+			logger.Err("%s: skipping FDB entry with wrong mac '%s' on %s", dbo.Name, e.Mac, e.Interface)
+			continue
+		}
+
+		entry := models.FdbEntry{ObjectID:dbo.ID, Port:e.Interface, Mac:m.String(), Vlan:e.Vlan, Active:true}
+		if iface, ok := ifaces[e.Interface]; ok {
+			entry.InterfaceID = iface.ID
+			entry.Port = iface.Name
+		}
+
+		key := fmt.Sprintf("%s %s %d", entry.Port, entry.Mac, entry.Vlan)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		fdb = append(fdb, entry)
+	}
+
+	cs.Fdb = fdb
+	return nil
+}
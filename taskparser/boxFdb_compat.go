@@ -0,0 +1,13 @@
+// +build !dprotonext
+
+package taskparser
+
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/models"
+)
+
+// Released dproto has no FDB task yet: FDB is not discovered.
+func computeFdb(compute func(dproto.TaskType, func() error), cs *Changeset, response *dproto.BoxResponse,
+	ifaces map[string]models.Interface, dbo models.Object) {
+}
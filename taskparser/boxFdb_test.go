@@ -0,0 +1,39 @@
+// +build dprotonext
+
+package taskparser
+
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/models"
+	"testing"
+)
+
+func TestCompareFdb(t *testing.T) {
+	gi := models.Interface{ID:5, Name:"GigabitEthernet0/1", Shortname:"Gi0/1"}
+	ifaces := map[string]models.Interface{gi.Name:gi, gi.Shortname:gi}
+	cs := newChangeset(models.Object{ID:1, Name:"sw1"})
+
+	err := compareFdb(cs, []*dproto.FdbEntry{
+		{Mac:"00-11-22-AA-BB-CC", Vlan:10, Interface:"Gi0/1"},
+		// the same entry, reported by full port name
+		{Mac:"00:11:22:aa:bb:cc", Vlan:10, Interface:"GigabitEthernet0/1"},
+		{Mac:"00:11:22:aa:bb:cd", Vlan:10, Interface:"Gi0/2"},
+	}, ifaces, models.Object{ID:1, Name:"sw1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cs.Fdb) != 2 {
+		t.Fatalf("unexpected FDB: %+v", cs.Fdb)
+	}
+	if e := cs.Fdb[0]; e.InterfaceID != 5 || e.Port != gi.Name || e.Mac != "00:11:22:aa:bb:cc" || !e.Active {
+		t.Errorf("entry is not resolved: %+v", e)
+	}
+	// port, that is not known yet, is resolved when changeset is applied
+	if e := cs.Fdb[1]; e.InterfaceID != 0 || e.Port != "Gi0/2" {
+		t.Errorf("unknown port entry: %+v", e)
+	}
+	if len(cs.Changes) != 0 {
+		t.Errorf("FDB is placed to changes: %+v", cs.Changes)
+	}
+}
@@ -1,28 +1,27 @@
 package taskparser
 
 import (
+	"fmt"
 	//"github.com/ircop/discoverer/dproto"
 	"github.com/ircop/dproto"
-	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/models"
-	"github.com/ircop/ohandler/db"
+	"github.com/go-pg/pg/orm"
 	"github.com/ircop/ohandler/logger"
 	"github.com/go-pg/pg"
-	"github.com/go-pg/pg/orm"
-	"github.com/ircop/ohandler/streamer"
+	"regexp"
+	"strings"
+	"time"
 )
 
 // todo: handle multiple interfaces with same name/shortname =\
 // done: db uniques
-func compareInterfaces(news map[string]*dproto.Interface, mo *handler.ManagedObject, dbo models.Object) {
-	var changes int64
-
+// Added interfaces are placed to ifaces without ID, so other sections can reference them.
+// Renamed interfaces are updated in place, so their links, vlans, ips and po members are kept.
+func compareInterfaces(tx orm.DB, cs *Changeset, news map[string]*dproto.Interface, ifaces map[string]models.Interface, dbo models.Object) error {
 	oldIfArr := make([]models.Interface, 0)
-	//oldPoArr := make([]models.PoMember, 0)
-	err := db.DB.Model(&oldIfArr).Where(`object_id = ?`, dbo.ID).Select()
+	err := tx.Model(&oldIfArr).Where(`object_id = ?`, dbo.ID).Select()
 	if err != nil && err != pg.ErrNoRows {
-		logger.Err("Failed to select object %d interfaces: %s", dbo.ID, err.Error())
-		return
+		return fmt.Errorf("Failed to select object interfaces: %s", err.Error())
 	}
 
 	newIfs := make(map[string]*dproto.Interface, len(news))
@@ -31,27 +30,53 @@ func compareInterfaces(news map[string]*dproto.Interface, mo *handler.ManagedObj
 	}
 
 	oldIfs := make(map[string]models.Interface, len(oldIfArr))
+	gone := make([]models.Interface, 0)
 	for _, i := range oldIfArr {
-		// check 1: loop over existing interfaces. Delete if there is no existing ifs in new ifs map.
 		oldIfs[i.Name] = i
 		if _, ok := newIfs[i.Name]; !ok {
-			logger.Update("%s: deleting interface %s", dbo.Name, i.Name)
-			changes++
-			if err = db.DB.Delete(&i); err != nil {
-				logger.Err("Failed to delete interface #%d (%s): %s", i.ID, i.Name, err.Error())
-				logger.Update("Failed to delete interface #%d (%s): %s", i.ID, i.Name, err.Error())
-			}
+			gone = append(gone, i)
 		}
 	}
-
-	// check 2: loop over new interfaces. Add if there is no new interface in olds map.
+	appeared := make([]*dproto.Interface, 0)
 	for name, iface := range newIfs {
-		//logger.Debug("-- NEWIFS.NAME: '%s'", name)
-		// todo: compare new+old interface params (descr, lldp id)
-		if old, ok := oldIfs[name]; !ok {
-			changes++
-			logger.Update("%s: adding interface %s", dbo.Name, iface.Name)
+		if _, ok := oldIfs[name]; !ok {
+			appeared = append(appeared, iface)
+		}
+	}
+	renames := matchRenames(gone, appeared)
+	renamedFrom := make(map[string]bool, len(renames))
+	for _, old := range renames {
+		renamedFrom[old.Name] = true
+	}
 
+	// check 1: loop over existing interfaces, that are gone and not renamed. Delete them.
+	for _, i := range gone {
+		if renamedFrom[i.Name] || inMaintenance(dbo, "interface " + i.Name) {
+			continue
+		}
+		old := i
+		cs.add(SectionInterfaces, OpDelete, i.Name, &old, nil, nil)
+	}
+
+	// check 2: loop over new interfaces. Rename or add if there is no new interface in olds map,
+	// or update changed params.
+	now := time.Now()
+	added := make([]models.Interface, 0)
+	renamed := make([]models.Interface, 0)
+	for name, iface := range newIfs {
+		if old, ok := renames[name]; ok {
+			updated := old
+			updated.Name = iface.Name
+			updated.Shortname = iface.Shortname
+			updated.Type = iface.Type.String()
+			updated.Description = iface.Description
+			updated.LldpID = iface.LldpID
+			if attrsReported(iface) {
+				setAttrs(&updated, iface, now)
+			}
+			cs.add(SectionInterfaces, OpUpdate, fmt.Sprintf("%s renamed to %s", old.Name, iface.Name), &old, &updated, nil)
+			renamed = append(renamed, updated)
+		} else if old, ok := oldIfs[name]; !ok {
 			newIf := models.Interface{
 				Name:iface.Name,
 				Shortname:iface.Shortname,
@@ -60,136 +85,222 @@ func compareInterfaces(news map[string]*dproto.Interface, mo *handler.ManagedObj
 				Description:iface.Description,
 				LldpID:iface.LldpID,
 			}
-			err := db.DB.Insert(&newIf)
-			if err != nil {
-				logger.Err("%s: Failed to insert interface %s: %s", dbo.Name, iface.Name, err.Error())
-				logger.Update("%s: Failed to insert interface %s: %s", dbo.Name, iface.Name, err.Error())
-
+			if attrsReported(iface) {
+				setAttrs(&newIf, iface, now)
 			}
+			cs.add(SectionInterfaces, OpAdd, iface.Name, nil, &newIf, nil)
+			added = append(added, newIf)
 		} else {
-			if iface.Description != old.Description || iface.LldpID != old.LldpID {
-				logger.Update("%s: updating lldpID/descr for %s", dbo.Name, iface.Name)
-				old.Description = iface.Description
-				old.LldpID = iface.LldpID
-				if err := db.DB.Update(&old); err != nil {
-					logger.Err("%s: Failed to update %s lldpID/descr: %s", dbo.Name, iface.Name, err.Error())
-					logger.Update("%s: Failed to update %s lldpID/descr: %s", dbo.Name, iface.Name, err.Error())
-				}
+			updated := old
+			updated.Description = iface.Description
+			updated.LldpID = iface.LldpID
+			if attrsReported(iface) {
+				setAttrs(&updated, iface, now)
+			}
+			if changed := changedFields(old, updated); len(changed) > 0 {
+				cs.add(SectionInterfaces, OpUpdate, iface.Name + " " + strings.Join(changed, "/"), &old, &updated, nil)
 			}
 		}
 	}
 
 	// PART II: parse port-channels
-	changes += parsePortchannels(news, mo, dbo)
+	planned := append(renamed, added...)
+	if err = parsePortchannels(tx, cs, news, ifaces, planned, dbo); err != nil {
+		return err
+	}
+
+	// old names of renamed interfaces are not valid anymore
+	for _, i := range renamed {
+		old := renames[i.Name]
+		delete(ifaces, old.Name)
+		delete(ifaces, old.Shortname)
+	}
+	for _, i := range planned {
+		ifaces[i.Name] = i
+		ifaces[i.Shortname] = i
+	}
+
+	return nil
+}
+
+// reIfPosition is numbering part of interface name: "1/0/1" of "Ethernet1/0/1"
+var reIfPosition = regexp.MustCompile(`\d+([/:.]\d+)*$`)
+
+// matchRenames pairs interfaces, that are gone, with appeared ones: by ifIndex first, then by LLDP port ID,
+// then by position (same type and numbering, like Ethernet1/0/1 and GigabitEthernet1/0/1).
+// Only unambiguous pairs are matched. Returns old interfaces by new name.
+func matchRenames(gone []models.Interface, appeared []*dproto.Interface) map[string]models.Interface {
+	renames := make(map[string]models.Interface)
+	matched := make(map[int64]bool)
+
+	match := func(oldKey func(models.Interface) string, newKey func(*dproto.Interface) string) {
+		olds := make(map[string][]models.Interface)
+		for _, i := range gone {
+			if k := oldKey(i); k != "" && !matched[i.ID] {
+				olds[k] = append(olds[k], i)
+			}
+		}
+		news := make(map[string][]*dproto.Interface)
+		for _, i := range appeared {
+			if _, ok := renames[i.Name]; ok {
+				continue
+			}
+			if k := newKey(i); k != "" {
+				news[k] = append(news[k], i)
+			}
+		}
+		for k, o := range olds {
+			if n := news[k]; len(o) == 1 && len(n) == 1 {
+				renames[n[0].Name] = o[0]
+				matched[o[0].ID] = true
+			}
+		}
+	}
 
-	if changes > 0 {
-		// broadcast object update
-		streamer.UpdateObject(dbo, false)
+	match(func(i models.Interface) string {
+		if i.IfIndex == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d", i.IfIndex)
+	}, func(i *dproto.Interface) string {
+		if ifIndex(i) == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%d", ifIndex(i))
+	})
+	match(func(i models.Interface) string {
+		return i.LldpID
+	}, func(i *dproto.Interface) string {
+		return i.LldpID
+	})
+	match(func(i models.Interface) string {
+		if pos := reIfPosition.FindString(i.Name); pos != "" {
+			return i.Type + " " + pos
+		}
+		return ""
+	}, func(i *dproto.Interface) string {
+		if pos := reIfPosition.FindString(i.Name); pos != "" {
+			return i.Type.String() + " " + pos
+		}
+		return ""
+	})
+
+	return renames
+}
+
+// changedFields returns names of changed interface params
+func changedFields(old models.Interface, new models.Interface) []string {
+	changed := make([]string, 0)
+	if old.Description != new.Description {
+		changed = append(changed, "descr")
+	}
+	if old.LldpID != new.LldpID {
+		changed = append(changed, "lldpID")
+	}
+	if old.AdminStatus != new.AdminStatus {
+		changed = append(changed, "admin")
+	}
+	if old.OperStatus != new.OperStatus {
+		changed = append(changed, "oper")
 	}
+	if old.Speed != new.Speed {
+		changed = append(changed, "speed")
+	}
+	if old.Duplex != new.Duplex {
+		changed = append(changed, "duplex")
+	}
+	if old.Mtu != new.Mtu {
+		changed = append(changed, "mtu")
+	}
+	if old.Mac != new.Mac {
+		changed = append(changed, "mac")
+	}
+	if old.IfIndex != new.IfIndex {
+		changed = append(changed, "ifIndex")
+	}
+	return changed
 }
 
 // todo: handle multiple PO members with same id =\
 // done: db uniques
-func parsePortchannels(news map[string]*dproto.Interface, mo *handler.ManagedObject, dbo models.Object) int64 {
-	var changes int64
+func parsePortchannels(tx orm.DB, cs *Changeset, news map[string]*dproto.Interface, ifaces map[string]models.Interface, planned []models.Interface, dbo models.Object) error {
+	// current and planned (added or renamed) interfaces
+	all := make(map[string]models.Interface, len(ifaces) + len(planned) * 2)
+	for name, i := range ifaces {
+		all[name] = i
+	}
+	for _, i := range planned {
+		all[i.Name] = i
+		all[i.Shortname] = i
+	}
 
-	for n, _ := range news {
+pos:
+	for n := range news {
 		iface := news[n]
 		if iface.Type != dproto.InterfaceType_AGGREGATED {
 			continue
 		}
 
-		/*
-		1: get po interface from DB
-		2: get member interfaces from DB by name/shortname
-		 */
-
-		// port-channel here
-		// select interface with this name:
-		var po models.Interface
-		err := db.DB.Model(&po).Where(`object_id = ?`, dbo.ID).
-			WhereGroup(func(q *orm.Query) (*orm.Query, error) {
-				q.Where(`name = ?`, iface.Name).WhereOr(`shortname = ?`, iface.Shortname)
-				return q, nil
-			}).Select()
-		if err != nil {
-			logger.Err("%s: cannot select port-channel '%s (%s)' from DB: %s", dbo.Name, iface.Name, iface.Shortname, err.Error())
+		po, ok := all[iface.Name]
+		if !ok {
+			po, ok = all[iface.Shortname]
+		}
+		if !ok {
+			logger.Err("%s: cannot find port-channel '%s (%s)'", dbo.Name, iface.Name, iface.Shortname)
 			continue
 		}
 
-		// get member interfaces from DB: they MUST be there
-		discoveredMembers := make(map[int64]models.Interface)	// just for simple search in hashmap
-		for i, _ := range iface.PoMembers {
-			name := iface.PoMembers[i]
-
-			// This interface should be present in DB
-			var dbIface models.Interface
-			err = db.DB.Model(&dbIface).Where(`object_id = ?`, dbo.ID).
-				WhereGroup(func(q *orm.Query) (*orm.Query, error) {
-					q.Where(`name = ?`, name).WhereOr(`shortname = ?`, name)
-					return q, nil
-				}).Select()
-			if err != nil {
-				logger.Err("%s: cannot select port-channel '%s' member iface '%s': %s", dbo.Name, iface.Name, name, err.Error())
-				return changes
+		// member interfaces MUST be there
+		discoveredMembers := make(map[string]models.Interface)	// by name, new interfaces have no ID
+		for _, name := range iface.PoMembers {
+			member, ok := all[name]
+			if !ok {
+				logger.Err("%s: cannot find port-channel '%s' member iface '%s'", dbo.Name, iface.Name, name)
+				continue pos
 			}
-			discoveredMembers[dbIface.ID] = dbIface
+			discoveredMembers[member.Name] = member
 		}
 
-		// got all interfaces from DB.
-		// Now we should select PoMembers from DB and compare with our ones.
-		DBMembers := make([]models.PoMember, len(discoveredMembers))
-		err = db.DB.Model(&DBMembers).
-			Where(`po_id = ?`, po.ID).Select()
-		if err != nil && err != pg.ErrNoRows {
-			logger.Err("%s: cannot select port-channel members for po %d: %s", dbo.Name, po.ID, err.Error())
-			return changes
+		// members of new port-channel are all new
+		dbMembersMap := make(map[int64]models.PoMember)
+		if po.ID != 0 {
+			DBMembers := make([]models.PoMember, 0)
+			err := tx.Model(&DBMembers).Where(`po_id = ?`, po.ID).Select()
+			if err != nil && err != pg.ErrNoRows {
+				return fmt.Errorf("cannot select port-channel members for po %d: %s", po.ID, err.Error())
+			}
+			for i := range DBMembers {
+				dbMembersMap[DBMembers[i].MemberID] = DBMembers[i]
+			}
 		}
-		// also make map
-		dbMembersMap := make(map[int64]models.PoMember, len(DBMembers))
-		for i, _ := range DBMembers {
-			dbMembersMap[DBMembers[i].MemberID] = DBMembers[i]
+		discoveredIDs := make(map[int64]bool, len(discoveredMembers))
+		for _, m := range discoveredMembers {
+			if m.ID != 0 {
+				discoveredIDs[m.ID] = true
+			}
 		}
 
-		// so for now we have:
-		// iface: current port-channel, as dproto.Interface
-		// po: current port-channel in DB
-		// discoveredMembers: map[member_interface_id]models.Interface
-		// dbMembersMap[member_interface_id]PoMember
-		// Next we need just compare them and make db stuff if needed
-
 		// first we will remove non-existing members from DB
 		for id, dbMember := range dbMembersMap {
-			if _, ok := discoveredMembers[id]; !ok {
-				changes++
-				// we did not discovered current member, so delete it from DB
-				logger.Update("%s: removing member %d from interface %s (%d)", dbo.Name, dbMember.MemberID, iface.Name, po.ID)
-				err := db.DB.Delete(&dbMember)
-				if err != nil && err != pg.ErrNoRows && err != pg.ErrMultiRows {
-					logger.Err("%s: failed to remove member %d from portchannel %s: %s", dbo.Name, dbMember.ID, po.Name, err.Error())
-					logger.Update("%s: failed to remove member %d from portchannel %s: %s", dbo.Name, dbMember.ID, po.Name, err.Error())
-					return changes
+			if !discoveredIDs[id] {
+				if inMaintenance(dbo, fmt.Sprintf("member %d of %s", dbMember.MemberID, po.Name)) {
+					continue
 				}
+				old := dbMember
+				cs.add(SectionPoMembers, OpDelete, fmt.Sprintf("member %d of %s", dbMember.MemberID, po.Name), &old, nil, nil)
 			}
 		}
 
-		// second, we should add to DB all discovered members, that are not exist in db yet
-		for id, discovered := range discoveredMembers {
-			if _, ok := dbMembersMap[id]; !ok {
-				changes++
-				logger.Update("%s: adding member %s (%d) to port-channel %s (%d)", dbo.Name, discovered.Name, discovered.ID, po.Name, po.ID)
-				newmember := models.PoMember{MemberID:discovered.ID, PoID:po.ID}
-				if err := db.DB.Insert(&newmember); err != nil {
-					logger.Err("%s: failed to insert new po (%s/%d) member (%s/%d): %s", dbo.Name, po.Name, po.ID, discovered.Name, discovered.ID, err.Error())
-					logger.Update("%s: failed to insert new po (%s/%d) member (%s/%d): %s", dbo.Name, po.Name, po.ID, discovered.Name, discovered.ID, err.Error())
-					return changes
-				}
+		// second, we should add all discovered members, that are not exist in db yet
+		for _, discovered := range discoveredMembers {
+			if _, ok := dbMembersMap[discovered.ID]; ok && discovered.ID != 0 {
+				continue
 			}
+			newmember := models.PoMember{MemberID:discovered.ID, PoID:po.ID}
+			refs := ref(ref(nil, "po_id", po), "member_id", discovered)
+			cs.add(SectionPoMembers, OpAdd, fmt.Sprintf("member %s of %s", discovered.Name, po.Name), nil, &newmember, refs)
 		}
-
-		// that's all, folks! lol
-		// todo: revork this stuff, its overcomplicated
 	}
 
-	return changes
+	return nil
 }
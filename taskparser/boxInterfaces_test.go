@@ -0,0 +1,37 @@
+package taskparser
+
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/models"
+	"testing"
+)
+
+func TestMatchRenames(t *testing.T) {
+	gone := []models.Interface{
+		{ID:1, Name:"Ethernet1/0/1", Type:"PHISYCAL"},
+		{ID:2, Name:"Ethernet1/0/2", Type:"PHISYCAL", IfIndex:2},
+		{ID:3, Name:"Ethernet1/0/3", Type:"PHISYCAL", LldpID:"port3"},
+		// two candidates for the same position
+		{ID:4, Name:"Vlan10", Type:"SVI"},
+		{ID:5, Name:"Vlanif10", Type:"SVI"},
+	}
+	appeared := []*dproto.Interface{
+		{Name:"GigabitEthernet1/0/1", Type:dproto.InterfaceType_PHISYCAL},
+		{Name:"GigabitEthernet1/0/30", Type:dproto.InterfaceType_PHISYCAL, LldpID:"port3"},
+		{Name:"VLAN10", Type:dproto.InterfaceType_SVI},
+	}
+
+	renames := matchRenames(gone, appeared)
+	expected := map[string]int64{
+		"GigabitEthernet1/0/1":1,
+		"GigabitEthernet1/0/30":3,
+	}
+	if len(renames) != len(expected) {
+		t.Fatalf("got renames %v, expected %v", renames, expected)
+	}
+	for name, id := range expected {
+		if renames[name].ID != id {
+			t.Errorf("%s is renamed from #%d, expected #%d", name, renames[name].ID, id)
+		}
+	}
+}
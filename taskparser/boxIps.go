@@ -2,10 +2,9 @@ package taskparser
 
 import (
 	"github.com/ircop/dproto"
-	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/logger"
 	"github.com/ircop/ohandler/models"
-	"github.com/ircop/ohandler/db"
+	"github.com/go-pg/pg/orm"
 	"net"
 	"fmt"
 	"strings"
@@ -19,19 +18,11 @@ TODO on db triggers:
  */
 
 // parse, compare, store, delete ip interfaces
-func processIpifs(discovered []*dproto.Ipif, mo *handler.ManagedObject, dbo models.Object) {
-	// 1: get ifnames: map[ifname]interface ; map[shortname]interface
-	dbIfs, err := getIfnamesAll(dbo)
-	if err != nil {
-		logger.Err("%s: processIpifs: cannot get interface names: %s", dbo.Name, err.Error())
-		return
-	}
-
+func processIpifs(tx orm.DB, cs *Changeset, discovered []*dproto.Ipif, dbIfs map[string]models.Interface, dbo models.Object) error {
 	// get DB ip addresses for this object.
 	var dbIps []models.Ipif
-	if err = db.DB.Model(&dbIps).Where(`object_id = ?`, dbo.ID).Select(); err != nil {
-		logger.Err("%s: cannot select DB ip addresses for object: %s", dbo.Name, err.Error())
-		return
+	if err := tx.Model(&dbIps).Where(`object_id = ?`, dbo.ID).Select(); err != nil {
+		return fmt.Errorf("cannot select DB ip addresses for object: %s", err.Error())
 	}
 	// map[ipCidr]ipif
 	dbMap := make(map[string]models.Ipif)
@@ -47,7 +38,6 @@ func processIpifs(discovered []*dproto.Ipif, mo *handler.ManagedObject, dbo mode
 	// step 1: add discovered ipifs, that are not in db yet
 	for i, _ := range discovered {
 		iface := discovered[i]
-		//logger.Debug("%+#v\n", discovered[i])
 		dbIf, ok := dbIfs[iface.Interface]
 		if !ok {
 			logger.Err("%s: ipif '%s': cannot find this interface in DB interfaces!", dbo.Name, iface.Interface)
@@ -73,39 +63,29 @@ func processIpifs(discovered []*dproto.Ipif, mo *handler.ManagedObject, dbo mode
 				Type:models.IpifType_DISCOVERED.String(),
 				Description:"",
 			}
-			logger.Update("%s: Adding IP interface %s to %s", dbo.Name, ipstring, dbIf.Name)
-			if err = db.DB.Insert(&newone); err != nil {
-				logger.Update("%s: Failed to insert interface %s: %s", dbo.Name, ipstring, err.Error())
-				logger.Err("%s: Failed to insert interface %s: %s", dbo.Name, ipstring, err.Error())
-				return
-			}
+			cs.add(SectionIps, OpAdd, fmt.Sprintf("%s on %s", ipstring, dbIf.Name), nil, &newone, ref(nil, "interface_id", dbIf))
 			continue
 		}
-		if ok {
-			// there is already such IPIF in db. Compare interface and fix if needed.
-			if dbIf.ID != dbip.InterfaceID {
-				logger.Update("%s: moving IP interface %s to interface %s", dbo.Name, ipstring, dbIf.Name)
-				dbip.InterfaceID = dbIf.ID
-				if err = db.DB.Update(&dbip); err != nil {
-					logger.Err("%s: Failed to update IPIF interface: %s", dbo.Name, err.Error())
-					logger.Update("%s: Failed to update IPIF interface: %s", dbo.Name, err.Error())
-					return
-				}
-			}
+		// there is already such IPIF in db. Compare interface and fix if needed.
+		if dbIf.ID != dbip.InterfaceID {
+			old := dbip
+			dbip.InterfaceID = dbIf.ID
+			cs.add(SectionIps, OpUpdate, fmt.Sprintf("%s to %s", ipstring, dbIf.Name), &old, &dbip, ref(nil, "interface_id", dbIf))
 		}
 	}
 
 	// step 2: remove DB ipifs, that was not discovered (i.e. deleted from device)
 	for ipstring, ipif  := range dbMap {
 		if _, ok := discMap[ipstring]; !ok {
-			logger.Update("%s: removing ip interface %s from DB", dbo.Name, ipstring)
-			if err = db.DB.Delete(&ipif); err != nil {
-				logger.Err("%s: failed to remove ipif %s: %s", dbo.Name, ipstring, err.Error())
-				logger.Update("%s: failed to remove ipif %s: %s", dbo.Name, ipstring, err.Error())
-				return
+			if inMaintenance(dbo, "ip interface " + ipstring) {
+				continue
 			}
+			old := ipif
+			cs.add(SectionIps, OpDelete, ipstring, &old, nil, nil)
 		}
 	}
+
+	return nil
 }
 
 func mask2bits(s string) (int,error) {
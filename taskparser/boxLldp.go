@@ -5,14 +5,15 @@ import (
 	"github.com/go-pg/pg/orm"
 	"github.com/ircop/dproto"
 	"github.com/ircop/discoverer/util/mac"
-	"github.com/ircop/ohandler/db"
-	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/logger"
 	"github.com/ircop/ohandler/models"
-	"github.com/pkg/errors"
+	"fmt"
+	"github.com/ircop/ohandler/handler"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 /*
@@ -20,17 +21,31 @@ Parse LldpNeighbors discovered:
 1) find all this neighbors chassis/port IDs in DB (chassis ID, port ID)
 2) ensure LldpNeighborship is in db
 3) also remove non-existant neighbors!
-- assuming ChassisID is macaddr, and PortID is either port mac or port name
+- chassis and port IDs are matched by rules of object discovery profile (see findChassis, findPort)
  */
-func compareLldp(neighbors []*dproto.LldpNeighbor, mo *handler.ManagedObject, dbo models.Object) {
-	reMac, err := regexp.Compile(`^(?i:)[a-f0-9]{4}\-[a-f0-9]{4}\-[a-f0-9]{4}$`)
-	if err != nil {
-		logger.Err("Cannot compile huawei mac regex: %s", err.Error())
-		return
+func compareLldp(tx orm.DB, cs *Changeset, neighbors []*dproto.LldpNeighbor, ifaces map[string]models.Interface, dbo models.Object) error {
+	chassisRules, portRules := models.DefaultChassisRules, models.DefaultPortRules
+	if dpInt, ok := handler.DiscoveryProfiles.Load(dbo.DiscoveryID); ok {
+		dp := dpInt.(models.DiscoveryProfile)
+		chassisRules, portRules = dp.LldpChassisRules(), dp.LldpPortRules()
 	}
 
 	// map that will handle found, discovered, checked, existant in DB, neighborships
 	discovered := make([]models.LldpNeighbor, 0)
+	// local ports, that are added by this changeset, by index in discovered
+	newPorts := make(map[int]models.Interface)
+	// neighbors, that are not in inventory (or their ports are not)
+	unresolved := make([]models.UnresolvedNeighbor, 0)
+	// the same neighbor may be reported twice, but it's stored once
+	seenUnresolved := make(map[string]bool)
+	addUnresolved := func(n models.UnresolvedNeighbor) {
+		key := fmt.Sprintf("%s %s %s", n.LocalPort, n.ChassisID, n.PortID)
+		if seenUnresolved[key] {
+			return
+		}
+		seenUnresolved[key] = true
+		unresolved = append(unresolved, n)
+	}
 
 	// make small map [chassisID]neighborID for not to select same information from DB multiple times
 	neis := make(map[string]int64)
@@ -42,64 +57,37 @@ func compareLldp(neighbors []*dproto.LldpNeighbor, mo *handler.ManagedObject, db
 		}
 
 		// 0: find LOCAL port
-		var localPort models.Interface
-		err := db.DB.Model(&localPort).Where(`object_id = ?`, dbo.ID).
-			WhereGroup(func(q *orm.Query) (*orm.Query, error) {
-				q.Where(`name = ?`, instance.LocalPort).
-					WhereOr(`shortname = ?`, instance.LocalPort)
-				return q, nil
-			}).Select()
-		if err != nil {
-			logger.Err("%s: Failed to select local interface '%s': %s", dbo.Name, instance.LocalPort, err.Error())
-			continue
-		}
-
-		// 1: try to find this chassis + port in DB
-		if reMac.Match([]byte(instance.ChassisID)) {
-			instance.ChassisID = strings.Replace(instance.ChassisID, "-", ".", -1)
-		}
-
-		cidMac, err := net.ParseMAC(instance.ChassisID)
-		if err != nil || cidMac == nil {
-			logger.Err("%s: Cannot parse neighbor chassis ID as mac (%s)", dbo.Name, instance.ChassisID)
+		localPort, ok := ifaces[instance.LocalPort]
+		if !ok {
+			logger.Err("%s: Failed to find local interface '%s'", dbo.Name, instance.LocalPort)
 			continue
 		}
 
-		// try to find chassis by mac in DB
-		var neighborID int64
-		if id, ok := neis[cidMac.String()]; ok {
-			neighborID = id
-		} else {
-			var cmak models.ObjectMac
-			if err = db.DB.Model(&cmak).Where(`mac = ?`, cidMac.String()).Select(); err != nil && err != pg.ErrNoRows {
-				logger.Err("%s: Cannot select neighbor mac '%s' from object_macs db: %s", dbo.Name, cidMac.String(), err.Error())
+		// 1: try to find this chassis in DB
+		neighborID, ok := neis[instance.ChassisID]
+		if !ok {
+			var err error
+			if neighborID, err = findChassis(tx, instance.ChassisID, chassisRules); err != nil {
+				logger.Err("%s: Cannot find neighbor chassis '%s': %s", dbo.Name, instance.ChassisID, err.Error())
 				continue
 			}
-			if err != nil && err == pg.ErrNoRows {
-				logger.Debug("%s: Cannot find neighbot by chassis id '%s' on port '%s'", dbo.Name, cidMac.String(), localPort.Name)
-				continue
-			}
-			neighborID = cmak.ObjectID
+			neis[instance.ChassisID] = neighborID
 		}
-
-		portID := instance.PortID
-		if Mac.IsMac(instance.PortID) {
-			portID = Mac.New(instance.PortID).String()
+		if neighborID == 0 {
+			logger.Debug("%s: Cannot find neighbot by chassis id '%s' on port '%s'", dbo.Name, instance.ChassisID, localPort.Name)
+			addUnresolved(unresolvedNeighbor(dbo, localPort, instance, 0))
+			continue
 		}
+
 		// neighbor found in DB. Next try to find port.
-		var remoteIF models.Interface
-		if err = db.DB.Model(&remoteIF).Where(`object_id = ?`, neighborID).
-			WhereGroup(func(q *orm.Query) (*orm.Query, error) {
-				q.Where(`lldp_id = ?`, portID).
-					WhereOr(`shortname = ?`, portID).
-					WhereOr(`name = ?`, portID)
-				return q, nil
-			}).Select(); err != nil && err != pg.ErrNoRows {
-				logger.Err("%s: Failed to select neighbor port '%s' in db: %s", instance.PortID, err.Error())
-				continue
-			}
-		if err != nil && err == pg.ErrNoRows {
-			logger.Debug("%s: Port id '%s' (for neighbor %d on port %s) not found in DB: %s", dbo.Name, instance.PortID, neighborID, instance.LocalPort, err.Error())
+		remoteIF, err := findPort(tx, neighborID, instance.PortID, portRules)
+		if err != nil {
+			logger.Err("%s: Failed to select neighbor port '%s' in db: %s", dbo.Name, instance.PortID, err.Error())
+			continue
+		}
+		if remoteIF == nil {
+			logger.Debug("%s: Port id '%s' (for neighbor %d on port %s) not found in DB", dbo.Name, instance.PortID, neighborID, instance.LocalPort)
+			addUnresolved(unresolvedNeighbor(dbo, localPort, instance, neighborID))
 			continue
 		}
 
@@ -113,6 +101,9 @@ func compareLldp(neighbors []*dproto.LldpNeighbor, mo *handler.ManagedObject, db
 			NeighborID:neighborID,
 			NeighborInterfaceID:remoteIF.ID,
 		}
+		if localPort.ID == 0 {
+			newPorts[len(discovered)] = localPort
+		}
 		discovered = append(discovered, n)
 	}
 
@@ -124,18 +115,18 @@ func compareLldp(neighbors []*dproto.LldpNeighbor, mo *handler.ManagedObject, db
 	// ? todo: ? Maybe we should not remove this neighborshpis at all?
 	// ? todo: ? We will make _LINKS_, and LINKS should be keept up-to-dated, but not unconfirmed neighborships
 	var dbNeighbors []models.LldpNeighbor
-	err = db.DB.Model(&dbNeighbors).Where(`object_id = ?`, dbo.ID).Select()
+	err := tx.Model(&dbNeighbors).Where(`object_id = ?`, dbo.ID).Select()
 	if err != nil && err != pg.ErrNoRows {
-		logger.Err("%s: Failed to select existing lldp neighbors from DB: %s", dbo.Name, err.Error())
-		return
+		return fmt.Errorf("Failed to select existing lldp neighbors from DB: %s", err.Error())
 	}
 
 	// add non-existing interfaces
-	for i, _ := range discovered {
+	for i := range discovered {
 		nei := discovered[i]
 		found := false
-		for j, _ := range dbNeighbors {
-			if dbNeighbors[j].NeighborID == nei.NeighborID &&
+		for j := range dbNeighbors {
+			if nei.LocalInterfaceID != 0 &&
+				dbNeighbors[j].NeighborID == nei.NeighborID &&
 				dbNeighbors[j].LocalInterfaceID == nei.LocalInterfaceID &&
 				dbNeighbors[j].NeighborInterfaceID == nei.NeighborInterfaceID {
 					found = true
@@ -143,20 +134,40 @@ func compareLldp(neighbors []*dproto.LldpNeighbor, mo *handler.ManagedObject, db
 			}
 		}
 		if !found {
-			logger.Update("%s: Adding new LLDP neighbor for port id %d (nei %d/port %d)", dbo.Name, nei.LocalInterfaceID, nei.NeighborID, nei.NeighborInterfaceID)
-			err = db.DB.Insert(&nei)
-			if err != nil {
-				logger.Err("%s: Failed to insert new lldp neighbor (localport, nei, neiport = %d/%d/%d): %s", dbo.Name, nei.LocalInterfaceID, nei.NeighborID, nei.NeighborInterfaceID, err.Error())
-				logger.Update("%s: Failed to insert new lldp neighbor (localport, nei, neiport = %d/%d/%d): %s", dbo.Name, nei.LocalInterfaceID, nei.NeighborID, nei.NeighborInterfaceID, err.Error())
-				return
+			local := fmt.Sprintf("%d", nei.LocalInterfaceID)
+			var refs map[string]string
+			if port, ok := newPorts[i]; ok {
+				local = port.Name
+				refs = ref(nil, "local_interface_id", port)
 			}
+			cs.add(SectionLldp, OpAdd, fmt.Sprintf("port %s: nei %d/port %d", local, nei.NeighborID, nei.NeighborInterfaceID), nil, &nei, refs)
 		}
 	}
 
 	// todo: maybe we should add 'trash' timer for non-existing neighbors? Something like `updated_at` column.
 	// todo: No. We should remove non-existing interfaces always, but ONLY IF THERE IS NOT LINKS for them.
 	// todo: So first we should deal with links.
-	processLinks(discovered, mo, dbo)
+	// new local ports have no opposite neighborships yet
+	known := make([]models.LldpNeighbor, 0, len(discovered))
+	for i := range discovered {
+		if discovered[i].LocalInterfaceID != 0 {
+			known = append(known, discovered[i])
+		}
+	}
+	cs.Unresolved = unresolved
+
+	return processLinks(tx, cs, known, dbo)
+}
+
+func unresolvedNeighbor(dbo models.Object, localPort models.Interface, n *dproto.LldpNeighbor, neighborID int64) models.UnresolvedNeighbor {
+	return models.UnresolvedNeighbor{
+		ObjectID:dbo.ID,
+		LocalInterfaceID:localPort.ID,
+		LocalPort:localPort.Name,
+		ChassisID:n.ChassisID,
+		PortID:n.PortID,
+		NeighborID:neighborID,
+	}
 }
 
 // Handle links stuff.
@@ -170,23 +181,24 @@ func compareLldp(neighbors []*dproto.LldpNeighbor, mo *handler.ManagedObject, db
 // 2: if it doesnt exist, just 'continue'.
 // 3: if exist, search actual link.
 // N: select all db links for this object
-func processLinks(neighbors []models.LldpNeighbor, mo *handler.ManagedObject, dbo models.Object) {
-	for i, _ := range neighbors{
-		//if dbo.Name == "J1" {
-		//	logger.Debug("PROCESSING J1 link: %+#v", neighbors[i])
-		//}
+func processLinks(tx orm.DB, cs *Changeset, neighbors []models.LldpNeighbor, dbo models.Object) error {
+	// links, planned to be deleted, by ID: one link may conflict with several neighborships
+	deleted := make(map[int64]bool)
+	confirmed := make(map[int64]bool)
+	conflicts := make([]models.LinkConflict, 0)
+	now := time.Now()
+
+	for i := range neighbors {
 		nei := neighbors[i]
 		// try to select 'remote' lldp neighbor
 		// if there is no opposite LLDP record, just skip this neighbor.
 		// link will be build if opposite neighbor will
-		//logger.Debug("%s: searching opposite lldp neighbor for cid/pid %s/%s on port %s...", dbo.Name, )
 		var remote models.LldpNeighbor
-		err := db.DB.Model(&remote).Where(`neighbor_id = ?`, dbo.ID).Where(`neighbor_interface_id = ?`, nei.LocalInterfaceID).
+		err := tx.Model(&remote).Where(`neighbor_id = ?`, dbo.ID).Where(`neighbor_interface_id = ?`, nei.LocalInterfaceID).
 			Where(`object_id = ?`, nei.NeighborID).Where(`local_interface_id = ?`, nei.NeighborInterfaceID).
 			Select()
 		if err != nil && err != pg.ErrNoRows {
-			logger.Err("%s: failed to select opposite lldp neighborship for #%d: %s", dbo.Name, nei.ID, err.Error())
-			continue
+			return fmt.Errorf("failed to select opposite lldp neighborship for port %d: %s", nei.LocalInterfaceID, err.Error())
 		}
 		if err != nil && err == pg.ErrNoRows {
 			continue
@@ -200,64 +212,205 @@ func processLinks(neighbors []models.LldpNeighbor, mo *handler.ManagedObject, db
 		// 2: check if there is another links a) for local interface, b) for remote interface. Delete them.
 		// 3: insert new link.
 		var existingLink models.Link
-		err = db.DB.Model(&existingLink).
+		err = tx.Model(&existingLink).
 			WhereGroup(func(q *orm.Query) (*orm.Query, error) {
-				q.Where(`int1_id = ?`, nei.LocalInterfaceID).Where(`int2_id = ?`, nei.NeighborInterfaceID).Select()
+				q.Where(`int1_id = ?`, nei.LocalInterfaceID).Where(`int2_id = ?`, nei.NeighborInterfaceID)
 				return q, nil
 			}).
 			WhereOrGroup(func(q *orm.Query) (*orm.Query, error) {
-				q.Where(`int2_id = ?`, nei.LocalInterfaceID).Where(`int1_id = ?`, nei.NeighborInterfaceID).Select()
+				q.Where(`int2_id = ?`, nei.LocalInterfaceID).Where(`int1_id = ?`, nei.NeighborInterfaceID)
 				return q, nil
 			}).
 			Select()
 
 		if err != nil && err != pg.ErrNoRows {
-			logger.Err("%s: failed to search existing links for local/remote interfaces '%d/%d' in db: %s", dbo.Name, nei.LocalInterfaceID, nei.NeighborInterfaceID, err.Error())
-			continue
+			return fmt.Errorf("failed to search existing links for local/remote interfaces '%d/%d' in db: %s", nei.LocalInterfaceID, nei.NeighborInterfaceID, err.Error())
 		}
 		if err == nil {
-			// we have existing link, nothing to do here.
+			// we have existing link, it's confirmed now.
+			confirmed[existingLink.ID] = true
 			continue
 		}
 
-
-		//logger.Debug("%s: We have NO link between: int1_id=%d + int2=%d OR int2=%d + int1=%d", dbo.Name, nei.LocalInterfaceID, nei.NeighborInterfaceID, nei.LocalInterfaceID, nei.NeighborInterfaceID)
-		//continue
 		// We HAVE NO link with this ports. We will:
-		// a) start transaction
-		// b) find/remove all links for local port and for remote port
-		// c) create link local<->remote ports
-		// todo: bug. current link is also removed.
-		logger.Update("%s: Adding link to %d:%d", dbo.Name, nei.NeighborID, nei.NeighborInterfaceID)
-		txerr := db.DB.RunInTransaction(func(tx *pg.Tx) error {
-			_, err := db.DB.Model(&models.Link{}).
-				Where(`int1_id = ?`, nei.LocalInterfaceID).
-				WhereOr(`int1_id = ?`, nei.NeighborInterfaceID).
-				WhereOr(`int2_id = ?`, nei.LocalInterfaceID).
-				WhereOr(`int2_id = ?`, nei.NeighborInterfaceID).
-				Delete()
-			if err != nil {
-				return errors.Wrap(err, "Error deleting unconsistent links")
+		// a) remove all links for local port and for remote port, unless one of them is manual
+		// b) create link local<->remote ports
+		if inMaintenance(dbo, fmt.Sprintf("links of interfaces %d/%d", nei.LocalInterfaceID, nei.NeighborInterfaceID)) {
+			continue
+		}
+		olds := make([]models.Link, 0)
+		err = tx.Model(&olds).
+			Where(`int1_id = ?`, nei.LocalInterfaceID).
+			WhereOr(`int1_id = ?`, nei.NeighborInterfaceID).
+			WhereOr(`int2_id = ?`, nei.LocalInterfaceID).
+			WhereOr(`int2_id = ?`, nei.NeighborInterfaceID).
+			Select()
+		if err != nil && err != pg.ErrNoRows {
+			return fmt.Errorf("failed to select unconsistent links: %s", err.Error())
+		}
+
+		// manual links are not replaced: conflict is reported instead
+		manual := int64(0)
+		for j := range olds {
+			if olds[j].LinkType == models.LinkTypeManual {
+				manual = olds[j].ID
+				break
 			}
+		}
+		if manual != 0 {
+			logger.Err("%s: LLDP adjacency of port %d with %d:%d conflicts with manual link %d", dbo.Name, nei.LocalInterfaceID, nei.NeighborID, nei.NeighborInterfaceID, manual)
+			conflicts = append(conflicts, models.LinkConflict{
+				ObjectID:dbo.ID,
+				LocalInterfaceID:nei.LocalInterfaceID,
+				NeighborID:nei.NeighborID,
+				NeighborInterfaceID:nei.NeighborInterfaceID,
+				LinkID:manual,
+			})
+			continue
+		}
 
-			link := models.Link{
-				Object1ID:nei.ObjectID,
-				Int1ID:nei.LocalInterfaceID,
-				Object2ID:nei.NeighborID,
-				Int2ID:nei.NeighborInterfaceID,
-				LinkType:"LLDP",
+		for j := range olds {
+			if deleted[olds[j].ID] {
+				continue
 			}
-			err = db.DB.Insert(&link)
-			if err != nil {
-				return errors.Wrap(err, "Error creating link")
+			deleted[olds[j].ID] = true
+			old := olds[j]
+			cs.add(SectionLinks, OpDelete, fmt.Sprintf("%d:%d - %d:%d", old.Object1ID, old.Int1ID, old.Object2ID, old.Int2ID), &old, nil, nil)
+		}
+
+		link := models.Link{
+			Object1ID:nei.ObjectID,
+			Int1ID:nei.LocalInterfaceID,
+			Object2ID:nei.NeighborID,
+			Int2ID:nei.NeighborInterfaceID,
+			LinkType:models.LinkTypeLldp,
+			LastConfirmedAt:&now,
+		}
+		cs.add(SectionLinks, OpAdd, fmt.Sprintf("%d:%d - %d:%d", link.Object1ID, link.Int1ID, link.Object2ID, link.Int2ID), nil, &link, nil)
+	}
+
+	// LLDP links of object, that are not seen by any of their ends for too long
+	if LinkMaxAge > 0 {
+		stale, err := models.LinksStale(tx, dbo.ID, now.Add(-LinkMaxAge))
+		if err != nil {
+			return fmt.Errorf("failed to select stale links: %s", err.Error())
+		}
+		for j := range stale {
+			old := stale[j]
+			if deleted[old.ID] || confirmed[old.ID] {
+				continue
+			}
+			if inMaintenance(dbo, fmt.Sprintf("stale link %d", old.ID)) {
+				continue
 			}
+			deleted[old.ID] = true
+			cs.add(SectionLinks, OpDelete, fmt.Sprintf("%d:%d - %d:%d: not confirmed since %s", old.Object1ID, old.Int1ID, old.Object2ID, old.Int2ID, old.LastConfirmedAt.Format("2006-01-02 15:04")), &old, nil, nil)
+		}
+	}
+
+	cs.ConfirmedLinks = make([]int64, 0, len(confirmed))
+	for id := range confirmed {
+		if !deleted[id] {
+			cs.ConfirmedLinks = append(cs.ConfirmedLinks, id)
+		}
+	}
+	cs.LinkConflicts = conflicts
 
-			return nil
-		})
-		if txerr != nil {
-			logger.Err("%s: Failed to insert new link: %s", dbo.Name, err.Error())
+	return nil
+}
+
+// LinkMaxAge is period, after which LLDP links, not confirmed by discovery, are removed. Zero means never.
+var LinkMaxAge time.Duration
+
+var reHuaweiMac = regexp.MustCompile(`^(?i:)[a-f0-9]{4}\-[a-f0-9]{4}\-[a-f0-9]{4}$`)
+
+// findChassis returns ID of neighbor object, found by LLDP chassis ID with first matching rule, or 0.
+// Rule matches, if it gives exactly one object.
+func findChassis(tx orm.DB, chassisID string, rules []string) (int64, error) {
+	ip := net.ParseIP(chassisID)
+	for _, rule := range rules {
+		var ids []int64
+		var err error
+		switch rule {
+		case models.ChassisMac:
+			cid := chassisID
+			if reHuaweiMac.MatchString(cid) {
+				cid = strings.Replace(cid, "-", ".", -1)
+			}
+			cidMac, e := net.ParseMAC(cid)
+			if e != nil {
+				continue
+			}
+			_, err = tx.Query(&ids, `SELECT DISTINCT object_id FROM object_macs WHERE mac = ?`, cidMac.String())
+		case models.ChassisName:
+			// hostname could be fqdn, while object is named by host only
+			host := strings.TrimSuffix(chassisID, ".")
+			short := host
+			if ip == nil {
+				short = strings.SplitN(host, ".", 2)[0]
+			}
+			_, err = tx.Query(&ids, `SELECT id FROM objects WHERE lower(name) = lower(?) OR lower(name) = lower(?)`, host, short)
+		case models.ChassisMgmt:
+			if ip == nil {
+				continue
+			}
+			_, err = tx.Query(&ids, `SELECT id FROM objects WHERE mgmt = ?`, ip.String())
+		case models.ChassisIpif:
+			if ip == nil {
+				continue
+			}
+			_, err = tx.Query(&ids, `SELECT DISTINCT object_id FROM ips WHERE split_part(addr, '/', 1) = ?`, ip.String())
+		default:
 			continue
 		}
+		if err != nil {
+			return 0, err
+		}
+		if len(ids) == 1 {
+			return ids[0], nil
+		}
 	}
+
+	return 0, nil
 }
 
+// findPort returns neighbor interface, found by LLDP port ID with first matching rule, or nil.
+// Rule matches, if it gives exactly one interface.
+func findPort(tx orm.DB, neighborID int64, portID string, rules []string) (*models.Interface, error) {
+	for _, rule := range rules {
+		var found []models.Interface
+		q := tx.Model(&found).Where(`object_id = ?`, neighborID)
+		switch rule {
+		case models.PortLldpID:
+			id := portID
+			if Mac.IsMac(portID) {
+				id = Mac.New(portID).String()
+			}
+			q.Where(`lldp_id = ?`, id)
+		case models.PortName:
+			q.WhereGroup(func(q *orm.Query) (*orm.Query, error) {
+				q.Where(`shortname = ?`, portID).WhereOr(`name = ?`, portID)
+				return q, nil
+			})
+		case models.PortIfIndex:
+			ifIndex, err := strconv.ParseInt(portID, 10, 64)
+			if err != nil || ifIndex <= 0 {
+				continue
+			}
+			q.Where(`if_index = ?`, ifIndex)
+		case models.PortDescription:
+			q.Where(`description = ?`, portID)
+		default:
+			continue
+		}
+
+		if err := q.Limit(2).Select(); err != nil && err != pg.ErrNoRows {
+			return nil, err
+		}
+		if len(found) == 1 {
+			return &found[0], nil
+		}
+	}
+
+	return nil, nil
+}
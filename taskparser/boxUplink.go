@@ -1,55 +1,37 @@
 package taskparser
 
 import (
-	"fmt"
-	"github.com/go-pg/pg"
-	"github.com/go-pg/pg/orm"
-	"github.com/ircop/ohandler/db"
-	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/logger"
 	"github.com/ircop/ohandler/models"
 )
 
-func processUplink(uplink string, mo *handler.ManagedObject, dbo models.Object) {
-	// select this interface from BD and compare with current set uplink
+func processUplink(cs *Changeset, uplink string, ifaces map[string]models.Interface, dbo models.Object) error {
+	// compare interface with current set uplink
 	if uplink == "" && dbo.UplinkID == 0 {
-		return
+		return nil
 	}
-	if uplink == "" && dbo.UplinkID != 0 {
-		logger.UpdateFormatted(dbo.Name, "Uplink", fmt.Sprintf("%d", dbo.UplinkID), "")
-		dbo.UplinkID = 0
-		err := db.DB.Update(&dbo)
-		if err != nil {
-			logger.Update("%s: Failed to update uplink: %s", dbo.Name, err.Error())
-			logger.Err("%s: Failed to update uplink: %s", dbo.Name, err.Error())
-			return
+	old := Uplink{InterfaceID:dbo.UplinkID}
+	for _, i := range ifaces {
+		if i.ID == dbo.UplinkID {
+			old.Name = i.Name
+			break
 		}
-		return
 	}
 
-	var iface models.Interface
-	err := db.DB.Model(&iface).Where(`object_id = ?`, dbo.ID).
-		WhereGroup(func(q *orm.Query) (*orm.Query, error) {
-			q.Where(`name = ?`, uplink).WhereOr(`shortname = ?`, uplink)
-			return q, nil
-		}).Select()
-	if err != nil && err != pg.ErrNoRows {
-		logger.Err("%s: Failed to select uplink interface '%s': %s", dbo.Name, uplink, err.Error())
-		return
+	if uplink == "" && dbo.UplinkID != 0 {
+		cs.add(SectionUplink, OpUpdate, "none", &old, &Uplink{}, nil)
+		return nil
 	}
-	if err == pg.ErrNoRows {
+
+	iface, ok := ifaces[uplink]
+	if !ok {
 		logger.Err("%s: Failed to find uplink interface '%s'", dbo.Name, uplink)
-		return
+		return nil
 	}
 
-	if iface.ID != dbo.UplinkID {
-		logger.UpdateFormatted(dbo.Name, "Uplink", fmt.Sprintf("%d", dbo.UplinkID), uplink)
-		dbo.UplinkID = iface.ID
-		err = db.DB.Update(&dbo)
-		if err != nil {
-			logger.Update("%s: Failed to update uplink: %s", dbo.Name, err.Error())
-			logger.Err("%s: Failed to update uplink: %s", dbo.Name, err.Error())
-			return
-		}
+	if iface.ID != dbo.UplinkID || iface.ID == 0 {
+		cs.add(SectionUplink, OpUpdate, iface.Name, &old, &Uplink{InterfaceID:iface.ID, Name:iface.Name}, ref(nil, "interface_id", iface))
 	}
+
+	return nil
 }
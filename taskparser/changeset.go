@@ -0,0 +1,566 @@
+package taskparser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/models"
+	"github.com/ircop/ohandler/streamer"
+	"reflect"
+	"time"
+)
+
+type Op string
+
+const (
+	OpAdd		Op = "add"
+	OpUpdate	Op = "update"
+	OpDelete	Op = "delete"
+)
+
+// Changeset sections. Changes are computed and applied in this order: interfaces are added before
+// anything that references them.
+const (
+	SectionPlatform		= "platform"
+	SectionMacs			= "macs"
+	SectionInterfaces	= "interfaces"
+	SectionPoMembers	= "po_members"
+	SectionLldp			= "lldp"
+	SectionLinks		= "links"
+	SectionVlans		= "vlans"
+	SectionIps			= "ips"
+	SectionUplink		= "uplink"
+	SectionConfig		= "config"
+)
+
+// names of dproto FDB and ARP tasks: their types are built with 'dprotonext' tag only
+const (
+	taskFdb	= "FDB"
+	taskArp	= "ARP"
+)
+
+// sectionTask is dproto task, that discovers section
+var sectionTask = map[string]dproto.TaskType{
+	SectionPlatform:dproto.TaskType_PLATFORM,
+	SectionMacs:dproto.TaskType_PLATFORM,
+	SectionInterfaces:dproto.TaskType_INTERFACES,
+	SectionPoMembers:dproto.TaskType_INTERFACES,
+	SectionLldp:dproto.TaskType_LLDP,
+	SectionLinks:dproto.TaskType_LLDP,
+	SectionVlans:dproto.TaskType_VLANS,
+	SectionIps:dproto.TaskType_IPS,
+	SectionUplink:dproto.TaskType_UPLINK,
+	SectionConfig:dproto.TaskType_CONFIG,
+}
+
+// sectionEntity is entity of section rows in change events
+var sectionEntity = map[string]string{
+	SectionPlatform:"platform",
+	SectionMacs:"mac",
+	SectionInterfaces:"interface",
+	SectionPoMembers:"po_member",
+	SectionLldp:"lldp_neighbor",
+	SectionLinks:"link",
+	SectionVlans:"vlan",
+	SectionIps:"ipif",
+	SectionUplink:"uplink",
+	SectionConfig:"config",
+}
+
+// Platform is a part of object, discovered by platform task
+type Platform struct {
+	Model		string	`json:"model"`
+	Revision	string	`json:"revision"`
+	Version		string	`json:"version"`
+	Serial		string	`json:"serial"`
+}
+
+// Uplink is uplink interface of object; zero InterfaceID means no uplink
+type Uplink struct {
+	InterfaceID	int64	`json:"interface_id"`
+	Name		string	`json:"name"`
+}
+
+// Change is a single planned DB modification. Old is current row (update, delete), New is row to store (add, update).
+// Rows are models of section: *models.Interface for interfaces, *models.ObjectVlan for vlans, etc.
+type Change struct {
+	Section		string				`json:"section"`
+	Op			Op					`json:"op"`
+	// human-readable subject of change
+	Key			string				`json:"key"`
+	Old			interface{}			`json:"old,omitempty"`
+	New			interface{}			`json:"new,omitempty"`
+	// interfaces, added by the same changeset, have no ID yet. Refs are field => interface name,
+	// resolved when changeset is applied.
+	Refs		map[string]string	`json:"refs,omitempty"`
+}
+
+// Changeset is a difference between box discovery result and DB state of object
+type Changeset struct {
+	ObjectID	int64		`json:"object_id"`
+	Name		string		`json:"name"`
+	// dproto tasks, whose sections were compared
+	Tasks		[]string	`json:"tasks"`
+	Changes		[]Change	`json:"changes"`
+	// LLDP neighbors, that are not found in inventory. They replace stored ones, if LLDP section was compared.
+	Unresolved	[]models.UnresolvedNeighbor	`json:"unresolved,omitempty"`
+	// links, confirmed by LLDP, and LLDP adjacencies, conflicting with manual links. Stored with LLDP section.
+	ConfirmedLinks	[]int64					`json:"confirmed_links,omitempty"`
+	LinkConflicts	[]models.LinkConflict	`json:"link_conflicts,omitempty"`
+	// discovered FDB; replaces active FDB of object, if FDB task was compared
+	Fdb				[]models.FdbEntry		`json:"fdb,omitempty"`
+	// discovered ARP and ND entries; replace active ARP table of object, if ARP task was compared
+	Arp				[]models.ArpEntry		`json:"arp,omitempty"`
+
+	// tables above are not stored
+	tablesDropped	bool
+}
+
+func newChangeset(dbo models.Object) *Changeset {
+	return &Changeset{
+		ObjectID:dbo.ID,
+		Name:dbo.Name,
+		Tasks:make([]string, 0),
+		Changes:make([]Change, 0),
+	}
+}
+
+func (cs *Changeset) add(section string, op Op, key string, old interface{}, new interface{}, refs map[string]string) {
+	cs.Changes = append(cs.Changes, Change{Section:section, Op:op, Key:key, Old:old, New:new, Refs:refs})
+}
+
+// compared returns true if sections of task were compared
+func (cs *Changeset) compared(t dproto.TaskType) bool {
+	return cs.comparedTask(t.String())
+}
+
+// comparedTask returns true if sections of task with given name were compared
+func (cs *Changeset) comparedTask(task string) bool {
+	for _, name := range cs.Tasks {
+		if name == task {
+			return true
+		}
+	}
+	return false
+}
+
+// DropTables drops discovered tables: unresolved neighbors, link confirmations and conflicts, FDB and ARP.
+// They are replaced by each box run, so tables of held changeset are outdated, when it's approved; stored
+// ones are kept then.
+func (cs *Changeset) DropTables() {
+	cs.Unresolved, cs.ConfirmedLinks, cs.LinkConflicts, cs.Fdb, cs.Arp = nil, nil, nil, nil, nil
+	cs.tablesDropped = true
+}
+
+// Deletions returns amount of rows, that will be deleted by changeset
+func (cs *Changeset) Deletions() int {
+	cnt := 0
+	for i := range cs.Changes {
+		if cs.Changes[i].Op == OpDelete {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// ref remembers interface name for the field, if interface is added by this changeset and has no ID yet
+func ref(refs map[string]string, field string, iface models.Interface) map[string]string {
+	if iface.ID != 0 {
+		return refs
+	}
+	if refs == nil {
+		refs = make(map[string]string)
+	}
+	refs[field] = iface.Name
+	return refs
+}
+
+// UnmarshalJSON decodes rows into models of change section
+func (c *Change) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Section		string				`json:"section"`
+		Op			Op					`json:"op"`
+		Key			string				`json:"key"`
+		Old			json.RawMessage		`json:"old"`
+		New			json.RawMessage		`json:"new"`
+		Refs		map[string]string	`json:"refs"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	c.Section, c.Op, c.Key, c.Refs = raw.Section, raw.Op, raw.Key, raw.Refs
+
+	var err error
+	if c.Old, err = decodeRow(raw.Section, raw.Old); err != nil {
+		return err
+	}
+	c.New, err = decodeRow(raw.Section, raw.New)
+	return err
+}
+
+func decodeRow(section string, b json.RawMessage) (interface{}, error) {
+	if len(b) == 0 || string(b) == "null" {
+		return nil, nil
+	}
+
+	var row interface{}
+	switch section {
+	case SectionPlatform:
+		row = &Platform{}
+	case SectionMacs:
+		row = &models.ObjectMac{}
+	case SectionInterfaces:
+		row = &models.Interface{}
+	case SectionPoMembers:
+		row = &models.PoMember{}
+	case SectionLldp:
+		row = &models.LldpNeighbor{}
+	case SectionLinks:
+		row = &models.Link{}
+	case SectionVlans:
+		row = &models.ObjectVlan{}
+	case SectionIps:
+		row = &models.Ipif{}
+	case SectionUplink:
+		row = &Uplink{}
+	case SectionConfig:
+		row = &models.Config{}
+	default:
+		return nil, fmt.Errorf("Unknown changeset section '%s'", section)
+	}
+
+	err := json.Unmarshal(b, row)
+	return row, err
+}
+
+// lockObject locks object row until the end of transaction, so results of object are applied one at a time
+func lockObject(tx orm.DB, objectID int64) error {
+	_, err := tx.Exec(`SELECT id FROM objects WHERE id = ? FOR UPDATE`, objectID)
+	return err
+}
+
+// ApplyTx locks object and stores changeset in transaction, with change events of given source. It stops on
+// the first failed change: transaction should be rolled back then. Returns amount of changes by dproto task name.
+func ApplyTx(tx orm.DB, cs *Changeset, source string) (map[string]int64, error) {
+	if err := lockObject(tx, cs.ObjectID); err != nil {
+		return nil, fmt.Errorf("Cannot lock object: %s", err.Error())
+	}
+
+	changes := make(map[string]int64)
+	for _, t := range cs.Tasks {
+		changes[t] = 0
+	}
+
+	// interface IDs by name/shortname, selected when first reference is met: all interfaces are added already
+	var ifaces map[string]models.Interface
+	for i := range cs.Changes {
+		c := &cs.Changes[i]
+		if len(c.Refs) > 0 && ifaces == nil {
+			var err error
+			if ifaces, err = getIfnamesAll(tx, cs.ObjectID); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := applyChange(tx, cs.ObjectID, c, ifaces); err != nil {
+			return nil, fmt.Errorf("Failed to %s %s %s: %s", c.Op, c.Section, c.Key, err.Error())
+		}
+		changes[sectionTask[c.Section].String()]++
+	}
+
+	// ports of entries below, that were added by this changeset
+	portID := func(name string) (int64, error) {
+		if ifaces == nil {
+			var err error
+			if ifaces, err = getIfnamesAll(tx, cs.ObjectID); err != nil {
+				return 0, err
+			}
+		}
+		return ifaces[name].ID, nil
+	}
+
+	if cs.compared(dproto.TaskType_LLDP) && !cs.tablesDropped {
+		for i := range cs.Unresolved {
+			n := &cs.Unresolved[i]
+			if n.LocalInterfaceID != 0 {
+				continue
+			}
+			var err error
+			if n.LocalInterfaceID, err = portID(n.LocalPort); err != nil {
+				return nil, err
+			}
+		}
+		if err := models.UnresolvedNeighborsStore(tx, cs.ObjectID, cs.Unresolved); err != nil {
+			return nil, fmt.Errorf("Failed to store unresolved neighbors: %s", err.Error())
+		}
+		if err := models.LinksConfirm(tx, cs.ConfirmedLinks); err != nil {
+			return nil, fmt.Errorf("Failed to confirm links: %s", err.Error())
+		}
+		if err := models.LinkConflictsStore(tx, cs.ObjectID, cs.LinkConflicts); err != nil {
+			return nil, fmt.Errorf("Failed to store link conflicts: %s", err.Error())
+		}
+	}
+
+	if cs.comparedTask(taskFdb) && !cs.tablesDropped {
+		for i := range cs.Fdb {
+			e := &cs.Fdb[i]
+			if e.InterfaceID != 0 {
+				continue
+			}
+			var err error
+			if e.InterfaceID, err = portID(e.Port); err != nil {
+				return nil, err
+			}
+		}
+		if err := models.FdbStore(tx, cs.ObjectID, cs.Fdb, retainedSince(FdbRetention)); err != nil {
+			return nil, fmt.Errorf("Failed to store FDB: %s", err.Error())
+		}
+	}
+
+	if cs.comparedTask(taskArp) && !cs.tablesDropped {
+		for i := range cs.Arp {
+			e := &cs.Arp[i]
+			if e.InterfaceID != 0 {
+				continue
+			}
+			var err error
+			if e.InterfaceID, err = portID(e.Port); err != nil {
+				return nil, err
+			}
+		}
+		if err := models.ArpStore(tx, cs.ObjectID, cs.Arp, retainedSince(ArpRetention)); err != nil {
+			return nil, fmt.Errorf("Failed to store ARP entries: %s", err.Error())
+		}
+	}
+
+	if err := models.ChangeEventsInsert(tx, cs.events(source)); err != nil {
+		return nil, fmt.Errorf("Failed to store change events: %s", err.Error())
+	}
+
+	return changes, nil
+}
+
+// FdbRetention is period, after which FDB entries, not seen by discovery, are removed from MAC history.
+// Zero means never.
+var FdbRetention time.Duration
+
+// ArpRetention is period, after which ARP/ND entries, not seen by discovery, are removed from IP-to-MAC history.
+// Zero means never.
+var ArpRetention time.Duration
+
+// retainedSince returns time, before which history entries are removed; zero retention keeps them forever
+func retainedSince(retention time.Duration) time.Time {
+	if retention <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-retention)
+}
+
+// events returns change events of applied changeset: rows of added entities have their IDs already.
+// Platform change is split to events of changed fields.
+func (cs *Changeset) events(source string) []models.ChangeEvent {
+	events := make([]models.ChangeEvent, 0, len(cs.Changes))
+	for i := range cs.Changes {
+		c := &cs.Changes[i]
+		entity := sectionEntity[c.Section]
+
+		switch c.Section {
+		case SectionPlatform:
+			old, new := c.Old.(*Platform), c.New.(*Platform)
+			fields := [][3]string{
+				{"model", old.Model, new.Model},
+				{"revision", old.Revision, new.Revision},
+				{"version", old.Version, new.Version},
+				{"serial", old.Serial, new.Serial},
+			}
+			for _, f := range fields {
+				if f[1] != f[2] {
+					events = append(events, models.NewChangeEvent(cs.ObjectID, entity, cs.ObjectID, f[0], string(c.Op), f[1], f[2], source))
+				}
+			}
+			continue
+		case SectionLinks:
+			l := c.New
+			if l == nil {
+				l = c.Old
+			}
+			events = append(events, models.LinkChangeEvents(*l.(*models.Link), c.Key, string(c.Op), c.Old, c.New, source)...)
+			continue
+		case SectionConfig:
+			// configs are large, their diff is enough
+			cfg := c.New.(*models.Config)
+			events = append(events, models.NewChangeEvent(cs.ObjectID, entity, cfg.ID, c.Key, string(c.Op), nil, cfg.PrevDiff, source))
+			continue
+		}
+
+		row := c.New
+		if row == nil {
+			row = c.Old
+		}
+		events = append(events, models.NewChangeEvent(cs.ObjectID, entity, rowID(row), c.Key, string(c.Op), c.Old, c.New, source))
+	}
+
+	return events
+}
+
+// rowID returns DB id of changed row; for uplink it's interface id
+func rowID(row interface{}) int64 {
+	switch r := row.(type) {
+	case *models.ObjectMac:
+		return r.ID
+	case *models.Interface:
+		return r.ID
+	case *models.PoMember:
+		return r.ID
+	case *models.LldpNeighbor:
+		return r.ID
+	case *models.Link:
+		return r.ID
+	case *models.ObjectVlan:
+		return r.ID
+	case *models.Ipif:
+		return r.ID
+	case *Uplink:
+		return r.InterfaceID
+	}
+	return 0
+}
+
+// Applied updates object of committed changeset in memory and broadcasts it, if interfaces were changed
+func Applied(cs *Changeset, mo *handler.ManagedObject) {
+	broadcast := false
+	for i := range cs.Changes {
+		c := &cs.Changes[i]
+		switch c.Section {
+		case SectionPlatform:
+			p := c.New.(*Platform)
+			mo.MX.Lock()
+			mo.DbObject.Model, mo.DbObject.Revision, mo.DbObject.Version, mo.DbObject.Serial = p.Model, p.Revision, p.Version, p.Serial
+			mo.MX.Unlock()
+		case SectionUplink:
+			mo.MX.Lock()
+			mo.DbObject.UplinkID = c.New.(*Uplink).InterfaceID
+			mo.MX.Unlock()
+		case SectionInterfaces, SectionPoMembers:
+			broadcast = true
+		}
+	}
+
+	if broadcast {
+		mo.MX.Lock()
+		dbo := mo.DbObject
+		mo.MX.Unlock()
+		streamer.UpdateObject(dbo, false)
+	}
+}
+
+func applyChange(tx orm.DB, objectID int64, c *Change, ifaces map[string]models.Interface) error {
+	for field, name := range c.Refs {
+		iface, ok := ifaces[name]
+		if !ok {
+			return fmt.Errorf("interface '%s' is not found", name)
+		}
+		setRef(c.New, field, iface.ID)
+	}
+
+	switch c.Section {
+	case SectionPlatform:
+		old, p := c.Old.(*Platform), c.New.(*Platform)
+		return updateChanged(tx,
+			&models.Object{ID:objectID, Model:old.Model, Revision:old.Revision, Version:old.Version, Serial:old.Serial},
+			&models.Object{ID:objectID, Model:p.Model, Revision:p.Revision, Version:p.Version, Serial:p.Serial})
+	case SectionUplink:
+		return updateChanged(tx,
+			&models.Object{ID:objectID, UplinkID:c.Old.(*Uplink).InterfaceID},
+			&models.Object{ID:objectID, UplinkID:c.New.(*Uplink).InterfaceID})
+	case SectionVlans:
+		// global vlan did not exist when changeset was computed
+		if ovlan, ok := c.New.(*models.ObjectVlan); ok && c.Op == OpAdd && ovlan.VlanID == 0 {
+			id, err := findOrCreateVlan(tx, ovlan.VID)
+			if err != nil {
+				return err
+			}
+			ovlan.VlanID = id
+		}
+	}
+
+	switch c.Op {
+	case OpAdd:
+		return tx.Insert(c.New)
+	case OpUpdate:
+		return updateChanged(tx, c.Old, c.New)
+	case OpDelete:
+		return actual(tx.Model(c.Old).WherePK().Delete())
+	}
+	return fmt.Errorf("unknown operation '%s'", c.Op)
+}
+
+// errNotActual is error of change, whose row was changed or removed after changeset was computed
+var errNotActual = errors.New("row is not actual anymore")
+
+// actual fails change, that affected no rows
+func actual(res orm.Result, err error) error {
+	if err == nil && res.RowsAffected() == 0 {
+		return errNotActual
+	}
+	return err
+}
+
+// updateChanged updates columns of row, that differ from old row, if they still have old values: changes
+// of held changeset don't overwrite ones, made after it was computed
+func updateChanged(tx orm.DB, old interface{}, new interface{}) error {
+	oldV, newV := reflect.Indirect(reflect.ValueOf(old)), reflect.Indirect(reflect.ValueOf(new))
+	fields := diffColumns(oldV, newV)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	q := tx.Model(new).WherePK()
+	columns := make([]string, 0, len(fields))
+	for _, f := range fields {
+		columns = append(columns, f.SQLName)
+		q.Where(`? IS NOT DISTINCT FROM ?`, pg.F(f.SQLName), sqlValue(f.AppendValue(nil, oldV, 1)))
+	}
+	return actual(q.Column(columns...).Update())
+}
+
+// diffColumns returns non-PK fields of model, whose DB values differ
+func diffColumns(oldV reflect.Value, newV reflect.Value) []*orm.Field {
+	fields := make([]*orm.Field, 0)
+	for _, f := range orm.GetTable(newV.Type()).DataFields {
+		if string(f.AppendValue(nil, oldV, 1)) != string(f.AppendValue(nil, newV, 1)) {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// sqlValue is value, already formatted by field of model
+type sqlValue []byte
+
+func (v sqlValue) AppendValue(b []byte, quote int) ([]byte, error) {
+	return append(b, v...), nil
+}
+
+func setRef(row interface{}, field string, id int64) {
+	switch r := row.(type) {
+	case *models.PoMember:
+		if field == "po_id" {
+			r.PoID = id
+		} else {
+			r.MemberID = id
+		}
+	case *models.LldpNeighbor:
+		r.LocalInterfaceID = id
+	case *models.ObjectVlan:
+		r.InterfaceID = id
+	case *models.Ipif:
+		r.InterfaceID = id
+	case *Uplink:
+		r.InterfaceID = id
+	}
+}
@@ -0,0 +1,119 @@
+package taskparser
+
+import (
+	"encoding/json"
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/models"
+	"reflect"
+	"testing"
+)
+
+func TestChangesetJSON(t *testing.T) {
+	cs := newChangeset(models.Object{ID:1, Name:"sw1"})
+	po := models.Interface{Name:"Port-channel1", Shortname:"Po1"}
+	cs.add(SectionPlatform, OpUpdate, "model", &Platform{Model:"old"}, &Platform{Model:"new"}, nil)
+	cs.add(SectionInterfaces, OpAdd, po.Name, nil, &po, nil)
+	cs.add(SectionPoMembers, OpAdd, "member", nil, &models.PoMember{MemberID:5}, ref(nil, "po_id", po))
+	cs.add(SectionVlans, OpDelete, "vlan 10", &models.ObjectVlan{ID:7, VID:10}, nil, nil)
+	cs.add(SectionIps, OpDelete, "10.0.0.1/24", &models.Ipif{ID:8, Addr:"10.0.0.1/24"}, nil, nil)
+
+	if cs.Deletions() != 2 {
+		t.Errorf("Deletions() = %d, expected 2", cs.Deletions())
+	}
+
+	bts, err := json.Marshal(cs)
+	if err != nil {
+		t.Fatalf("marshal: %s", err.Error())
+	}
+	var decoded Changeset
+	if err = json.Unmarshal(bts, &decoded); err != nil {
+		t.Fatalf("unmarshal: %s", err.Error())
+	}
+	if len(decoded.Changes) != len(cs.Changes) {
+		t.Fatalf("got %d changes, expected %d", len(decoded.Changes), len(cs.Changes))
+	}
+
+	if p, ok := decoded.Changes[0].New.(*Platform); !ok || p.Model != "new" {
+		t.Errorf("platform is decoded as %#v", decoded.Changes[0].New)
+	}
+	if decoded.Changes[1].Old != nil {
+		t.Errorf("added interface has old row %#v", decoded.Changes[1].Old)
+	}
+	member, ok := decoded.Changes[2].New.(*models.PoMember)
+	if !ok || member.MemberID != 5 || decoded.Changes[2].Refs["po_id"] != "Port-channel1" {
+		t.Errorf("po member is decoded as %#v, refs %v", decoded.Changes[2].New, decoded.Changes[2].Refs)
+	}
+	setRef(member, "po_id", 3)
+	if member.PoID != 3 || member.MemberID != 5 {
+		t.Errorf("po_id reference is resolved to %#v", member)
+	}
+	if v, ok := decoded.Changes[3].Old.(*models.ObjectVlan); !ok || v.ID != 7 {
+		t.Errorf("vlan is decoded as %#v", decoded.Changes[3].Old)
+	}
+	if decoded.Deletions() != 2 {
+		t.Errorf("decoded Deletions() = %d, expected 2", decoded.Deletions())
+	}
+
+	if err = json.Unmarshal([]byte(`{"changes":[{"section":"unknown","op":"add","new":{}}]}`), &decoded); err == nil {
+		t.Errorf("unknown section is decoded")
+	}
+}
+
+func TestChangesetEvents(t *testing.T) {
+	cs := newChangeset(models.Object{ID:1, Name:"sw1"})
+	cs.add(SectionPlatform, OpUpdate, "model", &Platform{Model:"old", Serial:"S1"}, &Platform{Model:"new", Serial:"S1"}, nil)
+	cs.add(SectionLinks, OpAdd, "link", nil, &models.Link{ID:4, Object1ID:1, Object2ID:2}, nil)
+	cs.add(SectionVlans, OpDelete, "vlan 10", &models.ObjectVlan{ID:7, VID:10}, nil, nil)
+
+	events := cs.events(models.SourceDiscovery)
+	if len(events) != 4 {
+		t.Fatalf("got %d events, expected 4: %+v", len(events), events)
+	}
+	if events[0].Entity != "platform" || events[0].Key != "model" || string(events[0].NewValue) != `"new"` {
+		t.Errorf("platform field event is %+v", events[0])
+	}
+	if events[1].ObjectID != 1 || events[2].ObjectID != 2 || events[2].EntityID != 4 {
+		t.Errorf("link events are %+v, %+v", events[1], events[2])
+	}
+	if events[3].EntityID != 7 || events[3].Action != models.ActionDelete || events[3].NewValue != nil {
+		t.Errorf("vlan event is %+v", events[3])
+	}
+}
+
+func TestDiffColumns(t *testing.T) {
+	old := models.Interface{ID:1, ObjectID:2, Name:"Gi0/1", Description:"old"}
+	new := old
+	new.Description = "new"
+
+	fields := diffColumns(reflect.ValueOf(old), reflect.ValueOf(new))
+	if len(fields) != 1 || fields[0].SQLName != "description" {
+		t.Errorf("changed columns of interface: %v", fields)
+	}
+	if fields = diffColumns(reflect.ValueOf(old), reflect.ValueOf(old)); len(fields) != 0 {
+		t.Errorf("unchanged interface has changed columns: %v", fields)
+	}
+
+	// removed uplink is NULL
+	fields = diffColumns(reflect.ValueOf(models.Object{ID:1, UplinkID:5}), reflect.ValueOf(models.Object{ID:1}))
+	if len(fields) != 1 || string(fields[0].AppendValue(nil, reflect.ValueOf(models.Object{ID:1}), 1)) != "NULL" {
+		t.Errorf("changed columns of object: %v", fields)
+	}
+}
+
+func TestChangesetDropTables(t *testing.T) {
+	cs := newChangeset(models.Object{ID:1, Name:"sw1"})
+	cs.Tasks = []string{dproto.TaskType_LLDP.String(), taskFdb, taskArp}
+	cs.Unresolved = []models.UnresolvedNeighbor{{ChassisID:"sw2"}}
+	cs.ConfirmedLinks = []int64{5}
+	cs.LinkConflicts = []models.LinkConflict{{}}
+	cs.Fdb = []models.FdbEntry{{Mac:"00:11:22:33:44:55"}}
+	cs.Arp = []models.ArpEntry{{Mac:"00:11:22:33:44:55"}}
+
+	cs.DropTables()
+	if cs.Unresolved != nil || cs.ConfirmedLinks != nil || cs.LinkConflicts != nil || cs.Fdb != nil || cs.Arp != nil {
+		t.Errorf("tables are not dropped: %+v", cs)
+	}
+	if !cs.tablesDropped || len(cs.Tasks) != 3 {
+		t.Errorf("tables are not marked dropped, or tasks are changed: %v", cs.Tasks)
+	}
+}
@@ -0,0 +1,34 @@
+// +build dprotonext
+
+package taskparser
+
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/models"
+	"time"
+)
+
+// attrsReported is false for workers, that don't discover interface attributes: stored ones are kept then
+func attrsReported(iface *dproto.Interface) bool {
+	return iface.AdminStatus != "" || iface.OperStatus != "" || iface.IfIndex != 0 || iface.Speed != 0 ||
+		iface.Mtu != 0 || iface.Mac != ""
+}
+
+// setAttrs copies discovered attributes to interface; oper status change time is set, if status is changed
+func setAttrs(i *models.Interface, iface *dproto.Interface, now time.Time) {
+	if i.OperStatus != iface.OperStatus || i.OperChangedAt == nil {
+		i.OperChangedAt = &now
+	}
+	i.AdminStatus = iface.AdminStatus
+	i.OperStatus = iface.OperStatus
+	i.Speed = iface.Speed
+	i.Duplex = iface.Duplex
+	i.Mtu = iface.Mtu
+	i.Mac = iface.Mac
+	i.IfIndex = iface.IfIndex
+}
+
+// ifIndex returns reported ifIndex of interface
+func ifIndex(iface *dproto.Interface) int64 {
+	return iface.IfIndex
+}
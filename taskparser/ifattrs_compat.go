@@ -0,0 +1,22 @@
+// +build !dprotonext
+
+package taskparser
+
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/models"
+	"time"
+)
+
+// Released dproto has no interface attributes yet: stored ones are kept.
+
+func attrsReported(iface *dproto.Interface) bool {
+	return false
+}
+
+func setAttrs(i *models.Interface, iface *dproto.Interface, now time.Time) {
+}
+
+func ifIndex(iface *dproto.Interface) int64 {
+	return 0
+}
@@ -0,0 +1,52 @@
+// +build dprotonext
+
+package taskparser
+
+import (
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInterfaceAttrs(t *testing.T) {
+	if attrsReported(&dproto.Interface{Name:"Gi0/1", Description:"uplink"}) {
+		t.Errorf("interface without attributes is reported as having them")
+	}
+
+	since := time.Now().Add(-time.Hour)
+	old := models.Interface{Name:"Gi0/1", OperStatus:"up", Speed:1000000000, Mtu:1500, OperChangedAt:&since}
+	now := time.Now()
+
+	updated := old
+	setAttrs(&updated, &dproto.Interface{OperStatus:"up", Speed:1000000000, Mtu:9000}, now)
+	if changed := changedFields(old, updated); !reflect.DeepEqual(changed, []string{"mtu"}) {
+		t.Errorf("changed fields are %v, expected [mtu]", changed)
+	}
+	if !updated.OperChangedAt.Equal(since) {
+		t.Errorf("oper change time is updated without status change")
+	}
+
+	updated = old
+	setAttrs(&updated, &dproto.Interface{OperStatus:"down", Speed:1000000000, Mtu:1500}, now)
+	if changed := changedFields(old, updated); !reflect.DeepEqual(changed, []string{"oper"}) {
+		t.Errorf("changed fields are %v, expected [oper]", changed)
+	}
+	if !updated.OperChangedAt.Equal(now) {
+		t.Errorf("oper change time is %v, expected %v", updated.OperChangedAt, now)
+	}
+}
+
+func TestMatchRenamesIfIndex(t *testing.T) {
+	gone := []models.Interface{
+		{ID:2, Name:"Ethernet1/0/2", Type:"PHISYCAL", IfIndex:2},
+	}
+	appeared := []*dproto.Interface{
+		{Name:"GigabitEthernet1/0/20", Type:dproto.InterfaceType_PHISYCAL, IfIndex:2},
+	}
+
+	if renames := matchRenames(gone, appeared); renames["GigabitEthernet1/0/20"].ID != 2 {
+		t.Errorf("got renames %v, expected GigabitEthernet1/0/20 from #2", renames)
+	}
+}
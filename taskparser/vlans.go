@@ -6,27 +6,33 @@ import (
 	"github.com/go-pg/pg/orm"
 	"github.com/ircop/dproto"
 	"github.com/ircop/ohandler/db"
-	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/logger"
 	"github.com/ircop/ohandler/models"
 	"github.com/pkg/errors"
 )
 
-// firts: we will create 2 maps [VID][INTERFACE_ID]discovered-vlan-mode and [VID][INTERFACE_ID]ObjectVlan
+// vlanPort is interface, where vlan is discovered. New interfaces have no ID yet.
+type vlanPort struct {
+	iface	models.Interface
+	mode	string
+}
+
+// firts: we will create 2 maps [VID][INTERFACE]discovered-vlan-mode and [VID][INTERFACE_ID]ObjectVlan
 // second: compare them
-func processVlans(discovered []*dproto.Vlan, mo *handler.ManagedObject, dbo models.Object) {
-	// create discovered vlans map as VID-InterfaceID-Mode
-	deviceVlans, err := getDeviceVlans(discovered, dbo)
-	if err != nil {
-		logger.Err("%s: %s", dbo.Name, err.Error())
-		return
-	}
+func processVlans(tx orm.DB, cs *Changeset, discovered []*dproto.Vlan, ifaces map[string]models.Interface, dbo models.Object) error {
+	// create discovered vlans map as VID-Interface-Mode
+	deviceVlans := getDeviceVlans(discovered, ifaces, dbo)
 
 	// create DB vlans map by VID -> intID -> objectVlan
-	dbVlans, err := getDbVlans(dbo)
+	dbVlans, err := getDbVlans(tx, dbo)
 	if err != nil {
-		logger.Err("%s: cannot select DB vlans: %s", dbo.Name, err.Error())
-		return
+		return fmt.Errorf("cannot select DB vlans: %s", err.Error())
+	}
+
+	// interface names for keys of changes
+	names := make(map[int64]string, len(ifaces))
+	for _, i := range ifaces {
+		names[i.ID] = i.Name
 	}
 
 	// compare this maps...
@@ -35,23 +41,20 @@ func processVlans(discovered []*dproto.Vlan, mo *handler.ManagedObject, dbo mode
 	for vid, dbVlan := range dbVlans {
 		devVlan, ok := deviceVlans[vid]
 		if !ok {
+			if inMaintenance(dbo, fmt.Sprintf("vlan %d", vid)) {
+				continue
+			}
 			// delete DB vlans of this object with VID = vid
-			logger.Update("%s: deleting vlan %d from object", dbo.Name, vid)
-			_, err = db.DB.Model(&models.ObjectVlan{}).
-				Where(`object_id = ?`, dbo.ID).Where(`vid = ?`, vid).
-				Delete()
-			if err != nil {
-				logger.Err("%s: Failed to delete object_vlan %d: %s", dbo.Name, vid, err.Error())
-				logger.Update("%s: Failed to delete object_vlan %d: %s", dbo.Name, vid, err.Error())
-				return
+			for ifid := range dbVlan {
+				ovlan := dbVlan[ifid]
+				cs.add(SectionVlans, OpDelete, fmt.Sprintf("vlan %d on %s", vid, names[ifid]), &ovlan, nil, nil)
 			}
 			continue
 		}
 
 		// vlan exist on device. Compare ports and modes.
-		if err = comparePorts(vid, dbVlan, devVlan, dbo); err != nil {
-			logger.Err(err.Error())
-			return
+		if err = comparePorts(tx, cs, vid, dbVlan, devVlan, names, dbo); err != nil {
+			return err
 		}
 	}
 
@@ -64,92 +67,78 @@ func processVlans(discovered []*dproto.Vlan, mo *handler.ManagedObject, dbo mode
 
 		// Vlan does not exists in DB for this object.
 		// Loop over all ports and create ObjectVlans
-		for ifid, mode := range devVlan {
-			id, err := findOrCreateVlan(vid)
-			if err != nil {
-				logger.Err("%s: failed to find/create global vlan with vid=%d: %s", dbo.Name, vid, err.Error())
-				return
-			}
-			logger.Update("%s: creating object_vlan %d for if %d", dbo.Name, vid, ifid)
-			ovlan := models.ObjectVlan{
-				VlanID:id,
-				ObjectID:dbo.ID,
-				Mode:mode,
-				InterfaceID:ifid,
-				VID:vid,
-			}
-			if err = db.DB.Insert(&ovlan); err != nil {
-				logger.Update("%s: failed to create object_vlan: %s", dbo.Name, err.Error())
-				logger.Err("%s: failed to create object_vlan: %s", dbo.Name, err.Error())
-				return
-			}
+		if err = comparePorts(tx, cs, vid, map[int64]models.ObjectVlan{}, devVlan, names, dbo); err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
 // dbVlan: map[INT_ID]ObjectVlan
-// devVlan: map[INT_ID]mode
-func comparePorts(vid int64, dbVlan map[int64]models.ObjectVlan, devVlan map[int64]string, dbo models.Object) error {
+// devVlan: map[INT_NAME]vlanPort
+func comparePorts(tx orm.DB, cs *Changeset, vid int64, dbVlan map[int64]models.ObjectVlan, devVlan map[string]vlanPort, names map[int64]string, dbo models.Object) error {
 	// 1: loop over DB ports and find device port with same id. If none foud, delete. If found, compare/update mode.
 	// 2: loop over device ports and find DB port with same id. If none, add.
+	devModes := make(map[int64]string, len(devVlan))
+	for _, port := range devVlan {
+		if port.iface.ID != 0 {
+			devModes[port.iface.ID] = port.mode
+		}
+	}
 
 	for ifid, ovlan := range dbVlan {
-		mode, ok := devVlan[ifid]
+		mode, ok := devModes[ifid]
 		if !ok {
-			// delete this from DB, because there is no this vlan on this interface on device
-			logger.Update("%s: deleting vlan %d from interface %d", dbo.Name, vid, ifid)
-			if err := db.DB.Delete(&ovlan); err != nil {
-				logger.Update("%s: cannot delete vlan %d (id %d) from interface: %s", dbo.Name, vid, ovlan.ID, err.Error())
-				return fmt.Errorf("%s: cannot delete vlan %d (id %d) from interface: %s", dbo.Name, vid, ovlan.ID, err.Error())
+			if inMaintenance(dbo, fmt.Sprintf("vlan %d on interface %d", vid, ifid)) {
+				continue
 			}
+			// delete this from DB, because there is no this vlan on this interface on device
+			old := ovlan
+			cs.add(SectionVlans, OpDelete, fmt.Sprintf("vlan %d on %s", vid, names[ifid]), &old, nil, nil)
 			continue
 		}
 		// if mode differs, update it
 		if mode != ovlan.Mode {
+			old := ovlan
 			ovlan.Mode = mode
-			logger.Update("%s: setting vlan %d mode on iface %d to %s", dbo.Name, vid, ifid, mode)
-			if err := db.DB.Update(&ovlan); err != nil {
-				logger.Update("%s: error updating object_vlan: %s", dbo.Name, err.Error())
-				return fmt.Errorf("%s: error updating object_vlan: %s", dbo.Name, err.Error())
-			}
+			cs.add(SectionVlans, OpUpdate, fmt.Sprintf("vlan %d mode on %s", vid, names[ifid]), &old, &ovlan, nil)
 		}
 	}
 
-
-	for ifid, mode := range devVlan {
-		_, ok := dbVlan[ifid]
-		if !ok {
-			// create new ObjectVlan
-			logger.Update("%s: adding new ObjectVlan %d to interface %d", dbo.Name, vid, ifid)
-			id, err := findOrCreateVlan(vid)
+	var vlanID int64
+	found := false
+	for _, port := range devVlan {
+		if _, ok := dbVlan[port.iface.ID]; ok && port.iface.ID != 0 {
+			continue
+		}
+		// create new ObjectVlan; global vlan is created while applying, if it does not exist yet
+		if !found {
+			id, err := findVlan(tx, vid)
 			if err != nil {
-				logger.Update("%s: failed to find/create global vlan: %s", err.Error())
-				return fmt.Errorf("%s: failed to find/create global vlan: %s", err.Error())
-			}
-
-			ovlan := models.ObjectVlan{
-				VID:vid,
-				InterfaceID:ifid,
-				Mode:mode,
-				ObjectID:dbo.ID,
-				VlanID:id,
-			}
-			if err = db.DB.Insert(&ovlan); err != nil {
-				logger.Update("%s: failed to add object_vlan %d: %s", dbo.Name, vid, err.Error())
-				return fmt.Errorf("%s: failed to add object_vlan %d: %s", dbo.Name, vid, err.Error())
+				return fmt.Errorf("failed to find global vlan %d: %s", vid, err.Error())
 			}
+			vlanID, found = id, true
 		}
+		ovlan := models.ObjectVlan{
+			VID:vid,
+			InterfaceID:port.iface.ID,
+			Mode:port.mode,
+			ObjectID:dbo.ID,
+			VlanID:vlanID,
+		}
+		cs.add(SectionVlans, OpAdd, fmt.Sprintf("vlan %d on %s", vid, port.iface.Name), nil, &ovlan, ref(nil, "interface_id", port.iface))
 	}
 
 	return nil
 }
 
 // return map[VID]map[INT_ID]ObjectVlan
-func getDbVlans(dbo models.Object) (map[int64]map[int64]models.ObjectVlan, error) {
+func getDbVlans(tx orm.DB, dbo models.Object) (map[int64]map[int64]models.ObjectVlan, error) {
 	result := make(map[int64]map[int64]models.ObjectVlan, 0)
 
 	arr := make([]models.ObjectVlan, 0)
-	if err := db.DB.Model(&arr).Where(`object_id = ?`, dbo.ID).Select(); err != nil {
+	if err := tx.Model(&arr).Where(`object_id = ?`, dbo.ID).Select(); err != nil {
 		return result, err
 	}
 
@@ -166,35 +155,23 @@ func getDbVlans(dbo models.Object) (map[int64]map[int64]models.ObjectVlan, error
 	return result, nil
 }
 
-// return map[VID]map[INT_ID]vlan_mode(string)
-func getDeviceVlans(discovered []*dproto.Vlan, dbo models.Object) (map[int64]map[int64]string, error) {
-	result := make(map[int64]map[int64]string, 0)
-
-	/*if dbo.Name == "10.170.52.244" {
-		logger.Debug("VLANS FOR 10.170.52.244  :: %+#v", discovered)
-	}*/
-
-	// get interfaces: map[name]Interface and map[shortname]Interface
-	//ifnames, err := getIfnames(dbo)
-	ifnames, err := getIfnamesAll(dbo)
-	if err != nil {
-		return result, err
-	}
+// return map[VID]map[INT_NAME]vlanPort
+func getDeviceVlans(discovered []*dproto.Vlan, ifnames map[string]models.Interface, dbo models.Object) map[int64]map[string]vlanPort {
+	result := make(map[int64]map[string]vlanPort, 0)
 
 	for i, _ := range discovered {
 		vlan := discovered[i]
 		vid := vlan.ID
-		interfaces := make(map[int64]string, 0)
+		interfaces := make(map[string]vlanPort, 0)
 
 		for j, _ := range vlan.AccessPorts {
 			ifname := vlan.AccessPorts[j]
 			iface, ok := ifnames[ifname]
 			if !ok {
-				//return result, fmt.Errorf("%d: Cannot find interface ID for '%s' (access)", vid, ifname)
 				logger.Err("%s: Cannot find interface ID for '%s' (access)", dbo.Name, ifname)
 				continue
 			}
-			interfaces[iface.ID] = models.VlanType_ACCESS.String()
+			interfaces[iface.Name] = vlanPort{iface:iface, mode:models.VlanType_ACCESS.String()}
 		}
 		for j, _ := range vlan.TrunkPorts {
 			ifname := vlan.TrunkPorts[j]
@@ -202,21 +179,31 @@ func getDeviceVlans(discovered []*dproto.Vlan, dbo models.Object) (map[int64]map
 			if !ok {
 				logger.Err("%s: Cannot find interface ID for '%s' (trunk)", dbo.Name, ifname)
 				continue
-				//return result, fmt.Errorf("%d: Cannot find interface ID for '%s' (trunk)", vid, ifname)
 			}
-			interfaces[iface.ID] = models.VlanType_TRUNK.String()
+			interfaces[iface.Name] = vlanPort{iface:iface, mode:models.VlanType_TRUNK.String()}
 		}
 		result[vid] = interfaces
 	}
 
-	return result, nil
+	return result
+}
+
+// findVlan returns db id of global vlan, or 0 if there is no such vlan
+func findVlan(tx orm.DB, vid int64) (int64, error) {
+	var v models.Vlan
+	err := tx.Model(&v).Where(`vid = ?`, vid).Select()
+	if err != nil && err != pg.ErrNoRows {
+		return 0, err
+	}
+
+	return v.ID, nil
 }
 
 // return db id
 // todo: name/description...
-func findOrCreateVlan(vid int64) (int64, error) {
+func findOrCreateVlan(tx orm.DB, vid int64) (int64, error) {
 	var v models.Vlan
-	err := db.DB.Model(&v).Where(`vid = ?`, vid).Select()
+	err := tx.Model(&v).Where(`vid = ?`, vid).Select()
 	if err != nil && err != pg.ErrNoRows {
 		return 0, err
 	}
@@ -224,7 +211,7 @@ func findOrCreateVlan(vid int64) (int64, error) {
 		// create vlan
 		v.Vid = vid
 		logger.Update("Creating global vlan %d", vid)
-		err = db.DB.Insert(&v)
+		err = tx.Insert(&v)
 		if err != nil {
 			return 0, fmt.Errorf("Cannot create vlan %d: %s", vid, err.Error())
 		}
@@ -257,11 +244,11 @@ func getIfnames(dbo models.Object) (map[string]models.Interface, error) {
 	return ifNames, nil
 }
 
-func getIfnamesAll(dbo models.Object) (map[string]models.Interface, error) {
+func getIfnamesAll(tx orm.DB, objectID int64) (map[string]models.Interface, error) {
 	ifNames := make(map[string]models.Interface, 0)
 
 	ifArr := make([]models.Interface, 0)
-	err := db.DB.Model(&ifArr).Where(`object_id = ?`, dbo.ID).
+	err := tx.Model(&ifArr).Where(`object_id = ?`, objectID).
 /*		WhereGroup(func(q *orm.Query) (*orm.Query, error) {
 		q.Where(`type = ?`, dproto.InterfaceType_PHISYCAL.String()).
 			WhereOr(`type = ?`, dproto.InterfaceType_AGGREGATED.String()).
@@ -1,6 +1,8 @@
 package tasks
 
 import (
+	"context"
+	"fmt"
 	"github.com/go-pg/pg"
 	"net"
 
@@ -11,26 +13,26 @@ import (
 	"github.com/ircop/ohandler/logger"
 	"github.com/ircop/ohandler/models"
 	"github.com/ircop/ohandler/streamer"
-	"math/rand"
 	"time"
 	"github.com/ircop/ohandler/taskparser"
 	"runtime/debug"
 )
 
 // BoxDiscovery runs every time on object`s timer fires an event.
-// 1) Send 'all' packet type to NATS
-// 2) wait for answer (in another, upper-lewel, routine)
-// 3) on answer, or on wait finished, re-schedule box discovery
-func BoxDiscovery(obj *handler.ManagedObject) {
+// 1) Send requested task types to NATS (nil taskTypes means tasks that are due by discovery profile)
+// 2) wait for answer, error or timeout
+// 3) re-schedule box discovery
+// Progress is reported to job, if it's not nil.
+func BoxDiscovery(obj *handler.ManagedObject, taskTypes []dproto.TaskType, job *Job) {
 	obj.MX.Lock()
 	dbo := obj.DbObject
 	obj.MX.Unlock()
 
-	if IsBoxRunning(dbo.ID) {
+	if !startBox(dbo.ID) {
 		logger.Err("%s: box discovery already running.", dbo.Name)
+		job.setStatus(dbo.ID, JobFailed, "Box discovery is already running")
 		return
 	}
-	BoxRunning.Store(dbo.ID, true)
 	defer func() {
 		BoxRunning.Delete(dbo.ID)
 	}()
@@ -38,12 +40,20 @@ func BoxDiscovery(obj *handler.ManagedObject) {
 	logger.Debug("Running box discovery for %s (%s)", dbo.Name, dbo.Mgmt)
 	if !dbo.Alive {
 		logger.Log("Skipping box discovery for %s: !alive", dbo.Name)
+		job.setStatus(dbo.ID, JobFailed, "Object is not alive")
+		SheduleBox(obj, false)
+		return
+	}
+	if handler.InMaintenance(dbo.ID) {
+		logger.Log("Skipping box discovery for %s: maintenance", dbo.Name)
+		job.setStatus(dbo.ID, JobFailed, "Object is in maintenance")
 		SheduleBox(obj, false)
 		return
 	}
 	// check if ip address is valid
 	if ipChech := net.ParseIP(dbo.Mgmt); ipChech == nil {
 		logger.Log("Skipping box discovery for '%s' (#%d): wrong IP", dbo.Name, dbo.ID)
+		job.setStatus(dbo.ID, JobFailed, "Wrong management IP")
 		SheduleBox(obj, false)
 		return
 	}
@@ -52,6 +62,7 @@ func BoxDiscovery(obj *handler.ManagedObject) {
 	apInt, ok := handler.AuthProfiles.Load(dbo.AuthID)
 	if !ok {
 		logger.Err("No auth profile for object %d found!", dbo.ID)
+		job.setStatus(dbo.ID, JobFailed, "No auth profile")
 		SheduleBox(obj, false)
 		return
 	}
@@ -66,25 +77,144 @@ func BoxDiscovery(obj *handler.ManagedObject) {
 	profile, err := dbo.GetProfile()
 	if err != nil {
 		logger.Err("%s: %s", dbo.Name, err.Error())
+		job.setStatus(dbo.ID, JobFailed, err.Error())
 		SheduleBox(obj, false)
 		return
 	}
 
-	//proto := dproto.Protocol_TELNET
-	// todo: check if MO is not nil
-	streamer.SendBox(dbo.Mgmt, proto, profile, ap.Login, ap.Password, ap.Enable,
-		func(s string){
-			BoxErrorCallback(s, obj)
+	if taskTypes == nil {
+		dpInt, ok := handler.DiscoveryProfiles.Load(dbo.DiscoveryID)
+		if !ok {
+			logger.Err("No discovery profile for object %d found!", dbo.ID)
+			job.setStatus(dbo.ID, JobFailed, "No discovery profile")
 			SheduleBox(obj, false)
-		},
-		func(response dproto.BoxResponse) {
-			BoxAnswerCallback(response, obj)
+			return
+		}
+		taskTypes = dpInt.(models.DiscoveryProfile).DueTasks(dbo.TaskRuns, time.Now())
+		if len(taskTypes) == 0 {
+			logger.Debug("%s: no box tasks are due", dbo.Name)
+			job.setStatus(dbo.ID, JobParsed, "")
 			SheduleBox(obj, false)
-		},
-		func() {
-			BoxTimeoutCallback(obj)
+			return
+		}
+	}
+
+	// dry run changes nothing: results are not applied, run is not stored
+	dryRun := job != nil && job.DryRun
+	run := models.DiscoveryRun{
+		ObjectID:dbo.ID,
+		StartedAt:time.Now(),
+		Tasks:make([]string, 0, len(taskTypes)),
+	}
+	for _, t := range taskTypes {
+		run.Tasks = append(run.Tasks, t.String())
+	}
+	saveRunOnExit := !dryRun
+	defer func() {
+		if saveRunOnExit {
+			saveRun(&run, dbo)
+		}
+	}()
+
+	// request is stored before it's published, so the reply can be claimed by this instance only,
+	// even if it comes faster than SendBox returns
+	var requestID string
+	store := func(id string, deadline time.Time) error {
+		if dryRun {
+			return nil
+		}
+		request := models.BoxRequest{
+			RequestID:id,
+			ObjectID:dbo.ID,
+			Tasks:run.Tasks,
+			SentAt:run.StartedAt,
+			ExpiresAt:deadline,
+			Instance:Instance,
+		}
+		if err := db.DB.Insert(&request); err != nil {
+			return fmt.Errorf("Cannot store box request: %s", err.Error())
+		}
+		requestID = id
+		return nil
+	}
+
+	handle, err := streamer.SendBox(context.Background(), streamer.BoxParams{
+		DomainID:dbo.DomainID,
+		Host:dbo.Mgmt,
+		Protocol:proto,
+		Profile:profile,
+		Login:ap.Login,
+		Password:ap.Password,
+		Enable:ap.Enable,
+		Tasks:taskTypes,
+		BeforeSend:store,
+	})
+	if err != nil {
+		if requestID != "" {
+			if e := models.BoxRequestDelete(requestID); e != nil {
+				logger.Err("%s: failed to remove box request: %s", dbo.Name, e.Error())
+			}
+		}
+		logger.Err("%s: %s", dbo.Name, err.Error())
+		job.setStatus(dbo.ID, JobFailed, err.Error())
+		run.Outcome, run.Error = models.RunError, err.Error()
+		SheduleBox(obj, false)
+		return
+	}
+	job.setRequest(dbo.ID, handle.RequestID)
+	run.RequestID = handle.RequestID
+
+	// wait for reply; discovery is considered running until it's parsed
+	result := <-handle.Result
+	if result.Err == streamer.ErrBoxShutdown {
+		// request stays in DB; run will be stored by late reply, if any
+		saveRunOnExit = false
+		job.setStatus(dbo.ID, JobFailed, result.Err.Error())
+		return
+	}
+
+	// claim request: reply, that came after timeout, could be taken by late reply handler already
+	if !dryRun {
+		request, err := models.BoxRequestTake(handle.RequestID, Instance)
+		if err != nil {
+			logger.Err("%s: failed to remove box request: %s", dbo.Name, err.Error())
+		} else if request == nil {
+			logger.Log("%s: reply %s is handled already", dbo.Name, handle.RequestID)
+			saveRunOnExit = false
+			job.setStatus(dbo.ID, JobFailed, "Reply is handled already")
 			SheduleBox(obj, false)
-		})
+			return
+		}
+	}
+	switch {
+	case result.Err == streamer.ErrBoxTimeout:
+		job.setStatus(dbo.ID, JobTimedOut, result.Err.Error())
+		run.Outcome, run.Error = models.RunTimeout, result.Err.Error()
+		BoxTimeoutCallback(obj)
+	case result.Err != nil:
+		job.setStatus(dbo.ID, JobFailed, result.Err.Error())
+		run.Outcome, run.Error = models.ErrorOutcome(result.Err.Error()), result.Err.Error()
+		BoxErrorCallback(result.Err.Error(), obj)
+	default:
+		job.setStatus(dbo.ID, JobReplied, "")
+		cs := BoxAnswerCallback(*result.Response, taskTypes, obj, &run, dryRun)
+		switch run.Outcome {
+		case models.RunError:
+			job.setStatus(dbo.ID, JobFailed, run.Error)
+		case models.RunHeld:
+			job.setStatus(dbo.ID, JobHeld, run.Error)
+		default:
+			if dryRun {
+				job.setChangeset(dbo.ID, cs)
+			}
+			job.setStatus(dbo.ID, JobParsed, "")
+		}
+	}
+	// failing objects are backed off; publish failure is not object's fault, so it's not counted
+	if !dryRun {
+		Sched.ReportResult(dbo.ID, run.Outcome == models.RunSuccess || run.Outcome == models.RunPartial || run.Outcome == models.RunHeld)
+	}
+	SheduleBox(obj, false)
 }
 
 // BoxErrorCallback called when task results with global error
@@ -98,8 +228,11 @@ func BoxErrorCallback(errorText string, mo *handler.ManagedObject) {
 	logger.Err("Got error on box discovery for %s (%s): %s", dbo.Name, dbo.Mgmt, errorText)
 }
 
-// BoxAnswerCallback: will be called after answer for this packet/task is recievwd
-func BoxAnswerCallback (response dproto.BoxResponse, mo *handler.ManagedObject) {
+// BoxAnswerCallback: will be called after answer for this packet/task is recievwd.
+// Changeset of response is applied, or held for approval if it deletes more than HoldDeletions rows.
+// In dry-run mode changeset is only computed. If any change fails, nothing is stored.
+// Outcome, changes and errors are stored to run.
+func BoxAnswerCallback (response dproto.BoxResponse, taskTypes []dproto.TaskType, mo *handler.ManagedObject, run *models.DiscoveryRun, dryRun bool) (cs *taskparser.Changeset) {
 	if mo == nil {
 		return
 	}
@@ -114,10 +247,104 @@ func BoxAnswerCallback (response dproto.BoxResponse, mo *handler.ManagedObject)
 	defer func() {
 		if r := recover(); r != nil {
 			logger.Panic("Recovered in BoxAnswerCallback for %s/%s: %+v\n%s", dbo.Name, dbo.Mgmt, r, debug.Stack())
+			run.Outcome, run.Error = models.RunError, fmt.Sprintf("Failed to parse box result: %+v", r)
+		}
+	}()
+
+	var hold bool
+	var err error
+	cs, run.Errors, run.Changes, err = taskparser.ParseBoxResult(response, taskTypes, mo, func(cs *taskparser.Changeset) bool {
+		hold = HoldDeletions > 0 && cs.Deletions() > HoldDeletions
+		return !dryRun && !hold
+	})
+	if err != nil {
+		// nothing is stored
+		logger.Err("%s: %s", dbo.Name, err.Error())
+		logger.Update("%s: changes are rolled back: %s", dbo.Name, err.Error())
+		run.Outcome, run.Error = models.RunError, err.Error()
+		return
+	}
+	if dryRun {
+		return
+	}
+
+	if hold {
+		id, err := holdChangeset(cs, run.RequestID)
+		if err != nil {
+			logger.Err("%s: %s", dbo.Name, err.Error())
+			run.Outcome, run.Error = models.RunError, err.Error()
+			return
+		}
+		deletions := cs.Deletions()
+		logger.Log("%s: changeset #%d deletes %d rows, it's held for approval", dbo.Name, id, deletions)
+		run.Outcome, run.Error = models.RunHeld, fmt.Sprintf("Changeset #%d deletes %d rows, it's held for approval", id, deletions)
+		storeTaskRuns(response, taskTypes, mo)
+		return
+	}
+
+	storeTaskRuns(response, taskTypes, mo)
+	run.Outcome = models.RunSuccess
+	if len(run.Errors) > 0 {
+		run.Outcome = models.RunPartial
+	}
+	return
+}
+
+// saveRun stores finished discovery run. Runs without outcome (skipped) are not stored.
+func saveRun(run *models.DiscoveryRun, dbo models.Object) {
+	if run.Outcome == "" {
+		return
+	}
+	run.FinishedAt = time.Now()
+	if err := db.DB.Insert(run); err != nil {
+		logger.Err("%s: failed to store discovery run: %s", dbo.Name, err.Error())
+	}
+}
+
+// StartRunsPruning removes old discovery runs and expired box requests once an hour
+func StartRunsPruning(retention time.Duration) {
+	go func() {
+		for {
+			if err := models.DiscoveryRunsPrune(retention); err != nil {
+				logger.Err("Failed to prune discovery runs: %s", err.Error())
+			}
+			if err := models.BoxRequestsPrune(); err != nil {
+				logger.Err("Failed to prune box requests: %s", err.Error())
+			}
+			time.Sleep(time.Hour)
 		}
 	}()
+}
+
+// storeTaskRuns remembers time of successful run for every requested task type
+func storeTaskRuns(response dproto.BoxResponse, taskTypes []dproto.TaskType, mo *handler.ManagedObject) {
+	if len(taskTypes) == 0 {
+		taskTypes = models.AllTaskTypes()
+	}
+
+	mo.MX.Lock()
+	dbo := mo.DbObject
+	mo.MX.Unlock()
 
-	taskparser.ParseBoxResult(response, mo, dbo)
+	runs := make(map[string]time.Time, len(dbo.TaskRuns))
+	for k, v := range dbo.TaskRuns {
+		runs[k] = v
+	}
+	now := time.Now()
+	for _, t := range taskTypes {
+		if _, failed := response.Errors[t.String()]; !failed {
+			runs[t.String()] = now
+		}
+	}
+	dbo.TaskRuns = runs
+
+	if _, err := db.DB.Model(&dbo).Column("task_runs").WherePK().Update(); err != nil {
+		logger.Err("%s: failed to store task runs: %s", dbo.Name, err.Error())
+		return
+	}
+	mo.MX.Lock()
+	mo.DbObject.TaskRuns = runs
+	mo.MX.Unlock()
 }
 
 // BoxTimeoutCallback: will be called after timeout waiting for NATS task reply
@@ -151,12 +378,7 @@ func SheduleBox(mo *handler.ManagedObject, urgent bool) {
 		if err == pg.ErrNoRows {
 			// remove obj from memory
 			if _, ok := handler.Objects.Load(dboOld.ID); ok {
-				mo.MX.Lock()
-				if mo.BoxTimer != nil {
-					mo.BoxTimer.Stop()
-					mo.BoxTimer = nil
-				}
-				mo.MX.Unlock()
+				Sched.Remove(dboOld.ID)
 				handler.Objects.Delete(dboOld.ID)
 			}
 			return
@@ -172,22 +394,20 @@ func SheduleBox(mo *handler.ManagedObject, urgent bool) {
 	}
 
 	dp := dpInt.(models.DiscoveryProfile)
-	boxInterval := time.Duration(dp.BoxInterval) * time.Second
-	//boxInterval = 15 * time.Second
+	// interval with backoff for failing objects and jitter
+	delay := Sched.NextDelay(dbo.ID, time.Duration(dp.BoxInterval) * time.Second)
 	if urgent {
-		boxInterval = 5 * time.Second
+		delay = 5 * time.Second
 	}
-	// todo: ondemand scheduling
 
-	// re-schedule only if time is in the past or is null or time - now > boxInterval
+	// re-schedule only if time is in the past or is null or time - now > delay
 	now := time.Now().In(Location)
 	curPlanned := dbo.NextBox.In(Location)
 	//logger.Debug("CUR: %+#v", curPlanned.String())
 	//logger.Debug("NOW: %+#v", now.String())
-	if curPlanned.Unix() <= now.Unix()+15 || time.Until(curPlanned) > (time.Duration(boxInterval)) {
-		next := now.Add(boxInterval).Add(time.Duration(rand.Intn(15)) * time.Second)	// random +-15 sec. Todo: +- 2-5 min.
-		dbo.NextBox = next
-		err := db.DB.Update(&dbo)
+	if curPlanned.Unix() <= now.Unix()+15 || time.Until(curPlanned) > delay {
+		dbo.NextBox = now.Add(delay)
+		_, err := db.DB.Model(&dbo).Column("next_box").WherePK().Update()
 		if err != nil {
 			// continue scheduling, otherwise all will fail after 10-sec DB problems
 			logger.Err("Failed to update next_box in db: %s", err.Error())
@@ -198,12 +418,7 @@ func SheduleBox(mo *handler.ManagedObject, urgent bool) {
 		}
 	}
 
-	mo.MX.Lock()
-	defer mo.MX.Unlock()
-	//mo.BoxTimer = time.AfterFunc(boxInterval, func(){
-	mo.BoxTimer = time.AfterFunc(time.Until(dbo.NextBox), func(){
-		BoxDiscovery(mo)
-	})
+	Sched.Schedule(dbo.ID, dbo.DomainID, dbo.NextBox)
 
 	logger.Debug("Sheduled box discovery for %s (%s) at %+#v", dbo.Name, dbo.Mgmt, dbo.NextBox.In(Location).String())
 }
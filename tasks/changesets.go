@@ -0,0 +1,93 @@
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-pg/pg"
+	"github.com/ircop/ohandler/db"
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"github.com/ircop/ohandler/taskparser"
+)
+
+// HoldDeletions is max. amount of rows, deleted by discovery result. Results deleting more are held for approval.
+// Zero means results are always applied.
+var HoldDeletions int
+
+// holdChangeset stores changeset for approval, instead of applying it
+func holdChangeset(cs *taskparser.Changeset, requestID string) (int64, error) {
+	bts, err := json.Marshal(cs)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot marshal changeset: %s", err.Error())
+	}
+
+	p := models.PendingChangeset{
+		ObjectID:cs.ObjectID,
+		RequestID:requestID,
+		Deletions:cs.Deletions(),
+		Changeset:bts,
+	}
+	if err = models.PendingChangesetHold(&p); err != nil {
+		return 0, fmt.Errorf("Cannot store pending changeset: %s", err.Error())
+	}
+
+	return p.ID, nil
+}
+
+// ApproveChangeset applies pending changeset on behalf of source, in transaction where it's removed. If some change is not actual
+// anymore (row is changed or removed since), nothing is applied, and changeset stays pending. Discovered tables of changeset
+// (unresolved neighbors, link conflicts, FDB, ARP) are not applied: newer runs replaced them.
+// Returns nil changeset if there is no such one.
+func ApproveChangeset(id int64, source string) (*taskparser.Changeset, map[string]int64, error) {
+	p, err := models.PendingChangesetByID(id)
+	if err != nil || p == nil {
+		return nil, nil, err
+	}
+
+	moInt, ok := handler.Objects.Load(p.ObjectID)
+	if !ok {
+		return nil, nil, fmt.Errorf("Object #%d not found", p.ObjectID)
+	}
+	mo := moInt.(*handler.ManagedObject)
+	if !startBox(p.ObjectID) {
+		return nil, nil, fmt.Errorf("Box discovery of object is running")
+	}
+	defer BoxRunning.Delete(p.ObjectID)
+
+	var cs *taskparser.Changeset
+	var changes map[string]int64
+	err = db.DB.RunInTransaction(func(tx *pg.Tx) error {
+		// it could be approved or replaced in the meantime
+		p, err := models.PendingChangesetTake(tx, id)
+		if err != nil || p == nil {
+			return err
+		}
+		cs = &taskparser.Changeset{}
+		if err = json.Unmarshal(p.Changeset, cs); err != nil {
+			return fmt.Errorf("Cannot parse changeset: %s", err.Error())
+		}
+		cs.DropTables()
+
+		logger.Log("%s: applying approved changeset #%d", cs.Name, id)
+		changes, err = taskparser.ApplyTx(tx, cs, source)
+		return err
+	})
+	if err != nil || cs == nil {
+		return nil, nil, err
+	}
+	taskparser.Applied(cs, mo)
+
+	return cs, changes, nil
+}
+
+// RejectChangeset removes pending changeset. Returns false if there is no such one.
+func RejectChangeset(id int64) (bool, error) {
+	p, err := models.PendingChangesetTake(db.DB, id)
+	if err != nil || p == nil {
+		return false, err
+	}
+
+	logger.Log("Pending changeset #%d of object #%d is rejected", id, p.ObjectID)
+	return true, nil
+}
@@ -0,0 +1,280 @@
+package tasks
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/models"
+	"github.com/ircop/ohandler/taskparser"
+	"github.com/sasha-s/go-deadlock"
+	"sort"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobQueued	JobStatus = "queued"
+	JobSent		JobStatus = "sent"
+	JobReplied	JobStatus = "replied"
+	JobParsed	JobStatus = "parsed"
+	JobFailed	JobStatus = "failed"
+	JobTimedOut	JobStatus = "timed-out"
+	// result is not applied, it's held for approval
+	JobHeld		JobStatus = "held"
+)
+
+// finished jobs are kept for polling this long
+const jobRetention = time.Hour
+
+// amount of objects of single job, discovered at once
+const jobConcurrency = 32
+
+// Jobs holds on-demand discovery jobs by ID
+var Jobs sync.Map
+
+// JobObject is a state of job for single object
+type JobObject struct {
+	ObjectID	int64		`json:"object_id"`
+	Name		string		`json:"name"`
+	Status		JobStatus	`json:"status"`
+	RequestID	string		`json:"request_id,omitempty"`
+	Error		string		`json:"error,omitempty"`
+	UpdatedAt	time.Time	`json:"updated_at"`
+	// computed changes of dry-run job
+	Changeset	*taskparser.Changeset	`json:"changeset,omitempty"`
+}
+
+// Job is on-demand box discovery of one or more objects
+type Job struct {
+	ID			string
+	CreatedAt	time.Time
+	FinishedAt	time.Time
+	Tasks		[]dproto.TaskType
+	// results are only computed and returned, not applied
+	DryRun		bool
+
+	objects		[]*JobObject
+	byID		map[int64]*JobObject
+	MX			deadlock.Mutex
+}
+
+// JobInfo is a snapshot of job, returned to REST
+type JobInfo struct {
+	ID			string				`json:"id"`
+	Status		JobStatus			`json:"status"`
+	CreatedAt	time.Time			`json:"created_at"`
+	FinishedAt	*time.Time			`json:"finished_at"`
+	Tasks		[]string			`json:"tasks"`
+	DryRun		bool				`json:"dry_run"`
+	Counts		map[JobStatus]int	`json:"counts"`
+	Objects		[]JobObject			`json:"objects,omitempty"`
+}
+
+func (s JobStatus) finished() bool {
+	return s == JobParsed || s == JobFailed || s == JobTimedOut || s == JobHeld
+}
+
+// progress is used to find least progressed object of the job
+func (s JobStatus) progress() int {
+	switch s {
+	case JobQueued:
+		return 0
+	case JobSent:
+		return 1
+	case JobReplied:
+		return 2
+	}
+	return 3
+}
+
+// StartJob creates job for given objects and runs box discovery for them in background.
+// Empty taskTypes means all tasks. Changesets of dry-run job are returned with job objects instead of being applied.
+func StartJob(objects []models.Object, taskTypes []dproto.TaskType, dryRun bool) (*Job, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot generate job uuid: %s", err.Error())
+	}
+	if len(taskTypes) == 0 {
+		taskTypes = models.AllTaskTypes()
+	}
+
+	job := &Job{
+		ID:id.String(),
+		CreatedAt:time.Now(),
+		Tasks:taskTypes,
+		DryRun:dryRun,
+		objects:make([]*JobObject, 0, len(objects)),
+		byID:make(map[int64]*JobObject, len(objects)),
+	}
+	for i := range objects {
+		if _, ok := job.byID[objects[i].ID]; ok {
+			continue
+		}
+		jo := &JobObject{
+			ObjectID:objects[i].ID,
+			Name:objects[i].Name,
+			Status:JobQueued,
+			UpdatedAt:job.CreatedAt,
+		}
+		job.objects = append(job.objects, jo)
+		job.byID[jo.ObjectID] = jo
+	}
+
+	pruneJobs()
+	Jobs.Store(job.ID, job)
+	go job.run()
+
+	return job, nil
+}
+
+func (j *Job) run() {
+	sem := make(chan struct{}, jobConcurrency)
+	var wg sync.WaitGroup
+
+	for _, jo := range j.objects {
+		moInt, ok := handler.Objects.Load(jo.ObjectID)
+		if !ok {
+			j.setStatus(jo.ObjectID, JobFailed, "Object not found")
+			continue
+		}
+		if IsBoxRunning(jo.ObjectID) {
+			j.setStatus(jo.ObjectID, JobFailed, "Box discovery is already running")
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(mo *handler.ManagedObject) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			BoxDiscovery(mo, j.Tasks, j)
+		}(moInt.(*handler.ManagedObject))
+	}
+
+	wg.Wait()
+}
+
+// setStatus updates status of job object. Job may be nil, in this case nothing happens.
+func (j *Job) setStatus(objectID int64, status JobStatus, errorText string) {
+	if j == nil {
+		return
+	}
+	j.MX.Lock()
+	defer j.MX.Unlock()
+
+	jo, ok := j.byID[objectID]
+	if !ok || jo.Status.finished() {
+		return
+	}
+	jo.Status = status
+	jo.Error = errorText
+	jo.UpdatedAt = time.Now()
+
+	if !status.finished() {
+		return
+	}
+	for _, o := range j.objects {
+		if !o.Status.finished() {
+			return
+		}
+	}
+	j.FinishedAt = jo.UpdatedAt
+}
+
+func (j *Job) setRequest(objectID int64, requestID string) {
+	if j == nil {
+		return
+	}
+	j.MX.Lock()
+	if jo, ok := j.byID[objectID]; ok {
+		jo.RequestID = requestID
+	}
+	j.MX.Unlock()
+	j.setStatus(objectID, JobSent, "")
+}
+
+func (j *Job) setChangeset(objectID int64, cs *taskparser.Changeset) {
+	if j == nil {
+		return
+	}
+	j.MX.Lock()
+	if jo, ok := j.byID[objectID]; ok {
+		jo.Changeset = cs
+	}
+	j.MX.Unlock()
+}
+
+// Info returns snapshot of job; objects are included only if withObjects is set.
+// Job status is status of least progressed object; finished job is 'parsed' only if all objects were parsed.
+func (j *Job) Info(withObjects bool) JobInfo {
+	j.MX.Lock()
+	defer j.MX.Unlock()
+
+	info := JobInfo{
+		ID:j.ID,
+		CreatedAt:j.CreatedAt,
+		Tasks:make([]string, 0, len(j.Tasks)),
+		DryRun:j.DryRun,
+		Counts:make(map[JobStatus]int),
+	}
+	for _, t := range j.Tasks {
+		info.Tasks = append(info.Tasks, t.String())
+	}
+	if !j.FinishedAt.IsZero() {
+		t := j.FinishedAt
+		info.FinishedAt = &t
+	}
+
+	info.Status = JobParsed
+	for _, o := range j.objects {
+		info.Counts[o.Status]++
+		if o.Status.progress() < info.Status.progress() {
+			info.Status = o.Status
+		}
+		if withObjects {
+			info.Objects = append(info.Objects, *o)
+		}
+	}
+	if info.Status.finished() {
+		if info.Counts[JobFailed] > 0 {
+			info.Status = JobFailed
+		} else if info.Counts[JobTimedOut] > 0 {
+			info.Status = JobTimedOut
+		}
+	}
+
+	return info
+}
+
+// JobsList returns snapshots of all known jobs, newest first
+func JobsList() []JobInfo {
+	result := make([]JobInfo, 0)
+	Jobs.Range(func(_, jInt interface{}) bool {
+		result = append(result, jInt.(*Job).Info(false))
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+
+	return result
+}
+
+// pruneJobs forgets jobs that were finished long ago
+func pruneJobs() {
+	Jobs.Range(func(id, jInt interface{}) bool {
+		job := jInt.(*Job)
+		job.MX.Lock()
+		finished := job.FinishedAt
+		job.MX.Unlock()
+		if !finished.IsZero() && time.Since(finished) > jobRetention {
+			Jobs.Delete(id)
+		}
+		return true
+	})
+}
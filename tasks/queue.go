@@ -0,0 +1,314 @@
+package tasks
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/ircop/ohandler/cfg"
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/streamer"
+	"github.com/sasha-s/go-deadlock"
+	"math/rand"
+	"time"
+)
+
+// Sched is the box discovery scheduler, started by InitScheduler
+var Sched *Scheduler
+
+// Scheduler is central box discovery queue. Objects are started by their planned time,
+// with limits of in-flight discoveries overall and per domain.
+type Scheduler struct {
+	maxInflight		int
+	maxPerDomain	int
+	jitter			time.Duration
+	maxBackoff		time.Duration
+	discover		func(objectID int64)
+
+	queue			schedQueue
+	items			map[int64]*schedItem
+	inflight		int
+	domainInflight	map[int64]int
+	failures		map[int64]int
+	dispatched		int64
+	lastLag			time.Duration
+	// only cluster leader dispatches discoveries
+	paused			bool
+	wake			chan struct{}
+	MX				deadlock.Mutex
+}
+
+type schedItem struct {
+	objectID	int64
+	domainID	int64
+	at			time.Time
+	index		int
+}
+
+// schedQueue is a heap of items, ordered by planned time
+type schedQueue []*schedItem
+
+func (q schedQueue) Len() int { return len(q) }
+func (q schedQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q schedQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *schedQueue) Push(x interface{}) {
+	item := x.(*schedItem)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+func (q *schedQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+// SchedulerStats is a snapshot of scheduler state, returned to REST
+type SchedulerStats struct {
+	Queued			int				`json:"queued"`
+	Due				int				`json:"due"`
+	Lag				float64			`json:"lag"`
+	LastLag			float64			`json:"last_dispatch_lag"`
+	InFlight		int				`json:"in_flight"`
+	InFlightDomains	map[string]int	`json:"in_flight_domains"`
+	MaxInFlight		int				`json:"max_in_flight"`
+	MaxPerDomain	int				`json:"max_per_domain"`
+	Backoff			int				`json:"backoff"`
+	Dispatched		int64			`json:"dispatched"`
+	Paused			bool			`json:"paused"`
+}
+
+func newScheduler(maxInflight int, maxPerDomain int, discover func(objectID int64)) *Scheduler {
+	return &Scheduler{
+		maxInflight:maxInflight,
+		maxPerDomain:maxPerDomain,
+		discover:discover,
+		queue:make(schedQueue, 0),
+		items:make(map[int64]*schedItem),
+		domainInflight:make(map[int64]int),
+		failures:make(map[int64]int),
+		wake:make(chan struct{}, 1),
+	}
+}
+
+// InitScheduler creates and starts scheduler with configured limits.
+// Scheduler is paused until this instance becomes leader.
+func InitScheduler(config *cfg.Cfg) {
+	var err error
+	if Location, err = time.LoadLocation("Local"); err != nil {
+		panic(fmt.Errorf("Cannot shedule anything, no local timezone: %s", err.Error()))
+	}
+
+	Sched = newScheduler(config.SchedMaxInflight, config.SchedMaxPerDomain, func(objectID int64) {
+		if moInt, ok := handler.Objects.Load(objectID); ok {
+			BoxDiscovery(moInt.(*handler.ManagedObject), nil, nil)
+		}
+	})
+	Sched.jitter = config.SchedJitter
+	Sched.maxBackoff = config.SchedMaxBackoff
+	Sched.paused = true
+
+	go Sched.run()
+}
+
+// Schedule plans box discovery of object at given time, replacing previous plan
+func (s *Scheduler) Schedule(objectID int64, domainID int64, at time.Time) {
+	s.MX.Lock()
+	if item, ok := s.items[objectID]; ok && item.index >= 0 {
+		item.at = at
+		item.domainID = domainID
+		heap.Fix(&s.queue, item.index)
+	} else {
+		item = &schedItem{objectID:objectID, domainID:domainID, at:at}
+		s.items[objectID] = item
+		heap.Push(&s.queue, item)
+	}
+	s.MX.Unlock()
+
+	s.signal()
+}
+
+// Remove forgets object, e.g. when it's deleted
+func (s *Scheduler) Remove(objectID int64) {
+	s.MX.Lock()
+	defer s.MX.Unlock()
+	if item, ok := s.items[objectID]; ok && item.index >= 0 {
+		heap.Remove(&s.queue, item.index)
+	}
+	delete(s.items, objectID)
+	delete(s.failures, objectID)
+}
+
+// ReportResult counts consecutive failed discoveries of object, which are used for backoff
+func (s *Scheduler) ReportResult(objectID int64, ok bool) {
+	s.MX.Lock()
+	defer s.MX.Unlock()
+	if ok {
+		delete(s.failures, objectID)
+		return
+	}
+	s.failures[objectID]++
+}
+
+// NextDelay returns delay before next discovery of object: interval, doubled for every consecutive
+// failure (but not more than max. backoff), plus-minus jitter
+func (s *Scheduler) NextDelay(objectID int64, interval time.Duration) time.Duration {
+	s.MX.Lock()
+	failures := s.failures[objectID]
+	s.MX.Unlock()
+
+	delay := interval
+	for i := 0; i < failures && delay < s.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.maxBackoff && interval < s.maxBackoff {
+		delay = s.maxBackoff
+	}
+
+	if s.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(s.jitter) * 2)) - s.jitter
+	}
+	if delay < time.Second {
+		delay = time.Second
+	}
+
+	return delay
+}
+
+// Pause stops dispatching and forgets planned objects: new leader plans them from scratch
+func (s *Scheduler) Pause() {
+	s.MX.Lock()
+	s.paused = true
+	s.queue = make(schedQueue, 0)
+	s.items = make(map[int64]*schedItem)
+	s.MX.Unlock()
+}
+
+// Resume starts dispatching again
+func (s *Scheduler) Resume() {
+	s.MX.Lock()
+	s.paused = false
+	s.MX.Unlock()
+
+	s.signal()
+}
+
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	for {
+		wait := s.dispatch()
+		if wait < 0 {
+			<-s.wake
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatch starts due objects, as far as limits allow.
+// Returns time until next planned object, or -1 if there is nothing to wait for but a signal.
+func (s *Scheduler) dispatch() time.Duration {
+	s.MX.Lock()
+	defer s.MX.Unlock()
+
+	if s.paused {
+		return -1
+	}
+
+	// objects of domains that are at limit wait for their turn
+	blocked := make([]*schedItem, 0)
+	defer func() {
+		for _, item := range blocked {
+			heap.Push(&s.queue, item)
+		}
+	}()
+
+	now := time.Now()
+	for s.queue.Len() > 0 {
+		if s.maxInflight > 0 && s.inflight >= s.maxInflight {
+			return -1
+		}
+		head := s.queue[0]
+		if head.at.After(now) {
+			return head.at.Sub(now)
+		}
+		heap.Pop(&s.queue)
+		if s.maxPerDomain > 0 && s.domainInflight[head.domainID] >= s.maxPerDomain {
+			blocked = append(blocked, head)
+			continue
+		}
+
+		delete(s.items, head.objectID)
+		s.inflight++
+		s.domainInflight[head.domainID]++
+		s.dispatched++
+		s.lastLag = now.Sub(head.at)
+		go s.start(head)
+	}
+
+	return -1
+}
+
+func (s *Scheduler) start(item *schedItem) {
+	defer func() {
+		s.MX.Lock()
+		s.inflight--
+		s.domainInflight[item.domainID]--
+		if s.domainInflight[item.domainID] <= 0 {
+			delete(s.domainInflight, item.domainID)
+		}
+		s.MX.Unlock()
+		s.signal()
+	}()
+
+	s.discover(item.objectID)
+}
+
+// Stats returns current queue depth, lag and in-flight discoveries
+func (s *Scheduler) Stats() SchedulerStats {
+	s.MX.Lock()
+	defer s.MX.Unlock()
+
+	st := SchedulerStats{
+		Queued:s.queue.Len(),
+		InFlight:s.inflight,
+		InFlightDomains:make(map[string]int, len(s.domainInflight)),
+		MaxInFlight:s.maxInflight,
+		MaxPerDomain:s.maxPerDomain,
+		Backoff:len(s.failures),
+		Dispatched:s.dispatched,
+		Paused:s.paused,
+		LastLag:s.lastLag.Seconds(),
+	}
+	now := time.Now()
+	for _, item := range s.queue {
+		if item.at.After(now) {
+			continue
+		}
+		st.Due++
+		if lag := now.Sub(item.at).Seconds(); lag > st.Lag {
+			st.Lag = lag
+		}
+	}
+	for domainID, cnt := range s.domainInflight {
+		st.InFlightDomains[streamer.DomainName(domainID)] = cnt
+	}
+
+	return st
+}
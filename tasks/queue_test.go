@@ -0,0 +1,83 @@
+package tasks
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSchedulerLimits(t *testing.T) {
+	release := make(chan struct{})
+	var mx sync.Mutex
+	started := make([]int64, 0)
+
+	s := newScheduler(3, 2, func(objectID int64) {
+		mx.Lock()
+		started = append(started, objectID)
+		mx.Unlock()
+		<-release
+	})
+
+	now := time.Now().Add(-time.Second)
+	// domain 1 has 3 due objects, domain 2 - one; object 5 is not due yet
+	s.Schedule(1, 1, now)
+	s.Schedule(2, 1, now.Add(time.Millisecond))
+	s.Schedule(3, 1, now.Add(time.Millisecond * 2))
+	s.Schedule(4, 2, now.Add(time.Millisecond * 3))
+	s.Schedule(5, 2, time.Now().Add(time.Hour))
+
+	if wait := s.dispatch(); wait != -1 {
+		t.Errorf("global limit is reached, dispatch should wait for signal, got %s", wait)
+	}
+	st := s.Stats()
+	if st.InFlight != 3 || st.Queued != 2 || st.Due != 1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+
+	// wait for goroutines
+	time.Sleep(time.Millisecond * 50)
+	mx.Lock()
+	got := map[int64]bool{}
+	for _, id := range started {
+		got[id] = true
+	}
+	mx.Unlock()
+	if !got[1] || !got[2] || !got[4] || got[3] {
+		t.Errorf("per-domain limit is not respected, started %v", started)
+	}
+
+	// finishing discoveries frees slots for object 3
+	close(release)
+	time.Sleep(time.Millisecond * 50)
+	if wait := s.dispatch(); wait <= 0 || wait > time.Hour {
+		t.Errorf("expected wait for object 5, got %s", wait)
+	}
+	time.Sleep(time.Millisecond * 50)
+	mx.Lock()
+	if len(started) != 4 || started[3] != 3 {
+		t.Errorf("object 3 was not started: %v", started)
+	}
+	mx.Unlock()
+}
+
+func TestSchedulerBackoff(t *testing.T) {
+	s := newScheduler(0, 0, func(int64) {})
+	s.maxBackoff = time.Hour * 4
+
+	if d := s.NextDelay(1, time.Hour); d != time.Hour {
+		t.Errorf("expected 1h, got %s", d)
+	}
+	s.ReportResult(1, false)
+	s.ReportResult(1, false)
+	if d := s.NextDelay(1, time.Hour); d != time.Hour * 4 {
+		t.Errorf("expected 4h after 2 failures, got %s", d)
+	}
+	s.ReportResult(1, false)
+	if d := s.NextDelay(1, time.Hour); d != time.Hour * 4 {
+		t.Errorf("backoff should be limited to 4h, got %s", d)
+	}
+	s.ReportResult(1, true)
+	if d := s.NextDelay(1, time.Hour); d != time.Hour {
+		t.Errorf("backoff should be reset after success, got %s", d)
+	}
+}
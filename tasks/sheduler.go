@@ -1,23 +1,17 @@
 package tasks
 
 import (
-	"fmt"
 	"github.com/ircop/ohandler/handler"
 	"github.com/ircop/ohandler/models"
+	"sort"
 	"time"
 )
 
 var Location *time.Location
 
-// ScheduleObjects makes initial scheduling for all objects
+// ScheduleObjects makes initial scheduling for all objects.
+// Objects that are already due are spread evenly across their box interval, so they are not started all at once.
 func ScheduleObjects() {
-	// Load local location
-	var err error
-	Location, err = time.LoadLocation("Local")
-	if nil != err {
-		panic(fmt.Errorf("Cannot shedule anything, no local timezone: %s", err.Error()))
-	}
-
 	dps := make(map[int64]models.DiscoveryProfile)
 	handler.DiscoveryProfiles.Range(func(key, val interface{}) bool {
 		dp := val.(models.DiscoveryProfile)
@@ -25,9 +19,34 @@ func ScheduleObjects() {
 		return true
 	})
 
+	now := time.Now()
+	// due objects by box interval
+	due := make(map[int64][]models.Object)
 	handler.Objects.Range(func(key, val interface{}) bool {
 		o := val.(*handler.ManagedObject)
-		SheduleBox(o, false)
+		o.MX.Lock()
+		dbo := o.DbObject
+		o.MX.Unlock()
+
+		dp, ok := dps[dbo.DiscoveryID]
+		if !ok {
+			// will be reported by SheduleBox
+			SheduleBox(o, false)
+			return true
+		}
+		if dbo.NextBox.After(now) {
+			Sched.Schedule(dbo.ID, dbo.DomainID, dbo.NextBox)
+			return true
+		}
+		due[dp.BoxInterval] = append(due[dp.BoxInterval], dbo)
 		return true
 	})
+
+	for interval, objects := range due {
+		sort.Slice(objects, func(i, j int) bool { return objects[i].ID < objects[j].ID })
+		step := time.Duration(interval) * time.Second / time.Duration(len(objects))
+		for i := range objects {
+			Sched.Schedule(objects[i].ID, objects[i].DomainID, now.Add(step * time.Duration(i)))
+		}
+	}
 }
@@ -0,0 +1,105 @@
+package tasks
+
+import (
+	"context"
+	"github.com/ircop/dproto"
+	"github.com/ircop/ohandler/handler"
+	"github.com/ircop/ohandler/logger"
+	"github.com/ircop/ohandler/models"
+	"github.com/ircop/ohandler/streamer"
+	"time"
+)
+
+// Drain waits until running box discoveries are finished. When ctx is done, requests still waiting
+// for reply are interrupted: they stay in DB, and their replies are applied after restart.
+func Drain(ctx context.Context) {
+	ticker := time.NewTicker(time.Millisecond * 500)
+	defer ticker.Stop()
+
+	for {
+		running := runningCount()
+		if running == 0 {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logger.Log("Shutdown: interrupting %d box requests, %d discoveries are running", streamer.InterruptAll(), running)
+			// parsing replies is not interrupted, give it a moment
+			for i := 0; i < 10 && runningCount() > 0; i++ {
+				time.Sleep(time.Millisecond * 500)
+			}
+			return
+		}
+	}
+}
+
+func runningCount() int {
+	cnt := 0
+	BoxRunning.Range(func(_, _ interface{}) bool {
+		cnt++
+		return true
+	})
+	return cnt
+}
+
+// Instance is name of this instance: box requests, sent by it, are applied by it only
+var Instance string
+
+// LateReply applies reply to request, that was sent by this instance before restart. Replies to requests
+// of other instances (and to dry runs, that are not stored) are received too, they are skipped.
+func LateReply(reply *dproto.BoxResponse) {
+	request, err := models.BoxRequestTake(reply.ReplyID, Instance)
+	if err != nil {
+		logger.Err("Cannot select box request %s: %s", reply.ReplyID, err.Error())
+		return
+	}
+	if request == nil {
+		logger.Debug("Skipping reply %s: it's not awaited by this instance", reply.ReplyID)
+		return
+	}
+	if time.Now().After(request.ExpiresAt) {
+		logger.Log("Got expired reply %s for object #%d, skipping", reply.ReplyID, request.ObjectID)
+		return
+	}
+
+	moInt, ok := handler.Objects.Load(request.ObjectID)
+	if !ok {
+		logger.Err("Got late reply %s for unknown object #%d", reply.ReplyID, request.ObjectID)
+		return
+	}
+	mo := moInt.(*handler.ManagedObject)
+	mo.MX.Lock()
+	dbo := mo.DbObject
+	mo.MX.Unlock()
+
+	if !startBox(dbo.ID) {
+		logger.Log("%s: skipping late reply %s, box discovery is running", dbo.Name, reply.ReplyID)
+		return
+	}
+	defer BoxRunning.Delete(dbo.ID)
+
+	taskTypes := make([]dproto.TaskType, 0, len(request.Tasks))
+	for _, t := range request.Tasks {
+		if v, ok := dproto.TaskType_value[t]; ok {
+			taskTypes = append(taskTypes, dproto.TaskType(v))
+		}
+	}
+
+	logger.Log("%s: applying late reply %s", dbo.Name, reply.ReplyID)
+	run := models.DiscoveryRun{
+		ObjectID:dbo.ID,
+		RequestID:reply.ReplyID,
+		StartedAt:request.SentAt,
+		Tasks:request.Tasks,
+	}
+	defer saveRun(&run, dbo)
+
+	if reply.Error != "" {
+		run.Outcome, run.Error = models.ErrorOutcome(reply.Error), reply.Error
+		BoxErrorCallback(reply.Error, mo)
+		return
+	}
+	BoxAnswerCallback(*reply, taskTypes, mo, &run, false)
+}
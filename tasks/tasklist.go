@@ -7,4 +7,10 @@ var BoxRunning sync.Map
 func IsBoxRunning(id int64) bool {
 	_, ok := BoxRunning.Load(id)
 	return ok
-}
\ No newline at end of file
+}
+
+// startBox marks box discovery of object as running. Returns false, if it's running already.
+func startBox(id int64) bool {
+	_, running := BoxRunning.LoadOrStore(id, true)
+	return !running
+}